@@ -0,0 +1,136 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/brentp/irelate/interfaces"
+)
+
+// allele is a single REF/ALT pair after decomposition of a (possibly) multi-allelic
+// record and trimming of the bases shared by REF and ALT.
+type allele struct {
+	pos uint32
+	ref string
+	alt string
+}
+
+func isSymbolic(alt string) bool {
+	return len(alt) == 0 || alt[0] == '<' || alt == "*" || strings.ContainsAny(alt, "[].")
+}
+
+// trimAllele removes the suffix and then the prefix shared by ref and alt so that
+// equivalent alleles from decomposed and un-decomposed records compare equal.
+// e.g. (10, ATG, ACG) -> (11, T, C) and (10, ATT, AT) -> (11, T, "").
+// pos is 0-based and is advanced by the number of bases trimmed from the left.
+func trimAllele(pos uint32, ref, alt string) allele {
+	ref, alt = strings.ToUpper(ref), strings.ToUpper(alt)
+	if isSymbolic(alt) {
+		return allele{pos, ref, alt}
+	}
+	for len(ref) > 0 && len(alt) > 0 && ref[len(ref)-1] == alt[len(alt)-1] {
+		ref, alt = ref[:len(ref)-1], alt[:len(alt)-1]
+	}
+	for len(ref) > 0 && len(alt) > 0 && ref[0] == alt[0] {
+		ref, alt = ref[1:], alt[1:]
+		pos++
+	}
+	return allele{pos, ref, alt}
+}
+
+// TrimAllele is trimAllele for the other packages that give a value for each allele of
+// a variant (e.g. consequence) so that they trim the bases shared by REF and ALT in the
+// same order. It returns the 0-based position and the trimmed, upper-case REF and ALT.
+func TrimAllele(pos uint32, ref, alt string) (uint32, string, string) {
+	a := trimAllele(pos, ref, alt)
+	return a.pos, a.ref, a.alt
+}
+
+// decompose splits v into one trimmed allele per alternate.
+func decompose(v interfaces.IRefAlt) []allele {
+	alts := v.Alt()
+	out := make([]allele, len(alts))
+	for i, alt := range alts {
+		out[i] = trimAllele(v.Start(), v.Ref(), alt)
+	}
+	return out
+}
+
+func hasNonRef(alts []string) bool {
+	return len(alts) > 0 && alts[0] == "<NON_REF>"
+}
+
+// matchAlleles decomposes q and o and returns, for each alternate in q, the index
+// of the equivalent alternate in o or -1 if there is none.
+func matchAlleles(q, o interfaces.IRefAlt) []int {
+	qa, oa := decompose(q), decompose(o)
+	idxs := make([]int, len(qa))
+	for i, a := range qa {
+		idxs[i] = -1
+		for j, b := range oa {
+			if a == b {
+				idxs[i] = j
+				break
+			}
+		}
+	}
+	return idxs
+}
+
+// sameAllele is the decomposition-aware counterpart of interfaces.Same for
+// strict matching: q and o are the same if, after decomposing both, any
+// alternate in q has an equivalent alternate in o.
+func sameAllele(q, o interfaces.IRefAlt) bool {
+	if !interfaces.SameChrom(q.Chrom(), o.Chrom()) {
+		return false
+	}
+	if hasNonRef(q.Alt()) || hasNonRef(o.Alt()) {
+		return interfaces.SameVariant(q, o)
+	}
+	for _, i := range matchAlleles(q, o) {
+		if i != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// refIndexes converts per-alternate indexes from matchAlleles to the indexes of
+// a Number=R field where the REF value is always in the first slot.
+func refIndexes(altIdxs []int) []int {
+	out := make([]int, len(altIdxs)+1)
+	for i, ai := range altIdxs {
+		out[i+1] = -1
+		if ai != -1 {
+			out[i+1] = ai + 1
+		}
+	}
+	return out
+}
+
+// gtIndex gives the index of the (diploid) genotype a/b in a Number=G field
+// per the VCF spec: F(j/k) = k*(k+1)/2 + j with j <= k.
+func gtIndex(a, b int) int {
+	if a > b {
+		a, b = b, a
+	}
+	return b*(b+1)/2 + a
+}
+
+// genotypeIndexes converts per-alternate indexes from matchAlleles to the
+// indexes of a Number=G field so that, for each genotype in the query allele
+// order, we get the same genotype in the annotation allele order (or -1 if
+// either allele is not in the annotation).
+func genotypeIndexes(altIdxs []int) []int {
+	alleles := refIndexes(altIdxs)
+	out := make([]int, gtIndex(len(alleles)-1, len(alleles)-1)+1)
+	for k := range alleles {
+		for j := 0; j <= k; j++ {
+			if alleles[j] == -1 || alleles[k] == -1 {
+				out[gtIndex(j, k)] = -1
+			} else {
+				out[gtIndex(j, k)] = gtIndex(alleles[j], alleles[k])
+			}
+		}
+	}
+	return out
+}
@@ -1,21 +1,20 @@
 package api
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"reflect"
-	"strconv"
 	"strings"
 	"sync"
 	"unsafe"
 
 	"github.com/biogo/hts/sam"
-	"github.com/brentp/bix"
 	"github.com/brentp/goluaez"
 	"github.com/brentp/irelate/interfaces"
 	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/fasta"
+	"github.com/brentp/vcfanno/liftover"
 	"github.com/brentp/vcfgo"
 )
 
@@ -50,20 +49,107 @@ type Source struct {
 	Name string
 	// Number from header of annotation is A (Number=A)
 	NumberA bool
+	// Number from header of annotation is R (Number=R)
+	NumberR bool
+	// Number from header of annotation is G (Number=G)
+	NumberG bool
 	// column number in bed file or ...
 	Column int
-	// info name in VCF. (can also be ID or FILTER).
+	// info name in VCF. (can also be ID or FILTER). For a VariantSource (see
+	// IsVariantSource), the field it computes, e.g. gc50 from a reference.
 	Field string
-	// 0-based index of the file order this source is from.
+	// 0-based index of the file order this source is from. Sources with a JoinOn or
+	// from a VariantSource are not counted.
 	Index int
-	mu    sync.Mutex
-	code  string
-	Vm    *goluaez.State
+	// JoinOn, if set, annotates with the rows of File that share a key with the query
+	// variant rather than those that overlap it. It is "ID" or "INFO:<field>" and gives
+	// the key of the query and of a VCF File. Multi-valued keys are split on , ; | and &.
+	JoinOn string
+	// JoinColumn is the 1-based column of the key when File is tab-delimited. Default 1.
+	JoinColumn int
+	// Chain, if set, is a UCSC chain file from the build of the query to the build of
+	// File. Each query region is lifted to find the annotations in File which are mapped
+	// back to the query.
+	Chain string
+	// FeatureTypes, if set, limits the features of a gene model File (e.g. GFF3) to
+	// those with these types (e.g. exon). Upstream and Downstream extend each feature
+	// by that many bases 5' and 3' of its strand. See FeatureSelector.
+	FeatureTypes         []string
+	Upstream, Downstream int
+	// Fasta is the reference given to the VariantSource of File (see IsVariantSource),
+	// used to decode a CRAM File (see IsCram) or, with a Chain, the reference of the
+	// query used to left-align the indels lifted from the - strand.
+	Fasta string
+
+	code string
+	Vm   *goluaez.State
+
+	// the output Type, Number and Description are resolved once, from the header of
+	// the annotation file, so that the Source can be used for many query files.
+	once   sync.Once
+	ntype  string
+	number string
+	desc   string
+}
+
+// clone copies the user-specified fields of s.
+func (s *Source) clone() *Source {
+	return &Source{File: s.File, Op: s.Op, Name: s.Name, Column: s.Column, Field: s.Field, Index: s.Index,
+		JoinOn: s.JoinOn, JoinColumn: s.JoinColumn, Chain: s.Chain, FeatureTypes: s.FeatureTypes, Upstream: s.Upstream,
+		Downstream: s.Downstream, Fasta: s.Fasta, NumberA: s.NumberA, NumberR: s.NumberR, NumberG: s.NumberG}
+}
+
+// selectsFeatures indicates that s uses FeatureTypes, Upstream or Downstream.
+func (s *Source) selectsFeatures() bool {
+	return len(s.FeatureTypes) > 0 || s.Upstream != 0 || s.Downstream != 0
+}
+
+// resolveOp checks the op and sets any op that depends only on the file type so
+// that it does not need to be changed while annotating.
+func (s *Source) resolveOp() error {
+	if !IsAlignments(s.File) {
+		return nil
+	}
+	switch s.Field {
+	case "mapq", "seq", "DP2":
+	default:
+		// for coverage, we just sum the values. 'count' is kept for backwards compat.
+		if s.Op == "count" {
+			s.Op = "sum"
+		}
+		if s.Op != "sum" {
+			return fmt.Errorf("%w: field %s specifed for bam: %s with op: %s", ErrUnknownOp, s.Field, s.File, s.Op)
+		}
+	}
+	return nil
+}
+
+// checkHeader checks that the op can use the values of a field with the VCF Type htype
+// and Number (from the header of the annotation or "" if they are not known). An op that
+// accepts only numbers (see Spec.Accepts) can not use a String, Character or Flag field
+// and a PositionReducer can not use a field with a value per allele or genotype.
+func (s *Source) checkHeader(htype string, number string) error {
+	switch htype {
+	case "String", "Character", "Flag":
+		if s.IsNumber() {
+			return fmt.Errorf("%w: op %s needs numbers but %s is Type=%s in %s for %s (use a lua: op to convert it)",
+				ErrConfig, s.Op, s.Field, htype, s.File, s.Name)
+		}
+	}
+	switch number {
+	case "A", "R", "G":
+		if _, _, ok := LookupPositionReducer(s.Op); ok {
+			return fmt.Errorf("%w: op %s needs a value per interval but %s is Number=%s in %s for %s",
+				ErrConfig, s.Op, s.Field, number, s.File, s.Name)
+		}
+	}
+	return nil
 }
 
 // IsNumber indicates that we expect the Source to return a number given the op
 func (s *Source) IsNumber() bool {
-	return s.Op == "mean" || s.Op == "max" || s.Op == "min" || s.Op == "count" || s.Op == "median" || s.Op == "sum"
+	spec, ok := ReducerSpec(s.Op)
+	return ok && spec.Accepts == AcceptsNumber
 }
 
 // Annotator holds the information to annotate a file.
@@ -72,6 +158,35 @@ type Annotator struct {
 	Strict    bool // require a variant to have same ref and share at least 1 alt
 	Ends      bool // annotate the ends of the variant in addition to the interval itself.
 	PostAnnos []*PostAnnotation
+	// AllowBuildMismatch logs, rather than returns, an ErrBuildMismatch from Setup.
+	AllowBuildMismatch bool
+	// FloatFormat, if set, is the fmt verb (e.g. "%.6g") used to write the Float values
+	// from the numeric ops. By default, vcfgo decides the formatting.
+	FloatFormat string
+
+	// the tables for Sources with a JoinOn are loaded once, by the first Setup.
+	joinOnce sync.Once
+	joinErr  error
+	joins    map[string]*joinTable
+
+	// the chain files are also loaded once.
+	chainOnce sync.Once
+	chainErr  error
+	chains    map[string]*liftover.Chains
+	// unmapped counts the lifted annotations that can not be mapped back to the query.
+	unmapped int64
+
+	// as are the FASTAs of the Sources from a reference.
+	fastaOnce sync.Once
+	fastaErr  error
+	fastas    map[string]*fasta.Reader
+	// fastaBuilds is the build of each FASTA (see DetectBuild) or "".
+	fastaBuilds map[string]string
+
+	// and the VariantSources, by variantSourceKey.
+	variantOnce    sync.Once
+	variantErr     error
+	variantSources map[string]VariantSource
 }
 
 // LuaOp uses go-lua to run a lua snippet on a list of values and return a single value.
@@ -97,6 +212,8 @@ type PostAnnotation struct {
 	Op     string
 	Name   string
 	Type   string
+	// Fasta is the reference used by the identifier ops (see IsIdentifierOp).
+	Fasta string
 
 	code string
 
@@ -109,51 +226,61 @@ type PostAnnotation struct {
 // If ends is true, it will annotate the 1 base ends of the interval as well as the
 // interval itself. If strict is true, when overlapping variants, they must share
 // the ref allele and at least 1 alt allele.
-func NewAnnotator(sources []*Source, lua string, ends bool, strict bool, postannos []PostAnnotation) *Annotator {
-	for _, s := range sources {
-		if e := checkSource(s); e != nil {
-			log.Fatal(e)
-		}
-	}
-
+// The sources and postannos are copied so they are not modified and can be used
+// for other Annotators. A single Annotator can be used to annotate many query files
+// (concurrently) with a call to Setup for each.
+func NewAnnotator(sources []*Source, lua string, ends bool, strict bool, postannos []PostAnnotation) (*Annotator, error) {
 	a := Annotator{
-		Sources:   sources,
+		Sources:   make([]*Source, len(sources)),
 		Strict:    strict,
 		Ends:      ends,
 		PostAnnos: make([]*PostAnnotation, len(postannos)),
 	}
+	for i, s := range sources {
+		if e := checkSource(s); e != nil {
+			return nil, e
+		}
+		a.Sources[i] = s.clone()
+		if e := a.Sources[i].resolveOp(); e != nil {
+			return nil, e
+		}
+	}
+
 	var err error
 	for i := range postannos {
-		for k := 0; k < len(postannos[i].Vms); k++ {
-			//postannos[i].Vms[k], err = goluaez.NewState(lua)
-			postannos[i].Vms[k], err = goluaez.NewState(lua)
-			postannos[i].mus[k] = make(chan int, 1)
-			postannos[i].mus[k] <- k
+		post := postannos[i]
+		for k := 0; k < len(post.Vms); k++ {
+			post.Vms[k], err = goluaez.NewState(lua)
+			post.mus[k] = make(chan int, 1)
+			post.mus[k] <- k
 		}
 		if err != nil {
-			log.Fatalf("error parsing custom lua:%s", err)
+			return nil, fmt.Errorf("%w: parsing custom lua: %s", ErrLua, err)
 		}
-		if strings.HasPrefix(postannos[i].Op, "lua:") {
-			postannos[i].code = postannos[i].Op[4:]
-		} else if _, ok := Reducers[postannos[i].Op]; !ok {
-			log.Fatalf("unknown op from %s: %s", postannos[i].Name, postannos[i].Op)
+		if strings.HasPrefix(post.Op, "lua:") {
+			post.code = post.Op[4:]
+		} else if IsIdentifierOp(post.Op) {
+			if post.Fasta == "" {
+				return nil, fmt.Errorf("%w: no reference (fasta) for op %s of %s", ErrConfig, post.Op, post.Name)
+			}
+			if post.Type == "" {
+				post.Type = "String"
+			}
+		} else if _, _, ok := LookupReducer(post.Op); !ok {
+			return nil, fmt.Errorf("%w from %s: %s", ErrUnknownOp, post.Name, post.Op)
 		}
-		a.PostAnnos[i] = &postannos[i]
+		a.PostAnnos[i] = &post
 	}
 	for _, src := range a.Sources {
 		src.Vm, err = goluaez.NewState(lua) // create a new vm for each source and lock in the source
 		if err != nil {
-			log.Fatalf("error parsing custom lua:%s", err)
+			return nil, fmt.Errorf("%w: parsing custom lua: %s", ErrLua, err)
 		}
 		if strings.HasPrefix(src.Op, "lua:") {
-			var err error
 			src.code = src.Op[4:]
-			if err != nil {
-				log.Fatalf("error parsing op: %s for file %s", src.Op, src.File)
-			}
 		}
 	}
-	return &a
+	return &a, nil
 }
 
 func unsafeString(b []byte) string {
@@ -162,7 +289,36 @@ func unsafeString(b []byte) string {
 
 func checkSource(s *Source) error {
 	if s.Name == "" {
-		return fmt.Errorf("no name specified for %v", s)
+		return fmt.Errorf("%w: no name specified for %v", ErrConfig, s)
+	}
+	if s.JoinOn != "" {
+		if err := CheckJoinOn(s.JoinOn); err != nil {
+			return err
+		}
+		if _, _, ok := LookupPositionReducer(s.Op); ok || s.Op == "by_alt" {
+			return fmt.Errorf("%w: op %s can not be used with join_on for %s", ErrConfig, s.Op, s.Name)
+		}
+	}
+	if s.Upstream < 0 || s.Downstream < 0 {
+		return fmt.Errorf("%w: upstream and downstream must not be negative for %s", ErrConfig, s.Name)
+	}
+	if _, _, ok := LookupPositionReducer(s.Op); ok && IsAlignments(s.File) && s.Field != "mapq" && s.Field != "seq" {
+		return fmt.Errorf("%w: op %s needs the position of each value but %s of %s has none for %s", ErrConfig, s.Op,
+			s.Field, s.File, s.Name)
+	}
+	if s.selectsFeatures() && (s.JoinOn != "" || IsVariantSource(s.File)) {
+		return fmt.Errorf("%w: feature_types, upstream and downstream can not be used with join_on or %s for %s", ErrConfig, s.File, s.Name)
+	}
+	if IsVariantSource(s.File) {
+		if _, _, ok := LookupPositionReducer(s.Op); ok || s.Op == "by_alt" || s.JoinOn != "" || s.Chain != "" {
+			return fmt.Errorf("%w: op %s, join_on and chain can not be used with %s for %s", ErrConfig, s.Op, s.File, s.Name)
+		}
+	} else if IsCram(s.File) {
+		if s.Fasta == "" {
+			return fmt.Errorf("%w: no reference given for the CRAM %s for %s", ErrConfig, s.File, s.Name)
+		}
+	} else if s.Fasta != "" && s.Chain == "" {
+		return fmt.Errorf("%w: fasta can not be used with %s for %s", ErrConfig, s.File, s.Name)
 	}
 	return nil
 }
@@ -188,7 +344,7 @@ func sameInterval(v interfaces.IVariant, other interfaces.Relatable, strict bool
 		if !strict {
 			return &o.Interval, true
 		}
-		return &o.Interval, interfaces.Same(v, o, strict)
+		return &o.Interval, sameAllele(v, o)
 	}
 	return nil, false
 }
@@ -229,6 +385,24 @@ func byAlt(in []interface{}, qAlts []string, existing [][]string) [][]string {
 // C,G  | T,G | 22,23      | .,23
 // G,C  | C,G | 22,23      | 23,22
 func handleA(val interface{}, qAlts []string, oAlts []string, out []interface{}) []interface{} {
+	altIdxs := make([]int, len(qAlts))
+	for iq, q := range qAlts {
+		altIdxs[iq] = -1
+		for io, o := range oAlts {
+			if q == o {
+				altIdxs[iq] = io
+				break
+			}
+		}
+	}
+	return remapA(val, altIdxs, out)
+}
+
+// remapA places the Number=A values from `val` into `out` according to altIdxs
+// which gives, for each query alternate, the index of the matching annotation
+// alternate (or -1). It is also used for Number=R and Number=G fields with the
+// indexes from refIndexes and genotypeIndexes.
+func remapA(val interface{}, altIdxs []int, out []interface{}) []interface{} {
 	vals := reflect.ValueOf(val)
 
 	if vals.Kind() != reflect.Slice {
@@ -236,32 +410,18 @@ func handleA(val interface{}, qAlts []string, oAlts []string, out []interface{})
 		vals = reflect.ValueOf(val)
 	}
 	if out == nil {
-		out = make([]interface{}, len(qAlts))
+		out = make([]interface{}, len(altIdxs))
 		for i := 0; i < len(out); i++ {
 			out[i] = "."
 		}
 	}
 
-	altIdxs := make([]int, len(qAlts))
-	for iq, q := range qAlts {
-		var found bool
-		for io, o := range oAlts {
-			if q == o {
-				found = true
-				altIdxs[iq] = io
-				break
-			}
-		}
-		if !found {
-			altIdxs[iq] = -1
-		}
-	}
 	for i, ai := range altIdxs {
 		if ai == -1 {
 			continue
 		}
 		if ai >= vals.Len() {
-			log.Printf("WARNING: out of bounds with query: %v, anno: %v, vals: %v", qAlts, oAlts, vals)
+			log.Printf("WARNING: out of bounds with allele indexes: %v, vals: %v", altIdxs, vals)
 			if vals.Len() == 1 {
 				out[i] = vals.Index(0).Interface()
 			}
@@ -273,21 +433,23 @@ func handleA(val interface{}, qAlts []string, oAlts []string, out []interface{})
 }
 
 // collect applies the reduction (op) specified in src on the rels.
-func collect(v interfaces.IVariant, rels []interfaces.Relatable, src *Source, strict bool) ([]interface{}, error) {
+// It also returns the position that each value came from for use by a PositionReducer.
+func collect(v interfaces.IVariant, rels []interfaces.Relatable, src *Source, strict bool) ([]interface{}, []interfaces.IPosition, error) {
 	coll := make([]interface{}, 0, len(rels))
+	poss := make([]interfaces.IPosition, 0, len(rels))
 	var val interface{}
 	var valByAlt [][]string
 	var finalerr error
 	for _, other := range rels {
 		if int(other.Source())-1 != src.Index {
-			log.Fatalf("got source %d with related %d", src.Index, other.Source())
+			return nil, nil, fmt.Errorf("got source %d with related %d", src.Index, other.Source())
 		}
 		// need this check for the ends stuff.
 		if !overlap(v.(interfaces.IPosition), other) {
 			continue
 		}
 		if o, ok := other.(interfaces.IVariant); ok {
-			if strict && !interfaces.Same(v, o, strict) {
+			if strict && !sameAllele(v, o) {
 				continue
 			}
 			// special case pulling the rsid
@@ -317,7 +479,7 @@ func collect(v interfaces.IVariant, rels []interfaces.Relatable, src *Source, st
 				// with alt uses handleA machinery and then concats each value with then
 				// alternate allele.
 				out := make([]interface{}, len(v.Alt()))
-				handleA(val, v.Alt(), o.Alt(), out)
+				remapA(val, matchAlleles(v, o), out)
 				valByAlt = byAlt(out, v.Alt(), valByAlt)
 				continue
 			}
@@ -336,12 +498,32 @@ func collect(v interfaces.IVariant, rels []interfaces.Relatable, src *Source, st
 				if len(v.Alt()) == 1 && len(o.Alt()) == 1 && v.Alt()[0] == o.Alt()[0] {
 					out[0] = val
 				} else {
-					handleA(val, v.Alt(), o.Alt(), out)
+					remapA(val, matchAlleles(v, o), out)
 				}
 				// coll updated in-place via out
 				continue
 			}
 
+			// Number=R and Number=G are like Number=A but also have a slot for the REF
+			// allele and, for G, one for each genotype so those must be remapped as well.
+			if (src.NumberR || src.NumberG) && src.Op == "self" && src.Field != "ID" && src.Field != "FILTER" {
+				idxs := matchAlleles(v, o)
+				if src.NumberG {
+					idxs = genotypeIndexes(idxs)
+				} else {
+					idxs = refIndexes(idxs)
+				}
+				var out []interface{}
+				if len(coll) > 0 {
+					out = coll[0].([]interface{})
+				} else {
+					out = make([]interface{}, len(idxs))
+					coll = append(coll, out)
+				}
+				remapA(val, idxs, out)
+				continue
+			}
+
 			if arr, ok := val.([]interface{}); ok {
 				if src.Op == "uniq" || src.Op == "concat" {
 					sarr := make([]string, len(arr))
@@ -349,25 +531,29 @@ func collect(v interfaces.IVariant, rels []interfaces.Relatable, src *Source, st
 						sarr[i] = fmt.Sprintf("%v", v)
 					}
 					coll = append(coll, strings.Join(sarr, ","))
+					poss = append(poss, other)
 				} else {
 					coll = append(coll, arr...)
+					for range arr {
+						poss = append(poss, other)
+					}
 				}
 			} else {
 
 				coll = append(coll, val)
+				poss = append(poss, other)
 			}
 		} else if o, ok := sameInterval(v, other, strict); o != nil {
 			if !ok {
 				continue
 			}
-			if src.Column-1 >= len(o.Fields) {
-				log.Println(src)
-				log.Println(string(bytes.Join(o.Fields, []byte{'\t'})))
+			if src.Column < 1 || src.Column > len(o.Fields) {
+				return nil, nil, fmt.Errorf("%w: column %d not found for %s in %s", ErrConfig, src.Column, src.Name, src.File)
 			}
 			sval := string(o.Fields[src.Column-1])
 			if src.IsNumber() {
 
-				v, e := strconv.ParseFloat(sval, 32)
+				v, e := parseNumber(sval)
 				if e != nil {
 					finalerr = e
 				}
@@ -375,6 +561,7 @@ func collect(v interfaces.IVariant, rels []interfaces.Relatable, src *Source, st
 			} else {
 				coll = append(coll, strings.Replace(sval, ";", ",", -1))
 			}
+			poss = append(poss, other)
 		} else if bam, ok := other.(*parsers.Bam); ok {
 			if bam.MapQ() < 1 || (bam.Flags&(sam.QCFail|sam.Unmapped|sam.Duplicate|sam.Secondary) != 0) {
 				continue
@@ -390,18 +577,15 @@ func collect(v interfaces.IVariant, rels []interfaces.Relatable, src *Source, st
 				switch src.Field {
 				case "mapq":
 					coll = append(coll, bam.MapQ())
+					poss = append(poss, other)
 				case "seq":
 					coll = append(coll, string(bam.Seq.Expand()))
+					poss = append(poss, other)
 				case "DP2":
 					coll = append(coll, (bam.Flags&sam.Reverse) != 0)
 				default:
 					if src.Op != "sum" {
-						if src.Op == "count" {
-							// backwards compat.
-							src.Op = "sum"
-						} else {
-							log.Fatalf("unknown field %s specifed for bam: %s with op: %s\n", src.Field, src.File, src.Op)
-						}
+						return nil, nil, fmt.Errorf("%w: field %s specifed for bam: %s with op: %s", ErrUnknownOp, src.Field, src.File, src.Op)
 					}
 					// for coverage, we just sum the values.
 					if len(coll) == 0 {
@@ -426,48 +610,85 @@ func collect(v interfaces.IVariant, rels []interfaces.Relatable, src *Source, st
 			}
 		}
 	}
-	return coll, finalerr
+	return coll, poss, finalerr
 }
 
 // AnnotateOne annotates a relatable with the Sources in an Annotator.
 // In most cases, no need to specify end (it should always be a single
 // arugment indicting LEFT, RIGHT, or INTERVAL, used from AnnotateEnds
+// A fatal error (see IsFatal) stops the annotation of r; after any other error (e.g.
+// ErrOp), the remaining Sources are still used and the last such error is returned.
 func (a *Annotator) AnnotateOne(r interfaces.Relatable, strict bool, end ...string) error {
-	if len(r.Related()) == 0 {
-		return nil
-	}
 	prefix := ""
 	if len(end) > 0 {
 		prefix = end[0]
 		if len(end) > 1 {
-			log.Fatalf("too many ends in AnnotateOne")
+			return fmt.Errorf("too many ends in AnnotateOne")
+		}
+	}
+	var e error
+	// joins are by key and values from a reference are for the variant so they are not
+	// used for the ends.
+	if a.joins != nil && prefix == "" {
+		if v, ok := r.(interfaces.IVariant); ok {
+			if e = a.annotateJoins(v); IsFatal(e) {
+				return e
+			}
+		}
+	}
+	if a.variantSources != nil && prefix == "" {
+		if v, ok := r.(interfaces.IVariant); ok {
+			if err := a.annotateVariantSources(v); IsFatal(err) {
+				return err
+			} else if err != nil {
+				e = err
+			}
 		}
 	}
+	if len(r.Related()) == 0 {
+		return e
+	}
 
 	parted := a.partition(r)
 	var v interfaces.IVariant
 	v, ok := r.(interfaces.IVariant)
 	if !ok {
-		log.Fatal("can't annotate non-IVariant", r)
+		return fmt.Errorf("can't annotate non-IVariant: %v", r)
 	}
 
 	var src *Source
-	var e error
 	for i := range a.Sources {
 		src = a.Sources[i]
-		if len(parted) <= src.Index {
+		if src.JoinOn != "" || IsVariantSource(src.File) || len(parted) <= src.Index {
 			continue
 		}
 
-		related := parted[src.Index]
+		related, err := summarized(r, parted[src.Index])
+		if err != nil {
+			return &VariantError{Chrom: v.Chrom(), Pos: int(v.Start()) + 1, Name: src.Name, Err: err}
+		}
 		if len(related) == 0 {
 			continue
 		}
-		vals, err := collect(v, related, src, strict)
+		vals, poss, err := collect(v, related, src, strict)
 		if err != nil {
+			if IsFatal(err) {
+				return &VariantError{Chrom: v.Chrom(), Pos: int(v.Start()) + 1, Name: src.Name, Err: err}
+			}
 			e = err
 		}
-		src.AnnotateOne(v, vals, prefix)
+		if fn, _, ok := LookupPositionReducer(src.Op); ok {
+			err = src.annotatePositions(v, fn, poss, vals, prefix, a.FloatFormat)
+		} else {
+			err = src.annotate(v, vals, prefix, a.FloatFormat)
+		}
+		if err != nil {
+			// the other sources are still annotated unless the error is fatal.
+			if IsFatal(err) {
+				return &VariantError{Chrom: v.Chrom(), Pos: int(v.Start()) + 1, Name: src.Name, Err: err}
+			}
+			e = &VariantError{Chrom: v.Chrom(), Pos: int(v.Start()) + 1, Name: src.Name, Err: err}
+		}
 	}
 	return e
 }
@@ -483,10 +704,16 @@ func v0len(vals []interface{}) int {
 
 }
 
-// AnnotateOne annotates a single variant with the vals
-func (s *Source) AnnotateOne(v interfaces.IVariant, vals []interface{}, prefix string) {
+// AnnotateOne annotates a single variant with the vals. An error is returned if the op
+// can not handle the vals (e.g. ErrMultiValue).
+func (s *Source) AnnotateOne(v interfaces.IVariant, vals []interface{}, prefix string) error {
+	return s.annotate(v, vals, prefix, "")
+}
+
+// annotate is AnnotateOne with the format of Float values (see Annotator.FloatFormat).
+func (s *Source) annotate(v interfaces.IVariant, vals []interface{}, prefix string, format string) error {
 	if len(vals) == 0 {
-		return
+		return nil
 	}
 	if s.code != "" {
 		luaval := s.LuaOp(v, s.code, vals)
@@ -529,13 +756,56 @@ func (s *Source) AnnotateOne(v interfaces.IVariant, vals []interface{}, prefix s
 
 			}
 		}
-		val := Reducers[s.Op](vals)
-		v.Info().Set(prefix+s.Name, val)
+		fn, _, _ := LookupReducer(s.Op)
+		val, err := reduce(func() interface{} { return fn(vals) })
+		if err != nil {
+			return err
+		}
+		v.Info().Set(prefix+s.Name, formatNumber(val, format))
+	}
+	return nil
+}
+
+// annotatePositions annotates a single variant with a PositionReducer. The Sources whose
+// values do not come with a position (e.g. bam coverage and Number=A fields) are refused
+// by checkSource and checkHeader; if there are any such values, no annotation is added.
+func (s *Source) annotatePositions(v interfaces.IVariant, fn PositionReducer, poss []interfaces.IPosition, vals []interface{}, prefix string, format string) error {
+	if len(vals) == 0 || len(poss) != len(vals) {
+		return nil
+	}
+	val, err := reduce(func() interface{} { return fn(v, poss, vals) })
+	if val != nil {
+		v.Info().Set(prefix+s.Name, formatNumber(val, format))
 	}
+	return err
 }
 
-// UpdateHeader does what it suggests but handles left and right ends for svs
+// UpdateHeader does what it suggests but handles left and right ends for svs.
+// htype, number and desc are from the header of the annotation file. They are used to
+// resolve the output Name, Type and Number on the first call; later calls (e.g. for
+// other query files) re-use those so the Source is not changed.
 func (s *Source) UpdateHeader(r HeaderUpdater, ends bool, htype string, number string, desc string) {
+	s.once.Do(func() { s.resolveHeader(htype, number, desc) })
+	r.AddInfoToHeader(s.Name, s.number, s.ntype, s.desc)
+	if ends {
+		for _, end := range []string{LEFT, RIGHT} {
+			d := fmt.Sprintf("%s at end %s", s.desc, strings.TrimSuffix(end, "_"))
+			r.AddInfoToHeader(end+s.Name, s.number, s.ntype, d)
+		}
+	}
+}
+
+// resolveHeader sets the output Type, Number and Description and strips any type
+// suffix (e.g. _float) from the Name.
+func (s *Source) resolveHeader(htype string, number string, desc string) {
+	// must set this to accurately represent multi-allelics.
+	if number == "1" && s.Op == "self" && !IsAlignments(s.File) && !IsVariantSource(s.File) {
+		log.Printf("WARNING: using op 'self' when with Number='1' for '%s' from '%s' can result in out-of-order values when the query is multi-allelic", s.Field, s.File)
+		log.Printf("       : this is not an issue if the query has been decomposed.")
+	}
+	s.NumberA = number == "A"
+	s.NumberR = number == "R"
+	s.NumberG = number == "G"
 	ntype := "String"
 	if s.Op == "by_alt" {
 		number = "A"
@@ -560,50 +830,46 @@ func (s *Source) UpdateHeader(r HeaderUpdater, ends bool, htype string, number s
 		} else if strings.HasSuffix(s.Name, "_flag") || strings.Contains(s.Op, "flag(") {
 			s.Name = s.Name[:len(s.Name)-5]
 			ntype, number = "Flag", "0"
-		} else if s.Op == "mean" || s.Op == "max" || s.Op == "min" {
-			ntype, number = "Float", "1"
-		} else {
-			if s.Op == "flag" {
+		} else if s.code != "" {
+			if strings.Contains(s.Op, "_flag(") {
 				ntype, number = "Flag", "0"
+			} else {
+				ntype = "String"
 			}
-			if (strings.HasSuffix(s.File, ".bam") && s.Field == "") || s.IsNumber() {
-				ntype = "Float"
-			} else if s.code != "" {
-				if strings.Contains(s.Op, "_flag(") {
-					ntype, number = "Flag", "0"
-				} else {
-					ntype = "String"
-				}
-			}
-		}
-		// use Number="." for stringy ops.
-		if s.Op == "uniq" || s.Op == "concat" {
-			number = "."
+		} else if spec, ok := ReducerSpec(s.Op); ok {
+			ntype, number = spec.headerType(htype, number)
 		}
 	}
-	if (s.Op == "first" || s.Op == "self") && htype == ntype {
+	if IsVariantSource(s.File) && (s.Op == "first" || s.Op == "self") && htype == ntype {
+		// the description may give the format of the value (e.g. Format: a|b) so it is
+		// kept as is.
+	} else if (s.Op == "first" || s.Op == "self") && htype == ntype {
 		desc = fmt.Sprintf("%s (from %s)", desc, s.File)
-	} else if strings.HasSuffix(s.File, ".bam") && s.Field == "" {
+	} else if IsAlignments(s.File) && s.Field == "" {
 		desc = fmt.Sprintf("calculated by coverage from %s", s.File)
 	} else if s.Field == "DP2" {
 		desc = fmt.Sprintf("calculated by coverage from %s values are numbers of forward,reverse reads", s.File)
 		number = "2"
 		ntype = "Integer"
+	} else if s.JoinOn != "" {
+		what := fmt.Sprintf("column %d", s.Column)
+		if s.Field != "" {
+			what = "field " + s.Field
+		}
+		desc = fmt.Sprintf("calculated by %s of values in %s from %s joined on %s", s.Op, what, s.File, s.JoinOn)
+	} else if IsVariantSource(s.File) {
+		from := s.File
+		if strings.HasSuffix(from, ":") {
+			// the source uses its reference.
+			from += s.Fasta
+		}
+		desc = fmt.Sprintf("calculated by %s of %s from %s", s.Op, s.Field, from)
 	} else if s.Field != "" {
 		desc = fmt.Sprintf("calculated by %s of overlapping values in field %s from %s", s.Op, s.Field, s.File)
 	} else {
 		desc = fmt.Sprintf("calculated by %s of overlapping values in column %d from %s", s.Op, s.Column, s.File)
 	}
-	r.AddInfoToHeader(s.Name, number, ntype, desc)
-	if ends {
-		if s.Op == "self" {
-			// what to do here?
-		}
-		for _, end := range []string{LEFT, RIGHT} {
-			d := fmt.Sprintf("%s at end %s", desc, strings.TrimSuffix(end, "_"))
-			r.AddInfoToHeader(end+s.Name, number, ntype, d)
-		}
-	}
+	s.ntype, s.number, s.desc = ntype, number, desc
 }
 
 // PostAnnotate happens after everything is done.
@@ -616,6 +882,9 @@ func (a *Annotator) PostAnnotate(chrom string, start int, end int, info interfac
 	newid := ""
 	for i := range a.PostAnnos {
 		post := a.PostAnnos[i]
+		if IsIdentifierOp(post.Op) {
+			continue
+		}
 		vals = vals[:0]
 		fields = fields[:0]
 		missing = missing[:0]
@@ -733,17 +1002,25 @@ func (a *Annotator) PostAnnotate(chrom string, start int, end int, info interfac
 				if post.Op == "div2" && len(vals) < 2 {
 					continue
 				}
-				fn := Reducers[post.Op]
+				if post.Op == "delete" && !(post.Name == "ID" && prefix == "") {
+					for _, f := range post.Fields {
+						info.(*vcfgo.InfoByte).Delete(prefix + f)
+					}
+					continue
+				}
+				fn, _, _ := LookupReducer(post.Op)
+				val, e := reduce(func() interface{} { return fn(vals) })
+				if e != nil {
+					err = &VariantError{Chrom: chrom, Pos: start + 1, Name: post.Name, Err: e}
+					if IsFatal(e) {
+						return err, newid
+					}
+					continue
+				}
 				if post.Name == "ID" && prefix == "" {
-					newid = fmt.Sprintf("%s", fn(vals))
+					newid = fmt.Sprintf("%s", val)
 				} else {
-					if post.Op == "delete" {
-						for _, f := range post.Fields {
-							info.(*vcfgo.InfoByte).Delete(prefix + f)
-						}
-					} else {
-						info.Set(prefix+post.Name, fn(vals))
-					}
+					info.Set(prefix+post.Name, formatNumber(val, a.FloatFormat))
 				}
 			}
 		}
@@ -770,66 +1047,182 @@ func getSize(path string) int64 {
 	return fi.Size()
 }
 
-// Setup reads all the tabix indexes and setups up the Queryables
+// Setup opens the SourceBackend (e.g. tabix index) for each file, adds the annotations
+// to the query header and returns the Queryables.
 func (a *Annotator) Setup(query HeaderUpdater) ([]interfaces.Queryable, error) {
 	files, fmap, err := a.setupStreams()
 	if err != nil {
 		return nil, err
 	}
+	a.joinOnce.Do(func() { a.joinErr = a.setupJoins() })
+	if a.joinErr != nil {
+		return nil, a.joinErr
+	}
+	a.chainOnce.Do(func() { a.chainErr = a.loadChains() })
+	if a.chainErr != nil {
+		return nil, a.chainErr
+	}
+	a.fastaOnce.Do(func() { a.fastaErr = a.setupFastas() })
+	if a.fastaErr != nil {
+		return nil, a.fastaErr
+	}
+	a.variantOnce.Do(func() { a.variantErr = a.setupVariantSources() })
+	if a.variantErr != nil {
+		return nil, a.variantErr
+	}
+	for _, src := range a.Sources {
+		var htype, num, desc string
+		if src.JoinOn != "" {
+			htype, num, desc = a.joins[src.joinKey()].Header(src.Field)
+			if num == "" {
+				num = "1"
+			}
+		} else if IsVariantSource(src.File) {
+			htype, num, desc = a.variantSources[src.variantSourceKey()].Header(src.Field)
+			if htype == "" {
+				return nil, fmt.Errorf("%w: unknown field %s for %s", ErrConfig, src.Field, src.File)
+			}
+		} else {
+			continue
+		}
+		if err := src.checkHeader(htype, num); err != nil {
+			return nil, err
+		}
+		src.UpdateHeader(query, false, htype, num, desc)
+	}
 	var wg sync.WaitGroup
 	wg.Add(len(files))
-	queryables := make([]interfaces.Queryable, len(files))
+	opened := make([]SourceBackend, len(files))
+	errs := make([]error, len(files))
 	for i, file := range files {
 		go func(idx int, file string) {
-			var q interfaces.Queryable
-			var err error
-			if strings.HasSuffix(file, ".bam") {
-				q, err = parsers.NewBamQueryable(file, 2)
-			} else {
-				if getSize(file) > 2320303098 {
-					q, err = bix.New(file, 2)
-				} else {
-					q, err = bix.New(file, 1)
+			defer wg.Done()
+			b, err := OpenBackend(file, BackendOptions{Fasta: fmap[file][0].Fasta})
+			if err != nil {
+				errs[idx] = fmt.Errorf("%w: %s: %s", ErrSourceOpen, file, err)
+				return
+			}
+			if src := fmap[file][0]; src.selectsFeatures() {
+				fs, ok := b.(FeatureSelector)
+				if !ok {
+					b.Close()
+					errs[idx] = fmt.Errorf("%w: feature_types, upstream and downstream can not be used with %s", ErrConfig, file)
+					return
+				}
+				if err := fs.SelectFeatures(src.FeatureTypes, src.Upstream, src.Downstream); err != nil {
+					b.Close()
+					errs[idx] = fmt.Errorf("%w: %s: %s", ErrConfig, file, err)
+					return
 				}
 			}
-			if err != nil {
-				log.Fatal(err)
+			if chain := fmap[file][0].Chain; chain != "" {
+				// the contigs and build of b are not checked against the query.
+				b = liftBackend{SourceBackend: b, chains: a.chains[chain], ref: a.fastas[fmap[file][0].Fasta], unmapped: &a.unmapped}
 			}
-			queryables[idx] = q
-			wg.Done()
+			opened[idx] = b
 		}(i, file)
 
 	}
 	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			for _, b := range opened {
+				if b != nil {
+					b.Close()
+				}
+			}
+			return nil, err
+		}
+	}
 
+	qc, qh := queryContigs(query)
+	contigs, builds := newContigChecker(), &buildChecker{}
+	contigs.add("the query", qc)
+	builds.add("the query", DetectBuild(qc, qh))
+	check := func(file string, fc []Contig, fh []string) error {
+		err := contigs.add(file, fc)
+		if err == nil {
+			err = builds.add(file, DetectBuild(fc, fh))
+		}
+		if err != nil && a.AllowBuildMismatch {
+			log.Printf("WARNING: %s", err)
+			return nil
+		}
+		return err
+	}
 	for i, file := range files {
-		if q, ok := queryables[i].(*bix.Bix); ok {
+		var fc []Contig
+		var fh []string
+		if cl, ok := opened[i].(ContigLister); ok {
+			fc = cl.Contigs()
+		}
+		if hl, ok := opened[i].(headerLiner); ok {
+			fh = hl.headerLines()
+		}
+		if err := check(file, fc, fh); err != nil {
+			for _, b := range opened {
+				b.Close()
+			}
+			return nil, err
+		}
+	}
+	for _, path := range a.fastaPaths() {
+		if err := check(fasta.Prefix+path, readerContigs(a.fastas[path]), nil); err != nil {
+			for _, b := range opened {
+				b.Close()
+			}
+			return nil, err
+		}
+	}
+	for _, src := range a.Sources {
+		cl, ok := a.variantSources[src.variantSourceKey()].(ContigLister)
+		if !ok || !IsVariantSource(src.File) {
+			continue
+		}
+		if err := check(src.File, cl.Contigs(), nil); err != nil {
+			for _, b := range opened {
+				b.Close()
+			}
+			return nil, err
+		}
+	}
+	setBuild(query, builds.first.Name)
+
+	queryables := make([]interfaces.Queryable, len(files))
+	for i, file := range files {
+		queryables[i] = opened[i]
+		if s, ok := opened[i].(Summarizer); ok {
+			queryables[i] = summaryBackend{SourceBackend: opened[i], s: s}
+		}
+		if fs, ok := opened[i].(FieldSelector); ok {
+			fields := make([]string, 0, len(fmap[file]))
 			for _, src := range fmap[file] {
-				num := q.GetHeaderNumber(src.Field)
-				// must set this to accurately represent multi-allelics.
-				if num == "1" && src.Op == "self" {
-					log.Printf("WARNING: using op 'self' when with Number='1' for '%s' from '%s' can result in out-of-order values when the query is multi-allelic", src.Field, src.File)
-					log.Printf("       : this is not an issue if the query has been decomposed.")
+				if src.Field != "" {
+					fields = append(fields, src.Field)
 				}
-				/*
-					if num == "1" && src.Op == "self" {
-						num = "A"
-					}
-				*/
-				desc := q.GetHeaderDescription(src.Field)
-				src.UpdateHeader(query, a.Ends, q.GetHeaderType(src.Field), num, desc)
-				src.NumberA = num == "A"
 			}
-		} else if _, ok := queryables[i].(*parsers.BamQueryable); ok {
-			for _, src := range fmap[file] {
-				htype := "String"
-				if src.IsNumber() {
-					htype = "Float"
+			if err := fs.SelectFields(fields); err != nil {
+				for _, b := range opened {
+					b.Close()
 				}
-				src.UpdateHeader(query, a.Ends, htype, "1", "")
+				return nil, fmt.Errorf("%w: %s: %s", ErrSourceOpen, file, err)
 			}
-		} else {
-			log.Printf("type not known: %T\n", queryables[i])
+		}
+		for _, src := range fmap[file] {
+			if fc, ok := opened[i].(FieldColumner); ok && src.Field != "" {
+				src.Column = fc.FieldColumn(src.Field)
+			}
+			htype, num, desc := opened[i].Header(src.Field)
+			if num == "" {
+				num = "1"
+			}
+			if err := src.checkHeader(htype, num); err != nil {
+				for _, b := range opened {
+					b.Close()
+				}
+				return nil, err
+			}
+			src.UpdateHeader(query, a.Ends, htype, num, desc)
 		}
 	}
 
@@ -837,6 +1230,10 @@ func (a *Annotator) Setup(query HeaderUpdater) ([]interfaces.Queryable, error) {
 		if post.Name == "" || post.Name == "ID" || post.Name == "FILTER" {
 			continue
 		}
+		if IsIdentifierOp(post.Op) {
+			query.AddInfoToHeader(post.Name, "A", post.Type, identifierDescription(post))
+			continue
+		}
 		number := "."
 		if strings.Contains(strings.ToLower(post.Name), "af_") || strings.Contains(strings.ToLower(post.Name), "_af") {
 			number = "A"
@@ -855,6 +1252,9 @@ func (a *Annotator) setupStreams() ([]string, map[string][]*Source, error) {
 	lookup := make(map[string][]*Source, len(a.Sources))
 	files := make([]string, 0, 4)
 	for _, src := range a.Sources {
+		if src.JoinOn != "" || IsVariantSource(src.File) {
+			continue
+		}
 		// have expanded so there are many sources per file.
 		// use seen to just grab the file the first time it is seen and start a stream
 		if _, ok := lookup[src.File]; !ok {
@@ -874,27 +1274,42 @@ func (a *Annotator) AnnotateEnds(v interfaces.Relatable, ends string) error {
 	var err error
 	// if Both, call the interval, left, and right version to annotate.
 	id := v.(*parsers.Variant).IVariant.(*vcfgo.Variant).Id()
-	if ends == BOTH {
-		if e := a.AnnotateOne(v, a.Strict); e != nil {
-			err = e
-		}
-		if e, _ := a.PostAnnotate(v.Chrom(), int(v.Start()), int(v.End()), v.(interfaces.IVariant).Info(), "", id); e != nil {
-			err = e
+	// the identifiers are added first so that they can be used by other postannotations.
+	var idErr error
+	if ends == BOTH || ends == INTERVAL {
+		var newid string
+		if newid, idErr = a.annotateIdentifiers(v.(interfaces.IVariant)); newid != "" {
+			v.(*parsers.Variant).IVariant.(*vcfgo.Variant).Id_ = newid
+			id = newid
 		}
-		if e := a.AnnotateEnds(v, LEFT); e != nil {
-			err = e
+		if IsFatal(idErr) {
+			return idErr
 		}
-		if e := a.AnnotateEnds(v, RIGHT); e != nil {
-			err = e
+		err = idErr
+	}
+	if ends == BOTH {
+		// keep the last error unless we already have a fatal one.
+		keep := func(e error) {
+			if e != nil && !IsFatal(err) {
+				err = e
+			}
 		}
+		keep(a.AnnotateOne(v, a.Strict))
+		e, _ := a.PostAnnotate(v.Chrom(), int(v.Start()), int(v.End()), v.(interfaces.IVariant).Info(), "", id)
+		keep(e)
+		keep(a.AnnotateEnds(v, LEFT))
+		keep(a.AnnotateEnds(v, RIGHT))
 	}
 	if ends == INTERVAL {
 		err := a.AnnotateOne(v, a.Strict)
+		if err == nil {
+			err = idErr
+		}
 		err2, newid := a.PostAnnotate(v.Chrom(), int(v.Start()), int(v.End()), v.(interfaces.IVariant).Info(), "", id)
 		if newid != "" {
 			v.(*parsers.Variant).IVariant.(*vcfgo.Variant).Id_ = newid
 		}
-		if err != nil {
+		if err != nil && !IsFatal(err2) {
 			return err
 		}
 		return err2
@@ -922,6 +1337,9 @@ func (a *Annotator) AnnotateEnds(v interfaces.Relatable, ends string) error {
 			Reference: "A", Alternate: []string{"<DEL>"}, Info_: m}, v.Source(), v.Related())
 
 		err = a.AnnotateOne(v2, false, ends)
+		if IsFatal(err) {
+			return err
+		}
 		var val interface{}
 		for _, key := range v2.Info().Keys() {
 			if key == "SVLEN" || key == "END" {
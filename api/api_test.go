@@ -1,8 +1,11 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/brentp/irelate/interfaces"
@@ -172,7 +175,8 @@ function mean(t)
 end
 `
 
-	s.annotator = NewAnnotator([]*Source{&s.src0, &s.src}, code, false, true, empty)
+	s.annotator, err = NewAnnotator([]*Source{&s.src0, &s.src}, code, false, true, empty)
+	c.Assert(err, IsNil)
 
 }
 
@@ -216,7 +220,7 @@ var jstest = []struct {
 
 func (s *APISuite) TestCollect(c *C) {
 	parted := s.annotator.partition(s.v1)
-	r, err := collect(s.v1, parted[0], &s.src0, false)
+	r, _, err := collect(s.v1, parted[0], &s.src0, false)
 	c.Assert(err, ErrorMatches, ".* not found in INFO")
 	c.Assert(len(r), Equals, 1)
 	c.Assert(r[0], Equals, float64(33))
@@ -261,7 +265,8 @@ func (s *APISuite) TestEndsBedQuery(c *C) {
 	b2.AddRelated(b1)
 
 	empty := make([]PostAnnotation, 0)
-	NewAnnotator([]*Source{&bsrc}, "", true, false, empty)
+	_, err := NewAnnotator([]*Source{&bsrc}, "", true, false, empty)
+	c.Assert(err, IsNil)
 }
 
 func (s *APISuite) TestIdAnno(c *C) {
@@ -278,7 +283,8 @@ func (s *APISuite) TestIdAnno(c *C) {
 	v.SetSource(1)
 
 	empty := make([]PostAnnotation, 0)
-	a := NewAnnotator([]*Source{&vsrc}, "", true, true, empty)
+	a, err := NewAnnotator([]*Source{&vsrc}, "", true, true, empty)
+	c.Assert(err, IsNil)
 
 	a.AnnotateOne(v, a.Strict)
 	c.Assert(v.Info().String(), Equals, "o_id=rs")
@@ -378,3 +384,299 @@ func TestByAlt(t *testing.T) {
 		}
 	}
 }
+
+var trimAlleleTests = []struct {
+	pos      uint32
+	ref, alt string
+	expected allele
+}{
+	{10, "A", "G", allele{10, "A", "G"}},
+	{10, "ATG", "ACG", allele{11, "T", "C"}},
+	{10, "ATT", "AT", allele{11, "T", ""}},
+	{10, "AT", "A", allele{11, "T", ""}},
+	{10, "A", "ATT", allele{11, "", "TT"}},
+	{10, "a", "g", allele{10, "A", "G"}},
+	{10, "A", "<DEL>", allele{10, "A", "<DEL>"}},
+}
+
+func TestTrimAllele(t *testing.T) {
+	for _, tt := range trimAlleleTests {
+		if got := trimAllele(tt.pos, tt.ref, tt.alt); got != tt.expected {
+			t.Errorf("trimAllele(%d, %s, %s): expected %v, got %v", tt.pos, tt.ref, tt.alt, tt.expected, got)
+		}
+	}
+}
+
+func TestMatchAllelesDecomposed(t *testing.T) {
+	// un-decomposed query with a complex allele vs decomposed annotations.
+	q := makeVariant("1", 10, "ATG", []string{"A", "ACG"}, "q", "", h)
+	del := makeVariant("1", 10, "ATT", []string{"AT"}, "del", "", h)
+	snp := makeVariant("1", 11, "T", []string{"C"}, "snp", "", h)
+
+	if got := matchAlleles(q, snp); !reflect.DeepEqual(got, []int{-1, 0}) {
+		t.Errorf("expected [-1 0], got %v", got)
+	}
+	if !sameAllele(q, snp) {
+		t.Errorf("expected %v to match %v", q, snp)
+	}
+	// ATG>A is not the same deletion as ATT>AT
+	if sameAllele(q, del) {
+		t.Errorf("expected %v not to match %v", q, del)
+	}
+
+	multi := makeVariant("1", 10, "ATGC", []string{"ACGC", "AGC"}, "multi", "", h)
+	if got := matchAlleles(q, multi); !reflect.DeepEqual(got, []int{-1, 0}) {
+		t.Errorf("expected [-1 0], got %v", got)
+	}
+	if got := remapA([]int{5, 6}, matchAlleles(q, multi), nil); !reflect.DeepEqual(got, []interface{}{".", 5}) {
+		t.Errorf("expected [. 5], got %v", got)
+	}
+}
+
+func TestNumberRG(t *testing.T) {
+	// query alts are flipped relative to the annotation and have an extra alt.
+	altIdxs := []int{1, 0, -1}
+
+	ridxs := refIndexes(altIdxs)
+	if !reflect.DeepEqual(ridxs, []int{0, 2, 1, -1}) {
+		t.Errorf("expected [0 2 1 -1], got %v", ridxs)
+	}
+	if got := remapA([]int{10, 11, 12}, ridxs, nil); !reflect.DeepEqual(got, []interface{}{10, 12, 11, "."}) {
+		t.Errorf("expected [10 12 11 .], got %v", got)
+	}
+
+	// annotation genotypes in order: 0/0 0/1 1/1 0/2 1/2 2/2
+	gidxs := genotypeIndexes(altIdxs[:2])
+	if !reflect.DeepEqual(gidxs, []int{0, 3, 5, 1, 4, 2}) {
+		t.Errorf("expected [0 3 5 1 4 2], got %v", gidxs)
+	}
+	gidxs = genotypeIndexes([]int{0, -1})
+	if got := remapA([]int{1, 2, 3}, gidxs, nil); !reflect.DeepEqual(got, []interface{}{1, 2, 3, ".", ".", "."}) {
+		t.Errorf("expected [1 2 3 . . .], got %v", got)
+	}
+}
+
+func TestCollectNumberR(t *testing.T) {
+	hr := vcfgo.NewHeader()
+	hr.Infos["AD"] = &vcfgo.Info{Id: "AD", Description: "AD", Number: "R", Type: "Integer"}
+	q := makeVariant("1", 10, "A", []string{"G", "C", "T"}, "q", "", hr)
+	o := makeVariant("1", 10, "A", []string{"C", "G"}, "o", "AD=7,8,9", hr)
+	o.SetSource(1)
+	src := &Source{File: "o.vcf.gz", Op: "self", Name: "AD", Field: "AD", NumberR: true}
+
+	vals, _, err := collect(q, []interfaces.Relatable{o}, src, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, []interface{}{[]interface{}{7, 9, 8, nil}}) {
+		t.Errorf("expected [[7 9 8 <nil>]], got %v", vals)
+	}
+}
+
+func TestPositionReducers(t *testing.T) {
+	query := interfaces.AsIPosition("chr1", 100, 200)
+	poss := []interfaces.IPosition{
+		interfaces.AsIPosition("chr1", 90, 101),  // 1 base
+		interfaces.AsIPosition("chr1", 150, 250), // 50 bases
+		interfaces.AsIPosition("chr1", 160, 170), // 10 bases, inside the previous
+	}
+	vals := []interface{}{100.0, 1.0, 7}
+
+	if got := weightedMean(query, poss, vals); got != (100.0+50+70)/61 {
+		t.Errorf("weighted_mean: got %v", got)
+	}
+	if got := bpCovered(query, poss, vals); got != 51 {
+		t.Errorf("bp_covered: expected 51, got %v", got)
+	}
+	if got := fracCovered(query, poss, vals); got != 0.51 {
+		t.Errorf("frac_covered: expected 0.51, got %v", got)
+	}
+	if got := maxOverlapValue(query, poss, vals); got != 1.0 {
+		t.Errorf("max_overlap_value: expected 1, got %v", got)
+	}
+	if got := weightedMean(query, poss[:0], vals[:0]); got != nil {
+		t.Errorf("weighted_mean: expected nil with no overlaps, got %v", got)
+	}
+}
+
+func TestAnnotatePositions(t *testing.T) {
+	q := makeVariant("chr1", 101, "A", []string{"<DEL>"}, "sv", "SVLEN=-100;END=200", h)
+	b1 := makeBed("chr1", 90, 101, 0.9)
+	b2 := makeBed("chr1", 101, 200, 0.1)
+	b1.SetSource(1)
+	b2.SetSource(1)
+	q.AddRelated(b1)
+	q.AddRelated(b2)
+	src := Source{File: "fitcons.bed", Op: "weighted_mean", Column: 4, Name: "fitcons_wmean", Index: 0}
+
+	empty := make([]PostAnnotation, 0)
+	a, err := NewAnnotator([]*Source{&src}, "", false, true, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AnnotateOne(q, a.Strict)
+	if got := q.Info().String(); got != "SVLEN=-100;END=200;fitcons_wmean=0.108" {
+		t.Errorf("got %s", got)
+	}
+
+	// values without positions are refused rather than giving no annotation.
+	for _, field := range []string{"", "DP2"} {
+		src := Source{File: "ex.bam", Op: "bp_covered", Field: field, Name: "x"}
+		if _, err := NewAnnotator([]*Source{&src}, "", false, true, nil); !errors.Is(err, ErrConfig) {
+			t.Errorf("expected ErrConfig for bam field '%s', got %v", field, err)
+		}
+	}
+	src = Source{File: "ex.bam", Op: "bp_covered", Field: "mapq", Name: "x"}
+	if _, err := NewAnnotator([]*Source{&src}, "", false, true, nil); err != nil {
+		t.Error(err)
+	}
+	src = Source{File: "gnomad.vcf.gz", Op: "weighted_mean", Field: "AF", Name: "x"}
+	if err := src.checkHeader("Float", "A"); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected ErrConfig for Number=A, got %v", err)
+	}
+	if err := src.checkHeader("Float", "1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultiValueError(t *testing.T) {
+	hh := vcfgo.NewHeader()
+	hh.Infos["AFS"] = &vcfgo.Info{Id: "AFS", Description: "afs", Number: ".", Type: "Float"}
+	q := makeVariant("chr1", 100, "A", []string{"T"}, "q", "", hh)
+	o := makeVariant("chr1", 100, "A", []string{"T"}, "o", "AFS=0.1,0.2", hh)
+	o.SetSource(1)
+	q.AddRelated(o)
+	src := Source{File: "afs.vcf", Op: "mean", Field: "AFS", Name: "afs_mean", Index: 0}
+
+	a, err := NewAnnotator([]*Source{&src}, "", false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.AnnotateOne(q, a.Strict)
+	if !errors.Is(err, ErrMultiValue) || !IsFatal(err) {
+		t.Fatalf("expected ErrMultiValue, got %v", err)
+	}
+	var verr *VariantError
+	if !errors.As(err, &verr) || verr.Chrom != "chr1" || verr.Pos != 100 || verr.Name != "afs_mean" {
+		t.Errorf("expected position of variant in error, got %v", err)
+	}
+}
+
+func TestOpError(t *testing.T) {
+	if err := RegisterReducer("test_panic", func(vals []interface{}) interface{} { panic("bad value") }, Spec{}); err != nil {
+		t.Fatal(err)
+	}
+	q := makeVariant("chr1", 101, "A", []string{"T"}, "q", "", h)
+	b := makeBed("chr1", 90, 110, 0.5)
+	b.SetSource(1)
+	q.AddRelated(b)
+	srcs := []*Source{{File: "a.bed", Op: "test_panic", Column: 4, Name: "bad", Index: 0},
+		{File: "a.bed", Op: "max", Column: 4, Name: "good", Index: 0}}
+	a, err := NewAnnotator(srcs, "", false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the error does not stop the other sources.
+	err = a.AnnotateOne(q, a.Strict)
+	if !errors.Is(err, ErrOp) || IsFatal(err) {
+		t.Errorf("expected a non-fatal ErrOp, got %v", err)
+	}
+	if got := q.Info().String(); got != "good=0.5" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestUnknownOpError(t *testing.T) {
+	post := []PostAnnotation{{Fields: []string{"DP"}, Op: "not_an_op", Name: "x", Type: "Float"}}
+	if _, err := NewAnnotator(nil, "", false, false, post); !errors.Is(err, ErrUnknownOp) {
+		t.Errorf("expected ErrUnknownOp, got %v", err)
+	}
+	if _, err := NewAnnotator([]*Source{{File: "a.bed", Op: "mean"}}, "", false, false, nil); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected ErrConfig, got %v", err)
+	}
+}
+
+// stringBackend has only String fields.
+type stringBackend struct {
+	memBackend
+}
+
+func (b *stringBackend) Header(field string) (string, string, string) {
+	return "String", "1", "a name"
+}
+
+func TestOpType(t *testing.T) {
+	if err := RegisterBackend("typetest://", func(path string, _ BackendOptions) (SourceBackend, error) { return &stringBackend{}, nil }); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		op string
+		ok bool
+	}{{"mean", false}, {"weighted_mean", false}, {"uniq", true}, {"count", true}, {"lua:vals[1]", true}} {
+		src := Source{File: "typetest://names", Op: c.op, Field: "name", Name: "x"}
+		a, err := NewAnnotator([]*Source{&src}, "", false, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Setup(&headerLines{}); (err == nil) != c.ok || (err != nil && !errors.Is(err, ErrConfig)) {
+			t.Errorf("%s: expected ok: %v, got %v", c.op, c.ok, err)
+		}
+	}
+}
+
+type headerLines []string
+
+func (h *headerLines) AddInfoToHeader(id string, num string, stype string, desc string) {
+	*h = append(*h, fmt.Sprintf("%s:%s:%s", id, num, stype))
+}
+
+func TestReuseAnnotator(t *testing.T) {
+	srcs := []*Source{
+		{File: "../example/exac.vcf.gz", Op: "max", Field: "AC_Adj", Name: "ac_adj_float", Index: 0},
+		{File: "../example/fitcons.bed.gz", Op: "mean", Column: 4, Name: "fitcons_int", Index: 1},
+		{File: "../example/ex.bam", Op: "count", Name: "coverage", Index: 2},
+	}
+	a, err := NewAnnotator(srcs, "", true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sources given to NewAnnotator are not changed.
+	if srcs[0].Name != "ac_adj_float" || srcs[2].Op != "count" {
+		t.Fatalf("sources changed: %s %s", srcs[0].Name, srcs[2].Op)
+	}
+
+	hs := make([]headerLines, 8)
+	var wg sync.WaitGroup
+	for i := range hs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := a.Setup(&hs[i]); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	exp := "ac_adj:1:Float left_ac_adj:1:Float right_ac_adj:1:Float fitcons:1:Integer left_fitcons:1:Integer right_fitcons:1:Integer coverage:1:Integer left_coverage:1:Integer right_coverage:1:Integer"
+	for _, h := range hs {
+		if got := strings.Join(h, " "); got != exp {
+			t.Errorf("got header:\n%s\nexpected:\n%s", got, exp)
+		}
+	}
+	if a.Sources[0].Name != "ac_adj" || a.Sources[2].Op != "sum" {
+		t.Errorf("unexpected resolved source: %s %s", a.Sources[0].Name, a.Sources[2].Op)
+	}
+
+	// the same sources can be used again.
+	b, err := NewAnnotator(srcs, "", false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h headerLines
+	if _, err := b.Setup(&h); err != nil {
+		t.Fatal(err)
+	}
+	if h[0] != "ac_adj:1:Float" {
+		t.Errorf("got %s", h[0])
+	}
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/brentp/bix"
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+)
+
+// SourceBackend provides the annotations for a Source. It is opened once per query
+// file by Annotator.Setup and queried by region.
+type SourceBackend interface {
+	// Query returns the annotations overlapping region sorted by start. Each Relatable
+	// should be an interfaces.IVariant (used like a VCF with Fields) or a
+	// *parsers.Interval (used like a BED file with Columns).
+	interfaces.Queryable
+	// Header gives the VCF Type, Number and Description of field. Any of these may be
+	// empty if unknown; Number defaults to "1".
+	Header(field string) (htype string, number string, desc string)
+	Close() error
+}
+
+// FieldSelector may be implemented by a SourceBackend that reads only the fields that
+// are used. Setup calls SelectFields before Header or Query.
+type FieldSelector interface {
+	SelectFields(fields []string) error
+}
+
+// FieldColumner may be implemented by a SourceBackend that gives a field of its records as
+// a column of a *parsers.Interval. Setup sets the Column of each Source with a Field from
+// FieldColumn after SelectFields. A column < 1 indicates that the field is in the Info of
+// an interfaces.IVariant. As for a BED file, the first 3 columns of each Interval are the
+// chrom, the 0-based start and the end so the fields start at column 4.
+type FieldColumner interface {
+	// FieldColumn gives the 1-based column of field.
+	FieldColumn(field string) int
+}
+
+// FeatureSelector may be implemented by a SourceBackend of gene models (e.g. GFF3) to
+// use only the features with the given types (all if empty) and to extend each feature
+// by upstream and downstream bases on its strand. Setup calls SelectFeatures with the
+// settings of the Sources of the file before Query.
+type FeatureSelector interface {
+	SelectFeatures(types []string, upstream, downstream int) error
+}
+
+// Summarizer may be implemented by a SourceBackend with summaries of its records at lower
+// resolutions (e.g. the zoom levels of a bigWig). Rather than being streamed with the
+// query, it is queried with Summary for the region of each variant (or end) so that it
+// can give a few summary records for a large SV. It is streamed as usual with a Chain.
+type Summarizer interface {
+	// Summary returns the records, or summaries of them, overlapping region sorted by
+	// start.
+	Summary(region interfaces.IPosition) (interfaces.RelatableIterator, error)
+}
+
+// BackendOptions are the settings of the Sources of a file that its SourceBackend may
+// need to open it.
+type BackendOptions struct {
+	// Fasta is the reference of the Sources, e.g. to decode a CRAM.
+	Fasta string
+}
+
+// BackendOpener opens the SourceBackend at path.
+type BackendOpener func(path string, opts BackendOptions) (SourceBackend, error)
+
+var backends = struct {
+	sync.RWMutex
+	schemes  map[string]BackendOpener
+	suffixes map[string]BackendOpener
+}{schemes: make(map[string]BackendOpener), suffixes: make(map[string]BackendOpener)}
+
+// RegisterBackend makes a SourceBackend available for files with the given pattern.
+// A pattern ending in "://" (e.g. "mydb://") is matched as a prefix of the File in
+// the config; any other pattern (e.g. ".bam") is matched as a suffix. Files that do
+// not match any pattern are opened as tabix files.
+func RegisterBackend(pattern string, open BackendOpener) error {
+	if pattern == "" || open == nil {
+		return fmt.Errorf("invalid backend: '%s'", pattern)
+	}
+	backends.Lock()
+	defer backends.Unlock()
+	m := backends.suffixes
+	if strings.HasSuffix(pattern, "://") {
+		m = backends.schemes
+	}
+	if _, ok := m[pattern]; ok {
+		return fmt.Errorf("backend already registered: %s", pattern)
+	}
+	m[pattern] = open
+	return nil
+}
+
+// scheme returns the registered scheme of path or "".
+func scheme(path string) string {
+	i := strings.Index(path, "://")
+	if i == -1 {
+		return ""
+	}
+	backends.RLock()
+	defer backends.RUnlock()
+	if _, ok := backends.schemes[path[:i+3]]; ok {
+		return path[:i+3]
+	}
+	return ""
+}
+
+// IsBackendURI indicates that path starts with a registered scheme so that it should
+// not be checked (or modified) as a local file.
+func IsBackendURI(path string) bool {
+	return scheme(path) != ""
+}
+
+// OpenBackend opens path with the registered backend for its scheme or (longest) suffix
+// or as a tabix file if there is none.
+func OpenBackend(path string, opts BackendOptions) (SourceBackend, error) {
+	sch := scheme(path)
+	backends.RLock()
+	open := backends.schemes[sch]
+	if open == nil {
+		best := ""
+		for suffix, o := range backends.suffixes {
+			if strings.HasSuffix(path, suffix) && len(suffix) > len(best) {
+				best, open = suffix, o
+			}
+		}
+	}
+	backends.RUnlock()
+	if open == nil {
+		open = openTabix
+	}
+	return open(path, opts)
+}
+
+type tabixBackend struct {
+	*bix.Bix
+}
+
+func openTabix(path string, _ BackendOptions) (SourceBackend, error) {
+	workers := 1
+	if getSize(path) > 2320303098 {
+		workers = 2
+	}
+	b, err := bix.New(path, workers)
+	if err != nil {
+		return nil, err
+	}
+	return tabixBackend{b}, nil
+}
+
+func (t tabixBackend) Header(field string) (string, string, string) {
+	return t.GetHeaderType(field), t.GetHeaderNumber(field), t.GetHeaderDescription(field)
+}
+
+type bamBackend struct {
+	*parsers.BamQueryable
+	contigs []Contig
+}
+
+func openBam(path string, _ BackendOptions) (SourceBackend, error) {
+	b, err := parsers.NewBamQueryable(path, 2)
+	if err != nil {
+		return nil, err
+	}
+	contigs, err := bamContigs(path)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return bamBackend{BamQueryable: b, contigs: contigs}, nil
+}
+
+// Header gives Integer for the numeric values from alignments (coverage, mapq).
+func (b bamBackend) Header(field string) (string, string, string) {
+	if field == "seq" {
+		return "String", "1", ""
+	}
+	return "Integer", "1", ""
+}
+
+func init() {
+	if err := RegisterBackend(".bam", openBam); err != nil {
+		panic(err)
+	}
+	if err := RegisterBackend(".cram", openCram); err != nil {
+		panic(err)
+	}
+}
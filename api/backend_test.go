@@ -0,0 +1,185 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfgo"
+)
+
+type memBackend struct {
+	ivs    []*parsers.Interval
+	closed bool
+}
+
+type memIterator struct {
+	ivs []interfaces.Relatable
+}
+
+func (m *memIterator) Next() (interfaces.Relatable, error) {
+	if len(m.ivs) == 0 {
+		return nil, io.EOF
+	}
+	r := m.ivs[0]
+	m.ivs = m.ivs[1:]
+	return r, nil
+}
+
+func (m *memIterator) Close() error { return nil }
+
+func (m *memBackend) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	it := &memIterator{}
+	for _, iv := range m.ivs {
+		if iv.Chrom() == region.Chrom() && iv.Start() < region.End() && region.Start() < iv.End() {
+			it.ivs = append(it.ivs, iv)
+		}
+	}
+	return it, nil
+}
+
+func (m *memBackend) Header(field string) (string, string, string) {
+	return "Float", "1", "a score"
+}
+
+func (m *memBackend) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestBackend(t *testing.T) {
+	mem := &memBackend{ivs: []*parsers.Interval{makeBed("chr1", 10, 20, 0.5), makeBed("chr1", 15, 30, 0.25)}}
+	if err := RegisterBackend("memtest://", func(path string, _ BackendOptions) (SourceBackend, error) { return mem, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterBackend("memtest://", func(path string, _ BackendOptions) (SourceBackend, error) { return mem, nil }); err == nil {
+		t.Error("expected error registering backend twice")
+	}
+	if !IsBackendURI("memtest://scores") || IsBackendURI("other://scores") || IsBackendURI("scores.bed.gz") {
+		t.Error("bad IsBackendURI")
+	}
+
+	src := Source{File: "memtest://scores", Op: "max", Column: 4, Name: "score", Index: 0}
+	a, err := NewAnnotator([]*Source{&src}, "", false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h headerLines
+	qs, err := a.Setup(&h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 1 || h[0] != "score:1:Float" {
+		t.Errorf("got header %v", h)
+	}
+
+	v := makeVariant("chr1", 17, "A", []string{"T"}, "v", "", vcfgo.NewHeader())
+	it, err := qs[0].Query(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r, err := it.Next(); err == nil; r, err = it.Next() {
+		r.SetSource(1)
+		v.AddRelated(r)
+	}
+	if err := a.AnnotateOne(v, a.Strict); err != nil {
+		t.Fatal(err)
+	}
+	if got := v.Info().String(); got != "score=0.5" {
+		t.Errorf("got %s", got)
+	}
+	qs[0].(SourceBackend).Close()
+	if !mem.closed {
+		t.Error("expected backend to be closed")
+	}
+}
+
+type contigBackend struct {
+	memBackend
+	contigs []Contig
+}
+
+func (c *contigBackend) Contigs() []Contig { return c.contigs }
+
+type contigQuery struct {
+	headerLines
+	contigs []Contig
+}
+
+func (c *contigQuery) Contigs() []Contig { return c.contigs }
+
+func TestContigs(t *testing.T) {
+	grch37 := []Contig{{Name: "1", Length: 249250621}, {Name: "2", Length: 243199373}, {Name: "X", Length: 155270560}}
+	b := &contigBackend{contigs: []Contig{{Name: "chr1", Length: 248956422}, {Name: "chr2", Length: 242193529}}}
+	if err := RegisterBackend("contigtest://", func(path string, _ BackendOptions) (SourceBackend, error) { return b, nil }); err != nil {
+		t.Fatal(err)
+	}
+	src := Source{File: "contigtest://scores", Op: "max", Column: 4, Name: "score"}
+	a, err := NewAnnotator([]*Source{&src}, "", false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Setup(&contigQuery{contigs: grch37}); !errors.Is(err, ErrBuildMismatch) || !IsFatal(err) {
+		t.Fatalf("expected ErrBuildMismatch, got %v", err)
+	}
+	if !b.closed {
+		t.Error("expected backend to be closed")
+	}
+
+	// same lengths in another order (and with a chr prefix) are fine.
+	b.contigs = []Contig{{Name: "chrX", Length: 155270560}, {Name: "chr1", Length: 249250621}, {Name: "chrUn", Length: 0}}
+	if _, err := a.Setup(&contigQuery{contigs: grch37}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lengthBackend gives one record with the length of the region from Summary.
+type lengthBackend struct {
+	memBackend
+}
+
+func (l *lengthBackend) Summary(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	return &memIterator{ivs: []interfaces.Relatable{makeBed(region.Chrom(), int(region.Start()), int(region.End()),
+		float32(region.End()-region.Start()))}}, nil
+}
+
+func TestSummarizer(t *testing.T) {
+	if err := RegisterBackend("summarytest://", func(path string, _ BackendOptions) (SourceBackend, error) { return &lengthBackend{}, nil }); err != nil {
+		t.Fatal(err)
+	}
+	src := Source{File: "summarytest://scores", Op: "max", Column: 4, Name: "len", Index: 0}
+	a, err := NewAnnotator([]*Source{&src}, "", false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs, err := a.Setup(&headerLines{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stream gives the region of the query and each variant is annotated from its own.
+	it, err := qs[0].Query(parsers.NewInterval("chr1", 0, 1000, nil, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	region, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	region.SetSource(1)
+	for _, c := range []struct {
+		pos int
+		ref string
+		exp string
+	}{{17, "A", "len=1"}, {100, "ACGT", "len=4"}} {
+		v := makeVariant("chr1", c.pos, c.ref, []string{"T"}, "v", "", vcfgo.NewHeader())
+		v.AddRelated(region)
+		if err := a.AnnotateOne(v, a.Strict); err != nil {
+			t.Fatal(err)
+		}
+		if got := v.Info().String(); got != c.exp {
+			t.Errorf("expected %s, got %s", c.exp, got)
+		}
+	}
+}
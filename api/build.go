@@ -0,0 +1,132 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/brentp/vcfgo"
+)
+
+// Genome builds given by DetectBuild. hg19 and hg38 are reported as GRCh37 and GRCh38.
+const (
+	NCBI36 = "NCBI36"
+	GRCh37 = "GRCh37"
+	GRCh38 = "GRCh38"
+	CHM13  = "CHM13"
+)
+
+// landmarks are the lengths of contigs that differ between the builds.
+var landmarks = map[string]map[int]string{
+	"1": {247249719: NCBI36, 249250621: GRCh37, 248956422: GRCh38, 248387328: CHM13},
+	"2": {242951149: NCBI36, 243199373: GRCh37, 242193529: GRCh38, 242696752: CHM13},
+	"X": {154913754: NCBI36, 155270560: GRCh37, 156040895: GRCh38, 154259566: CHM13},
+}
+
+// buildNames are matched (in order) to the assembly of a ##contig or to a ##reference line.
+var buildNames = []struct{ name, build string }{
+	{"grch38", GRCh38}, {"hg38", GRCh38}, {"hs38", GRCh38}, {"b38", GRCh38},
+	{"chm13", CHM13}, {"t2t", CHM13},
+	{"grch37", GRCh37}, {"hg19", GRCh37}, {"hs37", GRCh37}, {"b37", GRCh37}, {"g1k_v37", GRCh37},
+	{"ncbi36", NCBI36}, {"hg18", NCBI36}, {"b36", NCBI36},
+}
+
+// Build is the genome build of a file and the evidence for it. Name is empty if the
+// build is not known.
+type Build struct {
+	Name     string
+	Evidence string
+}
+
+func (b Build) String() string {
+	if b.Name == "" {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s (from %s)", b.Name, b.Evidence)
+}
+
+func buildName(s string) string {
+	s = strings.ToLower(s)
+	for _, b := range buildNames {
+		if strings.Contains(s, b.name) {
+			return b.build
+		}
+	}
+	return ""
+}
+
+// DetectBuild gives the genome build from the contigs and the header lines of a file.
+// The lengths of landmark contigs are used first, then the assembly of the contigs and
+// then any ##reference or ##assembly line.
+func DetectBuild(contigs []Contig, header []string) Build {
+	for _, c := range contigs {
+		if b, ok := landmarks[contigKey(c.Name)][c.Length]; ok {
+			return Build{b, fmt.Sprintf("length of %s", c.Name)}
+		}
+	}
+	for _, c := range contigs {
+		if b := buildName(c.Assembly); b != "" {
+			return Build{b, fmt.Sprintf("assembly=%s of %s", c.Assembly, c.Name)}
+		}
+	}
+	for _, l := range header {
+		if strings.HasPrefix(l, "##reference=") || strings.HasPrefix(l, "##assembly=") {
+			if b := buildName(l); b != "" {
+				return Build{b, strings.SplitN(l, "=", 2)[0]}
+			}
+		}
+	}
+	return Build{}
+}
+
+// headerLiner is implemented by a SourceBackend with header lines (e.g. ##reference)
+// that may give its build.
+type headerLiner interface {
+	headerLines() []string
+}
+
+func (t tabixBackend) headerLines() []string {
+	if t.VReader == nil {
+		return nil
+	}
+	return t.VReader.Header.Extras
+}
+
+// BuildLine is the start of the line added to the header of the query with its build.
+const BuildLine = "##vcfanno_build="
+
+// setBuild records the build in the header of a VCF query, replacing any earlier one.
+func setBuild(query HeaderUpdater, build string) {
+	r, ok := query.(*vcfgo.Reader)
+	if !ok || build == "" {
+		return
+	}
+	for i, l := range r.Header.Extras {
+		if strings.HasPrefix(l, BuildLine) {
+			r.Header.Extras[i] = BuildLine + build
+			return
+		}
+	}
+	r.Header.Extras = append(r.Header.Extras, BuildLine+build)
+}
+
+// buildChecker checks that the query and annotation files are from the same build.
+type buildChecker struct {
+	first Build
+	from  string
+}
+
+// add returns an error wrapping ErrBuildMismatch if b is not the same as the first
+// known build.
+func (c *buildChecker) add(file string, b Build) error {
+	if b.Name == "" {
+		return nil
+	}
+	if c.first.Name == "" {
+		c.first, c.from = b, file
+		return nil
+	}
+	if b.Name != c.first.Name {
+		return fmt.Errorf("%w: %s is %s but %s is %s", ErrBuildMismatch, c.from, c.first, file, b)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package api
+
+import "testing"
+
+func TestDetectBuild(t *testing.T) {
+	cases := []struct {
+		contigs []Contig
+		header  []string
+		build   string
+	}{
+		{[]Contig{{Name: "chr1", Length: 248956422}}, nil, GRCh38},
+		{[]Contig{{Name: "1", Length: 249250621}}, []string{"##reference=GRCh38.fa"}, GRCh37},
+		{[]Contig{{Name: "2", Length: 10, Assembly: "b37"}}, nil, GRCh37},
+		{[]Contig{{Name: "chrUn", Length: 10}}, []string{"##reference=file:///ref/hs38DH.fa"}, GRCh38},
+		{nil, []string{"##source=chm13"}, ""},
+		{nil, nil, ""},
+	}
+	for i, c := range cases {
+		if b := DetectBuild(c.contigs, c.header); b.Name != c.build {
+			t.Errorf("case %d: expected %q, got %q", i, c.build, b)
+		}
+	}
+
+	var bc buildChecker
+	if bc.add("a", Build{}) != nil || bc.add("b", Build{Name: GRCh37}) != nil || bc.add("c", Build{Name: GRCh37}) != nil {
+		t.Error("unexpected error for the same build")
+	}
+	if err := bc.add("d", Build{Name: GRCh38}); err == nil {
+		t.Error("expected error for a different build")
+	}
+}
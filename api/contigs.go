@@ -0,0 +1,158 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/bam"
+	"github.com/brentp/vcfgo"
+)
+
+// Contig is a sequence named in the header or index of a file. Length is 0 and
+// Assembly is empty if they are not known.
+type Contig struct {
+	Name     string
+	Length   int
+	Assembly string
+}
+
+// ContigLister may be implemented by a SourceBackend (or the HeaderUpdater given to
+// Setup) that knows the contigs of its file. The contigs should be in the order of the
+// data if that is known (e.g. from an index) or of the header otherwise.
+type ContigLister interface {
+	Contigs() []Contig
+}
+
+// HeaderContigs gives the ##contig lines of a VCF header.
+func HeaderContigs(h *vcfgo.Header) []Contig {
+	if h == nil {
+		return nil
+	}
+	contigs := make([]Contig, 0, len(h.Contigs))
+	for _, c := range h.Contigs {
+		if c["ID"] == "" {
+			continue
+		}
+		l, _ := strconv.Atoi(c["length"])
+		contigs = append(contigs, Contig{Name: c["ID"], Length: l, Assembly: c["assembly"]})
+	}
+	return contigs
+}
+
+// Contigs gives the contigs in the order of the index with the lengths from the
+// ##contig lines of a VCF.
+func (t tabixBackend) Contigs() []Contig {
+	var header []Contig
+	if t.VReader != nil {
+		header = HeaderContigs(t.VReader.Header)
+	}
+	named, ok := t.Index.(interface{ Names() []string })
+	if !ok {
+		return header
+	}
+	byName := make(map[string]Contig, len(header))
+	for _, c := range header {
+		byName[c.Name] = c
+	}
+	names := named.Names()
+	contigs := make([]Contig, len(names))
+	for i, n := range names {
+		contigs[i] = byName[n]
+		contigs[i].Name = n
+	}
+	return contigs
+}
+
+// Contigs gives the references from the header of the bam.
+func (b bamBackend) Contigs() []Contig { return b.contigs }
+
+func bamContigs(path string) ([]Contig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br, err := bam.NewReader(f, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	refs := br.Header().Refs()
+	contigs := make([]Contig, len(refs))
+	for i, r := range refs {
+		contigs[i] = Contig{Name: r.Name(), Length: r.Len()}
+	}
+	return contigs, nil
+}
+
+// contigKey matches contigs with and without a chr prefix. chrM is not matched to MT
+// as they differ between hg19 and GRCh37 which are otherwise the same.
+func contigKey(name string) string {
+	return strings.TrimPrefix(name, "chr")
+}
+
+// contigChecker compares the contigs of the query and the annotation files.
+type contigChecker struct {
+	// lengths and from hold the first length seen for each contig and its file.
+	lengths map[string]int
+	from    map[string]string
+	// order is the index of each contig in the query.
+	order map[string]int
+}
+
+func newContigChecker() *contigChecker {
+	return &contigChecker{lengths: make(map[string]int), from: make(map[string]string)}
+}
+
+// add checks the contigs of file. It returns an error wrapping ErrBuildMismatch if a
+// contig has a different length than in an earlier file. The first file added (the
+// query) gives the order. A file with its contigs in another order is only logged: each
+// chunk of the query is queried by region from the index of the file, so its order of
+// contigs does not matter and the query is not reordered.
+func (c *contigChecker) add(file string, contigs []Contig) error {
+	for _, ct := range contigs {
+		k := contigKey(ct.Name)
+		if ct.Length == 0 {
+			continue
+		}
+		if l, ok := c.lengths[k]; ok && l != ct.Length {
+			return fmt.Errorf("%w: %s has length %d in %s but %d in %s", ErrBuildMismatch, ct.Name, ct.Length, file, l, c.from[k])
+		} else if !ok {
+			c.lengths[k], c.from[k] = ct.Length, file
+		}
+	}
+	if c.order == nil {
+		c.order = make(map[string]int, len(contigs))
+		for i, ct := range contigs {
+			c.order[contigKey(ct.Name)] = i
+		}
+		return nil
+	}
+	last, lastName := -1, ""
+	for _, ct := range contigs {
+		i, ok := c.order[contigKey(ct.Name)]
+		if !ok {
+			continue
+		}
+		if i < last {
+			log.Printf("NOTE: contigs in %s are in a different order than in the query (%s before %s). this does not affect annotation.", file, lastName, ct.Name)
+			break
+		}
+		last, lastName = i, ct.Name
+	}
+	return nil
+}
+
+// queryContigs gives the contigs and the other header lines of the query.
+func queryContigs(query HeaderUpdater) ([]Contig, []string) {
+	switch q := query.(type) {
+	case ContigLister:
+		return q.Contigs(), nil
+	case *vcfgo.Reader:
+		return HeaderContigs(q.Header), q.Header.Extras
+	}
+	return nil, nil
+}
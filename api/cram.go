@@ -0,0 +1,252 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/biogo/hts/bam"
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+)
+
+// IsCram indicates that file is a CRAM. It is decoded by samtools, which must be in the
+// PATH, with the reference given by the Fasta of its Source (BackendOptions.Fasta) and
+// needs a .crai index. One samtools view is kept per CRAM and restarted only when a query
+// is before the previous ones, on another chromosome or far past the last record read.
+func IsCram(file string) bool {
+	return strings.HasSuffix(file, ".cram")
+}
+
+// IsAlignments indicates that file is a bam or CRAM from which the coverage, mapq, seq and
+// DP2 are computed.
+func IsAlignments(file string) bool {
+	return strings.HasSuffix(file, ".bam") || IsCram(file)
+}
+
+// maxSkip is the most bases after the last query that are read to get to the next
+// rather than starting samtools again at the next query.
+const maxSkip = 100000
+
+// keepQueries is the number of the last queries whose alignments are kept so that those
+// that arrive out of order (irelate queries its chunks concurrently) are still answered
+// without starting samtools again.
+const keepQueries = 8
+
+// cramBackend reads the records of a CRAM as those of a bam from samtools view. A single
+// samtools reads from the start of a query to the end of its chrom and is used for the
+// queries after it. A query on another chrom, before the alignments that are kept or far
+// after the last query starts samtools again.
+type cramBackend struct {
+	path, ref string
+	contigs   []Contig
+
+	mu    sync.Mutex
+	view  *cramView
+	chrom string
+	// recs are the alignments read from view, by start, that end after low.
+	recs []*parsers.Bam
+	low  uint32
+	// next is the start of the last alignment read and eof is set when there are no more.
+	next   uint32
+	eof    bool
+	starts []uint32
+}
+
+func openCram(path string, opts BackendOptions) (SourceBackend, error) {
+	ref := opts.Fasta
+	if ref == "" {
+		return nil, fmt.Errorf("a reference fasta is required for a CRAM")
+	}
+	if _, err := os.Stat(path + ".crai"); err != nil {
+		return nil, err
+	}
+	c := &cramBackend{path: path, ref: ref}
+	v, err := c.start("-H")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range v.br.Header().Refs() {
+		c.contigs = append(c.contigs, Contig{Name: r.Name(), Length: r.Len()})
+	}
+	v.Close()
+	return c, nil
+}
+
+// start runs samtools view on the CRAM with args after the options and reads its output.
+func (c *cramBackend) start(args ...string) (*cramView, error) {
+	v := &cramView{}
+	v.cmd = exec.Command("samtools", append([]string{"view", "-u", "-T", c.ref, c.path}, args...)...)
+	v.cmd.Stderr = &v.stderr
+	out, err := v.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := v.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("samtools is required to read a CRAM: %w", err)
+	}
+	if v.br, err = bam.NewReader(out, 1); err != nil {
+		v.cmd.Process.Kill()
+		return nil, v.wait(err)
+	}
+	return v, nil
+}
+
+// name gives the name of chrom in the CRAM, adding or removing a chr prefix if needed.
+func (c *cramBackend) name(chrom string) (string, bool) {
+	for _, n := range []string{chrom, "chr" + chrom, strings.TrimPrefix(chrom, "chr")} {
+		for _, ct := range c.contigs {
+			if ct.Name == n {
+				return n, true
+			}
+		}
+	}
+	return "", false
+}
+
+// seek starts samtools at start (0-based) on chrom.
+func (c *cramBackend) seek(chrom string, start uint32) error {
+	c.reset()
+	v, err := c.start(fmt.Sprintf("%s:%d", chrom, start+1))
+	if err != nil {
+		return err
+	}
+	c.view, c.chrom, c.low = v, chrom, start
+	return nil
+}
+
+// reset stops samtools and drops the alignments.
+func (c *cramBackend) reset() {
+	if c.view != nil {
+		c.view.Close()
+	}
+	c.view, c.chrom, c.recs, c.low, c.next, c.eof, c.starts = nil, "", nil, 0, 0, false, nil
+}
+
+// Query returns the alignments overlapping region. There are none for a contig that is
+// not in the CRAM.
+func (c *cramBackend) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	var rels sliceIterator
+	chrom, ok := c.name(region.Chrom())
+	if !ok {
+		return &rels, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, e := region.Start(), region.End()
+	if c.view == nil || chrom != c.chrom || s < c.low || (!c.eof && s > c.next+maxSkip) {
+		if err := c.seek(chrom, s); err != nil {
+			return nil, err
+		}
+	}
+	for !c.eof && c.next < e {
+		b, err := c.view.read(chrom)
+		if err == io.EOF {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			c.reset()
+			return nil, err
+		}
+		c.recs = append(c.recs, b)
+		c.next = b.Start()
+	}
+	for _, b := range c.recs {
+		if b.Start() >= e {
+			break
+		}
+		if b.End() > s {
+			rels = append(rels, b)
+		}
+	}
+
+	// drop the alignments that end before the last queries.
+	if c.starts = append(c.starts, s); len(c.starts) > keepQueries {
+		c.starts = c.starts[1:]
+	}
+	if low := slices.Min(c.starts); low > c.low {
+		c.low = low
+		recs := c.recs[:0]
+		for _, b := range c.recs {
+			if b.End() > low {
+				recs = append(recs, b)
+			}
+		}
+		clear(c.recs[len(recs):])
+		c.recs = recs
+	}
+	return &rels, nil
+}
+
+// Header is the same as for a bam.
+func (c *cramBackend) Header(field string) (string, string, string) {
+	return bamBackend{}.Header(field)
+}
+
+// Contigs gives the references from the header of the CRAM.
+func (c *cramBackend) Contigs() []Contig { return c.contigs }
+
+// Close stops samtools.
+func (c *cramBackend) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+	return nil
+}
+
+// cramView reads the alignments from samtools view.
+type cramView struct {
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	br     *bam.Reader
+	done   bool
+}
+
+// wait waits for samtools to exit and gives its error or else err.
+func (v *cramView) wait(err error) error {
+	v.done = true
+	if werr := v.cmd.Wait(); werr != nil {
+		return fmt.Errorf("samtools: %w: %s", werr, strings.TrimSpace(v.stderr.String()))
+	}
+	return err
+}
+
+// read gives the next alignment on chrom. Once samtools has exited, it gives io.EOF or
+// the error.
+func (v *cramView) read(chrom string) (*parsers.Bam, error) {
+	if v.done {
+		return nil, io.EOF
+	}
+	for {
+		rec, err := v.br.Read()
+		if err != nil {
+			if err != io.EOF {
+				// samtools may still be writing.
+				v.cmd.Process.Kill()
+			}
+			return nil, v.wait(err)
+		}
+		if rec.Ref != nil && rec.Ref.Name() == chrom {
+			return &parsers.Bam{Record: rec, Chromosome: chrom}, nil
+		}
+	}
+}
+
+// Close stops samtools if it has not finished.
+func (v *cramView) Close() error {
+	if v.br != nil {
+		v.br.Close()
+	}
+	if !v.done {
+		v.done = true
+		v.cmd.Process.Kill()
+		v.cmd.Wait()
+	}
+	return nil
+}
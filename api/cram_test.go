@@ -0,0 +1,180 @@
+package api
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/vcfgo"
+)
+
+// writeAlignments writes the test alignments as a bam to path and gives the path of
+// their reference in dir.
+func writeAlignments(t *testing.T, dir, path string) string {
+	ref, err := sam.NewReference("1", "", "", 1000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := bam.NewWriter(f, h, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		name  string
+		pos   int
+		n     int
+		mapq  byte
+		flags sam.Flags
+	}{{"fwd", 10, 20, 30, 0}, {"rev", 15, 20, 40, sam.Reverse}, {"mapq0", 12, 10, 0, 0}, {"dup", 16, 10, 60, sam.Duplicate},
+		{"after", 500, 20, 60, 0}} {
+		rec, err := sam.NewRecord(r.name, ref, nil, r.pos, -1, 0, r.mapq, []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, r.n)},
+			[]byte(strings.Repeat("A", r.n)), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Flags = r.flags
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fa := filepath.Join(dir, "ref.fa")
+	if err := os.WriteFile(fa, []byte(">1\n"+strings.Repeat("ACGTACGTAC\n", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fa
+}
+
+// writeCram writes a bam as path.cram and a samtools to the PATH that gives it for any
+// region if the reference exists and appends the region to path.calls. If CRAM_FAIL is
+// set, the bam is followed by bytes that are not BGZF and samtools fails with CRAM_FAIL.
+func writeCram(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ex.cram")
+	fa := writeAlignments(t, dir, path)
+	files := map[string]string{
+		path + ".crai": "",
+		filepath.Join(dir, "samtools"): "#!/bin/sh\n" +
+			"[ \"$3\" = -T ] && [ -f \"$4\" ] || { echo \"$4: no reference\" >&2; exit 1; }\n" +
+			"echo \"$6\" >> " + path + ".calls\n" +
+			"[ -n \"$CRAM_FAIL\" ] && { echo \"$CRAM_FAIL\" >&2; cat " + path + "; printf 'not bgzf'; exit 1; }\n" +
+			"exec cat " + path + "\n",
+	}
+	for name, s := range files {
+		if err := os.WriteFile(name, []byte(s), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return path, fa
+}
+
+func TestCram(t *testing.T) {
+	path, fa := writeCram(t)
+	if !IsCram(path) || !IsAlignments(path) || !IsAlignments("ex.bam") || IsCram("ex.bam") {
+		t.Error("bad IsCram or IsAlignments")
+	}
+	if _, err := openCram(path, BackendOptions{}); err == nil {
+		t.Error("expected an error without a reference")
+	}
+	if _, err := openCram(path, BackendOptions{Fasta: fa + ".missing"}); err == nil || !strings.Contains(err.Error(), "no reference") {
+		t.Errorf("expected the error from samtools, got %v", err)
+	}
+	checkCram(t, path, fa)
+	// a single samtools is used for the queries after the first and started again for
+	// the query before them.
+	if calls, err := os.ReadFile(path + ".calls"); err != nil || string(calls) != "-H\n1:18\n1:5\n" {
+		t.Errorf("unexpected samtools calls: %q (%v)", calls, err)
+	}
+
+	t.Setenv("CRAM_FAIL", "truncated file")
+	c, err := openCram(path, BackendOptions{Fasta: fa})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the error from samtools is only read after it has exited.
+	if _, err := c.Query(makeVariant("1", 600, "A", []string{"T"}, "v", "", vcfgo.NewHeader())); err == nil ||
+		!strings.Contains(err.Error(), "truncated file") {
+		t.Errorf("expected the error from samtools, got %v", err)
+	}
+}
+
+// TestSamtools decodes a real CRAM. It is skipped if samtools is not in the PATH.
+func TestSamtools(t *testing.T) {
+	if _, err := exec.LookPath("samtools"); err != nil {
+		t.Skip("samtools is not in the PATH")
+	}
+	dir := t.TempDir()
+	bam, path := filepath.Join(dir, "ex.bam"), filepath.Join(dir, "ex.cram")
+	fa := writeAlignments(t, dir, bam)
+	for _, args := range [][]string{{"sort", "-O", "cram", "--reference", fa, "-o", path, bam}, {"index", path}} {
+		if out, err := exec.Command("samtools", args...).CombinedOutput(); err != nil {
+			t.Fatalf("samtools %s: %s: %s", args[0], err, out)
+		}
+	}
+	checkCram(t, path, fa)
+}
+
+// checkCram checks the annotations from the alignments of writeAlignments in the CRAM
+// at path.
+func checkCram(t *testing.T, path, fa string) {
+	t.Helper()
+	srcs := []*Source{{File: path, Op: "count", Name: "cov", Fasta: fa}, {File: path, Op: "DP2", Field: "DP2", Name: "dp2", Fasta: fa},
+		{File: path, Op: "mean", Field: "mapq", Name: "mq", Fasta: fa}, {File: path, Op: "first", Field: "seq", Name: "seq", Fasta: fa}}
+	a, err := NewAnnotator(srcs, "", false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs, err := a.Setup(&headerLines{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs := qs[0].(ContigLister).Contigs(); len(cs) != 1 || cs[0] != (Contig{Name: "1", Length: 1000}) {
+		t.Errorf("unexpected contigs %v", cs)
+	}
+	// the reads with mapq 0 and duplicates are not counted.
+	for _, c := range []struct {
+		chrom string
+		pos   int
+		exp   string
+	}{{"1", 18, "cov=2;dp2=1,1;mq=35;seq=AAAAAAAAAAAAAAAAAAAA"},
+		{"chr1", 31, "cov=1;dp2=0,1;mq=40;seq=AAAAAAAAAAAAAAAAAAAA"}, {"1", 5, "."}, {"2", 18, "."}} {
+		v := makeVariant(c.chrom, c.pos, "A", []string{"T"}, "v", "", vcfgo.NewHeader())
+		it, err := qs[0].Query(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r, err := it.Next(); err == nil; r, err = it.Next() {
+			r.SetSource(1)
+			v.AddRelated(r)
+		}
+		it.Close()
+		if err := a.AnnotateOne(v, a.Strict); err != nil {
+			t.Fatal(err)
+		}
+		if got := v.Info().String(); got != c.exp {
+			t.Errorf("%s:%d: expected %s, got %s", c.chrom, c.pos, c.exp, got)
+		}
+	}
+
+	if _, err := NewAnnotator([]*Source{{File: path, Op: "count", Name: "cov"}}, "", false, false, nil); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected ErrConfig without a reference, got %v", err)
+	}
+}
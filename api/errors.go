@@ -0,0 +1,72 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the api (and shared) packages. Use errors.Is to check for these
+// as they are usually wrapped with more context.
+var (
+	// ErrMultiValue occurs when an op that needs a single number gets multiple values, e.g.
+	// from a multi-allelic that was not decomposed.
+	ErrMultiValue = errors.New("multiple values given to op that needs a single value")
+	// ErrUnknownOp occurs when an op (or a field for a bam) is not known.
+	ErrUnknownOp = errors.New("unknown op")
+	// ErrSourceOpen occurs when an annotation source can not be opened.
+	ErrSourceOpen = errors.New("unable to open annotation source")
+	// ErrLua occurs when the custom lua can not be read or parsed.
+	ErrLua = errors.New("error in lua")
+	// ErrConfig occurs for an invalid Source or PostAnnotation.
+	ErrConfig = errors.New("invalid configuration")
+	// ErrBuildMismatch occurs when a contig has different lengths in the query and an
+	// annotation file, e.g. when they are from different genome builds.
+	ErrBuildMismatch = errors.New("genome build mismatch")
+	// ErrOp occurs when an op fails (panics) for the values of a single variant. It is
+	// not fatal: the other annotations of the variant are still added.
+	ErrOp = errors.New("op failed")
+)
+
+// VariantError is returned when annotating a variant fails. It gives the location of the
+// variant and the name of the annotation along with the underlying error.
+type VariantError struct {
+	Chrom string
+	// Pos is 1-based.
+	Pos  int
+	Name string
+	Err  error
+}
+
+func (e *VariantError) Error() string {
+	return fmt.Sprintf("%s at %s:%d: %s", e.Name, e.Chrom, e.Pos, e.Err)
+}
+
+func (e *VariantError) Unwrap() error { return e.Err }
+
+// IsFatal indicates that err is due to an invalid configuration or input rather than, for
+// example, a field missing from a single annotation. Callers will usually want to stop
+// annotating when this is true.
+func IsFatal(err error) bool {
+	for _, f := range []error{ErrMultiValue, ErrUnknownOp, ErrSourceOpen, ErrLua, ErrConfig, ErrBuildMismatch} {
+		if errors.Is(err, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// reduce calls fn and converts a panic from it (e.g. from asfloat64 on a
+// multi-valued input) to an error so that Reducer can keep its simple signature. A panic
+// other than ErrMultiValue gives an ErrOp.
+func reduce(fn func() interface{}) (val interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok && errors.Is(e, ErrMultiValue) {
+				err = e
+			} else {
+				err = fmt.Errorf("%w: %v", ErrOp, r)
+			}
+		}
+	}()
+	return fn(), nil
+}
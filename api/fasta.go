@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/vcfanno/fasta"
+)
+
+func init() {
+	if err := RegisterVariantSource(fasta.Prefix, openFasta); err != nil {
+		panic(err)
+	}
+}
+
+// fastaSource computes the annotations of each variant from a reference (fasta:path or,
+// with no path, the Fasta of the Source).
+type fastaSource struct {
+	r *fasta.Reader
+}
+
+func openFasta(path string, ref *fasta.Reader) (VariantSource, error) {
+	if path == "" {
+		if ref == nil {
+			return nil, fmt.Errorf("no reference given")
+		}
+		return fastaSource{r: ref}, nil
+	}
+	r, err := fasta.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return fastaSource{r: r}, nil
+}
+
+func (f fastaSource) Value(field string, v interfaces.IVariant) (interface{}, error) {
+	return f.r.Value(field, v.Chrom(), int(v.Start()), v.Ref(), v.Alt())
+}
+
+func (f fastaSource) Header(field string) (string, string, string) {
+	return fasta.Header(field)
+}
+
+// SelectFields checks that each field can be computed from the reference.
+func (f fastaSource) SelectFields(fields []string) error {
+	for _, field := range fields {
+		if err := fasta.CheckField(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f fastaSource) Contigs() []Contig { return readerContigs(f.r) }
+
+// setupFastas opens the FASTA of each Source and PostAnnotation with one. It is called
+// once for an Annotator.
+func (a *Annotator) setupFastas() error {
+	for _, path := range a.fastaPaths() {
+		r, err := fasta.Open(path)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrSourceOpen, err)
+		}
+		if a.fastas == nil {
+			a.fastas = make(map[string]*fasta.Reader)
+			a.fastaBuilds = make(map[string]string)
+		}
+		a.fastas[path] = r
+		a.fastaBuilds[path] = DetectBuild(readerContigs(r), nil).Name
+	}
+	return nil
+}
+
+// readerContigs gives the contigs of the FASTA of r.
+func readerContigs(r *fasta.Reader) []Contig {
+	names, lengths := r.Contigs()
+	contigs := make([]Contig, len(names))
+	for i := range names {
+		contigs[i] = Contig{Name: names[i], Length: lengths[i]}
+	}
+	return contigs
+}
+
+// fastaPaths gives the path of each FASTA in the order of the Sources (given to a
+// VariantSource or CRAM) and then of the PostAnnotations with an identifier op.
+func (a *Annotator) fastaPaths() []string {
+	var all, paths []string
+	for _, src := range a.Sources {
+		all = append(all, src.Fasta)
+	}
+	for _, post := range a.PostAnnos {
+		if IsIdentifierOp(post.Op) {
+			all = append(all, post.Fasta)
+		}
+	}
+	for _, path := range all {
+		if path == "" {
+			continue
+		}
+		seen := false
+		for _, p := range paths {
+			seen = seen || p == path
+		}
+		if !seen {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
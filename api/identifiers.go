@@ -0,0 +1,95 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/vcfanno/varid"
+)
+
+// Postannotation ops that give a standard identifier for each ALT of the query. They
+// use the reference in PostAnnotation.Fasta and need no Fields.
+const (
+	// OpSPDI gives the canonical NCBI SPDI, e.g. NC_000001.11:12344:A:G.
+	OpSPDI = "spdi"
+	// OpHGVS gives the HGVS genomic notation, e.g. NC_000001.11:g.12345A>G.
+	OpHGVS = "hgvs"
+	// OpVRS gives the GA4GH VRS (version 2) allele digest, e.g. ga4gh:VA.<digest>.
+	OpVRS = "vrs"
+)
+
+// IsIdentifierOp indicates that op is OpSPDI, OpHGVS or OpVRS.
+func IsIdentifierOp(op string) bool {
+	return op == OpSPDI || op == OpHGVS || op == OpVRS
+}
+
+func identifierDescription(post *PostAnnotation) string {
+	what := map[string]string{OpSPDI: "NCBI SPDI", OpHGVS: "HGVS genomic notation", OpVRS: "GA4GH VRS allele digest"}[post.Op]
+	return fmt.Sprintf("%s of each ALT normalized with %s", what, post.Fasta)
+}
+
+// annotateIdentifiers adds the identifiers of each identifier op to v. An ALT without an
+// identifier (e.g. <DEL>) is given as ".". The identifiers for a PostAnnotation named ID
+// are instead appended (joined by ;) to the existing ID of v, which is returned if it
+// changed. As the ID is not per ALT, an ALT without an identifier is skipped there. An
+// error is returned if REF does not match the reference.
+func (a *Annotator) annotateIdentifiers(v interfaces.IVariant) (string, error) {
+	var ids []string
+	if id := v.Id(); id != "" && id != "." {
+		ids = strings.Split(id, ";")
+	}
+	n := len(ids)
+	var err error
+	for _, post := range a.PostAnnos {
+		if !IsIdentifierOp(post.Op) {
+			continue
+		}
+		r := a.fastas[post.Fasta]
+		acc := varid.Accession(a.fastaBuilds[post.Fasta], v.Chrom())
+		vals := make([]string, len(v.Alt()))
+		for i, alt := range v.Alt() {
+			vals[i] = "."
+			al, e := varid.Normalize(r, v.Chrom(), int(v.Start()), v.Ref(), alt)
+			if e != nil {
+				if !errors.Is(e, varid.ErrUnsupported) {
+					err = &VariantError{Chrom: v.Chrom(), Pos: int(v.Start()) + 1, Name: post.Name, Err: e}
+				}
+				continue
+			}
+			switch post.Op {
+			case OpSPDI:
+				vals[i] = varid.SPDI(al, acc)
+			case OpHGVS:
+				vals[i] = varid.HGVS(al, acc)
+			case OpVRS:
+				seq, e := r.Refget(v.Chrom())
+				if e != nil {
+					err = &VariantError{Chrom: v.Chrom(), Pos: int(v.Start()) + 1, Name: post.Name, Err: e}
+					continue
+				}
+				vals[i] = varid.VRS(al, seq)
+			}
+		}
+		if post.Name == "ID" {
+			for _, val := range vals {
+				if val != "." && !slices.Contains(ids, val) {
+					ids = append(ids, val)
+				}
+			}
+			continue
+		}
+		for _, val := range vals {
+			if val != "." {
+				v.Info().Set(post.Name, strings.Join(vals, ","))
+				break
+			}
+		}
+	}
+	if len(ids) == n {
+		return "", err
+	}
+	return strings.Join(ids, ";"), err
+}
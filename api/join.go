@@ -0,0 +1,391 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/vcfgo"
+	"github.com/brentp/xopen"
+)
+
+// JoinID and JoinInfo are the values of Source.JoinOn. JoinInfo is followed by the
+// name of the INFO field, e.g. "INFO:GENE".
+const (
+	JoinID   = "ID"
+	JoinInfo = "INFO:"
+)
+
+// CheckJoinOn checks that on is a valid value for Source.JoinOn.
+func CheckJoinOn(on string) error {
+	if on == JoinID || (strings.HasPrefix(on, JoinInfo) && len(on) > len(JoinInfo)) {
+		return nil
+	}
+	return fmt.Errorf("%w: join_on must be 'ID' or 'INFO:<field>', got '%s'", ErrConfig, on)
+}
+
+// splitKeys splits a (multi-valued) key such as "BRCA1,NBR2" or "rs1;rs2". Empty and
+// missing (".") keys are skipped.
+func splitKeys(keys []string, s string) []string {
+	for _, k := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' || r == '|' || r == '&' }) {
+		if k == "." {
+			continue
+		}
+		dup := false
+		for _, o := range keys {
+			if o == k {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// variantKeys gives the keys of v for a JoinOn of ID or INFO:<field>.
+func variantKeys(v interfaces.IVariant, on string) []string {
+	if on == JoinID {
+		return splitKeys(nil, v.Id())
+	}
+	val, err := v.Info().Get(on[len(JoinInfo):])
+	if err != nil || val == nil {
+		return nil
+	}
+	var keys []string
+	switch val := val.(type) {
+	case string:
+		keys = splitKeys(keys, val)
+	case []string:
+		for _, s := range val {
+			keys = splitKeys(keys, s)
+		}
+	case []interface{}:
+		for _, s := range val {
+			keys = splitKeys(keys, fmt.Sprintf("%v", s))
+		}
+	default:
+		keys = splitKeys(keys, fmt.Sprintf("%v", val))
+	}
+	return keys
+}
+
+// joinRow holds the value for each Source of a joinTable from a single line of the file.
+type joinRow []interface{}
+
+// joinTable is the in-memory hash of key to rows for a file annotated with JoinOn.
+// Only the values used by the Sources are kept.
+type joinTable struct {
+	srcs   []*Source
+	rows   map[string][]joinRow
+	header map[string][3]string
+}
+
+// joinKey identifies the table of a Source. Sources from the same file and with the
+// same key share a table.
+func (s *Source) joinKey() string {
+	return fmt.Sprintf("%s\x00%s\x00%d", s.File, s.JoinOn, s.JoinColumn)
+}
+
+func isVCF(path string) bool {
+	return strings.HasSuffix(path, ".vcf") || strings.HasSuffix(path, ".vcf.gz") || strings.HasSuffix(path, ".vcf.bgz")
+}
+
+// loadJoin reads the file of srcs into a joinTable. All srcs must have the same joinKey.
+func loadJoin(srcs []*Source) (*joinTable, error) {
+	rdr, err := xopen.Ropen(srcs[0].File)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	t := &joinTable{srcs: srcs, rows: make(map[string][]joinRow), header: make(map[string][3]string)}
+	if isVCF(srcs[0].File) {
+		err = t.readVCF(rdr)
+	} else {
+		err = t.readTSV(rdr)
+	}
+	return t, err
+}
+
+func (t *joinTable) add(keys []string, row joinRow) {
+	for _, k := range keys {
+		k = strings.Clone(k)
+		t.rows[k] = append(t.rows[k], row)
+	}
+}
+
+func (t *joinTable) readVCF(r io.Reader) error {
+	vcf, err := vcfgo.NewReader(r, true)
+	if err != nil {
+		return err
+	}
+	on := t.srcs[0].JoinOn
+	for _, src := range t.srcs {
+		switch src.Field {
+		case "ID", "FILTER":
+			t.header[src.Field] = [3]string{"String", "1", src.Field}
+		default:
+			if h, ok := vcf.Header.Infos[src.Field]; ok {
+				t.header[src.Field] = [3]string{h.Type, h.Number, h.Description}
+			}
+		}
+	}
+	for v := vcf.Read(); v != nil; v = vcf.Read() {
+		keys := variantKeys(v, on)
+		if len(keys) == 0 {
+			continue
+		}
+		row := make(joinRow, len(t.srcs))
+		for i, src := range t.srcs {
+			var val interface{}
+			switch src.Field {
+			case "ID":
+				val = strings.Replace(v.Id(), ";", ",", -1)
+			case "FILTER":
+				if v.Filter != "PASS" {
+					val = strings.Replace(v.Filter, ";", ",", -1)
+				}
+			default:
+				// copy strings so the rows do not keep the lines of the file.
+				switch s := infoValue(v, src.Field).(type) {
+				case string:
+					val = strings.Clone(s)
+				case []string:
+					c := make([]string, len(s))
+					for k := range s {
+						c[k] = strings.Clone(s[k])
+					}
+					val = c
+				default:
+					val = s
+				}
+			}
+			if val != "" && val != "." {
+				row[i] = val
+			}
+		}
+		t.add(keys, row)
+	}
+	return vcf.Error()
+}
+
+func infoValue(v interfaces.IVariant, field string) interface{} {
+	val, _ := v.Info().Get(field)
+	return val
+}
+
+// readTSV reads a tab-delimited file. Sources with a Field choose their column by
+// name from the header: the last line starting with '#' before the data or, if that
+// does not have the names, the first line. Otherwise, the first line is skipped as a
+// header if it starts with '#' or has a value that is not a number for a numeric op.
+func (t *joinTable) readTSV(r io.Reader) error {
+	col := t.srcs[0].JoinColumn
+	if col < 1 {
+		col = 1
+	}
+	byName := false
+	for _, src := range t.srcs {
+		byName = byName || src.Field != ""
+	}
+	br := bufio.NewReader(r)
+	var comment string
+	first := true
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" && line[0] == '#' {
+			comment = line[1:]
+		} else if line != "" {
+			fields := strings.Split(line, "\t")
+			header := false
+			if first {
+				first = false
+				if byName {
+					if t.setColumns(strings.Split(comment, "\t")) != nil {
+						if err := t.setColumns(fields); err != nil {
+							return err
+						}
+						header = true
+					}
+				} else {
+					header = t.isHeader(fields)
+				}
+			}
+			if !header {
+				if err := t.addTSV(fields, col, line); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// setColumns sets the Column of each Source with a Field from the column names in header.
+func (t *joinTable) setColumns(header []string) error {
+	for _, src := range t.srcs {
+		if src.Field == "" {
+			continue
+		}
+		src.Column = slices.Index(header, src.Field) + 1
+		if src.Column == 0 {
+			return fmt.Errorf("%w: column %s not found in header: %s", ErrConfig, src.Field, strings.Join(header, "\t"))
+		}
+	}
+	return nil
+}
+
+// isHeader reports whether fields has a value that is not a number in the column of a
+// numeric op, as in the column names of a header without a '#'.
+func (t *joinTable) isHeader(fields []string) bool {
+	for _, src := range t.srcs {
+		if src.IsNumber() && src.Column >= 1 && src.Column <= len(fields) {
+			if v := fields[src.Column-1]; v != "" && v != "." {
+				if _, err := parseNumber(v); err != nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (t *joinTable) addTSV(fields []string, col int, line string) error {
+	if col > len(fields) {
+		return fmt.Errorf("%w: key column %d not found in line: %s", ErrConfig, col, line)
+	}
+	row := make(joinRow, len(t.srcs))
+	for i, src := range t.srcs {
+		if src.Column < 1 || src.Column > len(fields) {
+			return fmt.Errorf("%w: column %d not found in line: %s", ErrConfig, src.Column, line)
+		}
+		sval := fields[src.Column-1]
+		if sval == "" || sval == "." {
+			continue
+		}
+		if src.IsNumber() {
+			var err error
+			if row[i], err = parseNumber(sval); err != nil {
+				return err
+			}
+		} else {
+			row[i] = strings.Replace(sval, ";", ",", -1)
+		}
+	}
+	t.add(splitKeys(nil, fields[col-1]), row)
+	return nil
+}
+
+// lookup collects the values for src of all rows that match any key of v. A row that
+// matches more than one key is used once.
+func (t *joinTable) lookup(v interfaces.IVariant, src *Source) []interface{} {
+	idx := -1
+	for i, s := range t.srcs {
+		if s == src {
+			idx = i
+		}
+	}
+	var coll []interface{}
+	var seen []joinRow
+	for _, k := range variantKeys(v, src.JoinOn) {
+	rows:
+		for _, row := range t.rows[k] {
+			for _, s := range seen {
+				if &s[0] == &row[0] {
+					continue rows
+				}
+			}
+			seen = append(seen, row)
+			val := row[idx]
+			if val == nil {
+				continue
+			}
+			if arr, ok := val.([]interface{}); ok {
+				if src.Op == "uniq" || src.Op == "concat" {
+					sarr := make([]string, len(arr))
+					for i, v := range arr {
+						sarr[i] = fmt.Sprintf("%v", v)
+					}
+					coll = append(coll, strings.Join(sarr, ","))
+				} else {
+					coll = append(coll, arr...)
+				}
+			} else {
+				coll = append(coll, val)
+			}
+		}
+	}
+	return coll
+}
+
+// Header gives the type, number and description of field from the header of a VCF.
+// Number=A, R and G are given as "." as the values are not matched to alleles.
+func (t *joinTable) Header(field string) (string, string, string) {
+	h := t.header[field]
+	switch h[1] {
+	case "A", "R", "G":
+		h[1] = "."
+	}
+	return h[0], h[1], h[2]
+}
+
+// setupJoins loads the table for each Source with a JoinOn. It is called once for
+// an Annotator.
+func (a *Annotator) setupJoins() error {
+	var keys []string
+	bykey := make(map[string][]*Source)
+	for _, src := range a.Sources {
+		if src.JoinOn == "" {
+			continue
+		}
+		k := src.joinKey()
+		if _, ok := bykey[k]; !ok {
+			keys = append(keys, k)
+		}
+		bykey[k] = append(bykey[k], src)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	a.joins = make(map[string]*joinTable, len(keys))
+	for _, k := range keys {
+		t, err := loadJoin(bykey[k])
+		if errors.Is(err, ErrConfig) {
+			return fmt.Errorf("%w for %s", err, bykey[k][0].File)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s: %s", ErrSourceOpen, bykey[k][0].File, err)
+		}
+		a.joins[k] = t
+	}
+	return nil
+}
+
+// annotateJoins annotates v with each Source with a JoinOn.
+func (a *Annotator) annotateJoins(v interfaces.IVariant) error {
+	var e error
+	for _, src := range a.Sources {
+		if src.JoinOn == "" {
+			continue
+		}
+		vals := a.joins[src.joinKey()].lookup(v, src)
+		if err := src.annotate(v, vals, "", a.FloatFormat); err != nil {
+			e = &VariantError{Chrom: v.Chrom(), Pos: int(v.Start()) + 1, Name: src.Name, Err: err}
+			if IsFatal(err) {
+				return e
+			}
+		}
+	}
+	return e
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/fasta"
+	"github.com/brentp/vcfanno/liftover"
+	"github.com/brentp/vcfgo"
+)
+
+// liftBackend is a SourceBackend in another build than the query. Each region is lifted
+// to the build of the backend and the annotations are mapped back to the build of the
+// query so that they are matched (by position and alleles) as usual.
+type liftBackend struct {
+	SourceBackend
+	chains *liftover.Chains
+	// ref is the reference of the query, if any, used to left-align lifted indels.
+	ref      *fasta.Reader
+	unmapped *int64
+}
+
+func (l liftBackend) SelectFields(fields []string) error {
+	if fs, ok := l.SourceBackend.(FieldSelector); ok {
+		return fs.SelectFields(fields)
+	}
+	return nil
+}
+
+func (l liftBackend) FieldColumn(field string) int {
+	if fc, ok := l.SourceBackend.(FieldColumner); ok {
+		return fc.FieldColumn(field)
+	}
+	return -1
+}
+
+// sliceIterator iterates over the annotations from a liftBackend.
+type sliceIterator []interfaces.Relatable
+
+func (s *sliceIterator) Next() (interfaces.Relatable, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	r := (*s)[0]
+	*s = (*s)[1:]
+	return r, nil
+}
+
+func (s *sliceIterator) Close() error { return nil }
+
+func (l liftBackend) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	var rels sliceIterator
+	for _, seg := range l.chains.Segments(region.Chrom(), region.Start(), region.End()) {
+		t := seg.Target
+		it, err := l.SourceBackend.Query(parsers.NewInterval(t.Chrom, t.Start, t.End, nil, 0, nil))
+		if err != nil {
+			return nil, err
+		}
+		for {
+			r, err := it.Next()
+			if r != nil {
+				if u := l.unlift(r, seg.Chain, region.Chrom()); u == nil {
+					atomic.AddInt64(l.unmapped, 1)
+				} else if u.Start() < region.End() && u.End() > region.Start() {
+					rels = append(rels, u)
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				it.Close()
+				return nil, err
+			}
+		}
+		it.Close()
+	}
+	sort.SliceStable(rels, func(i, j int) bool {
+		return rels[i].Start() < rels[j].Start() || (rels[i].Start() == rels[j].Start() && rels[i].End() < rels[j].End())
+	})
+	return &rels, nil
+}
+
+// unlift maps an annotation back to chrom in the build of the query. It returns nil if
+// the annotation is not within a single block of the chain or is not an interval or a
+// variant. The END of a structural variant is moved with it. On the - strand, the
+// alleles are reverse-complemented, those of an indel are left-aligned (see normalize)
+// and the REF of a structural variant is the base at its new start (see base).
+func (l liftBackend) unlift(r interfaces.Relatable, c *liftover.Chain, chrom string) interfaces.Relatable {
+	s, e, ok := c.Unlift(r.Start(), r.End())
+	if !ok {
+		return nil
+	}
+	var v *vcfgo.Variant
+	switch o := r.(type) {
+	case *parsers.Interval:
+		return parsers.NewInterval(chrom, s, e, o.Fields, 0, nil)
+	case *parsers.Variant:
+		v, _ = o.IVariant.(*vcfgo.Variant)
+	case interfaces.VarWrap:
+		v, _ = o.IVariant.(*vcfgo.Variant)
+	}
+	if v == nil {
+		return nil
+	}
+	lifted := *v
+	lifted.Chromosome, lifted.Pos = chrom, uint64(s)+1
+	if info, ok := v.Info_.(*vcfgo.InfoByte); ok && info.Contains("END") {
+		// the INFO is copied as the backend may keep v.
+		info = vcfgo.NewInfoByte(append([]byte(nil), info.Info...), v.Header)
+		info.Set("END", int(e))
+		lifted.Info_ = info
+	}
+	if lifted.Start() != s || lifted.End() != e {
+		// e.g. an SVLEN that does not agree with the END.
+		return nil
+	}
+	if c.Minus {
+		lifted.Reference = liftover.ReverseComplement(v.Reference)
+		lifted.Alternate = make([]string, len(v.Alternate))
+		indel, symbolic := false, false
+		for i, a := range v.Alternate {
+			if isSymbolic(a) {
+				lifted.Alternate[i] = a
+				symbolic = true
+				continue
+			}
+			lifted.Alternate[i] = liftover.ReverseComplement(a)
+			indel = indel || len(a) != len(v.Reference)
+		}
+		if symbolic && len(v.Reference) == 1 {
+			// the REF of a structural variant is the base at its start, now on the other side.
+			lifted.Reference = l.base(chrom, uint64(s))
+		} else if indel {
+			l.normalize(&lifted)
+		}
+	}
+	return interfaces.AsRelatable(&lifted)
+}
+
+// normalize left-aligns the alleles of a reverse-complemented indel, whose base shared
+// by the alleles (first in the VCF) is now last: while the alleles end with the same
+// base, it is removed and, if an allele is empty, the base to the left is added to all.
+// The base to the left is from the reference of the query or, without one, is N so that
+// the alleles are still matched to the query after trimming (see trimAllele).
+func (l liftBackend) normalize(v *vcfgo.Variant) {
+	alleles := append([]string{v.Reference}, v.Alternate...)
+	pos := v.Pos - 1
+	for {
+		last := alleles[0][len(alleles[0])-1]
+		empty := false
+		for _, a := range alleles {
+			if len(a) == 0 || a[len(a)-1] != last {
+				return
+			}
+			empty = empty || len(a) == 1
+		}
+		if empty && pos == 0 {
+			break
+		}
+		for i, a := range alleles {
+			alleles[i] = a[:len(a)-1]
+		}
+		if empty {
+			pos--
+			base := l.base(v.Chromosome, pos)
+			for i, a := range alleles {
+				alleles[i] = base + a
+			}
+		}
+		v.Pos, v.Reference, v.Alternate = pos+1, alleles[0], alleles[1:]
+	}
+}
+
+// base gives the base of the query reference at the 0-based pos or N.
+func (l liftBackend) base(chrom string, pos uint64) string {
+	if l.ref != nil {
+		if seq, ok, err := l.ref.Seq(chrom, int(pos), int(pos)+1); ok && err == nil && len(seq) == 1 {
+			return strings.ToUpper(seq)
+		}
+	}
+	return "N"
+}
+
+// loadChains opens the chain file of each Source with a Chain. It is called once for
+// an Annotator.
+func (a *Annotator) loadChains() error {
+	a.chains = make(map[string]*liftover.Chains)
+	for _, src := range a.Sources {
+		if src.Chain == "" || a.chains[src.Chain] != nil {
+			continue
+		}
+		c, err := liftover.Open(src.Chain)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %s", ErrSourceOpen, src.Chain, err)
+		}
+		a.chains[src.Chain] = c
+	}
+	return nil
+}
+
+// Unlifted indicates that v can not be lifted with the chain of at least one Source
+// and so will not be annotated from that Source. It is only valid after Setup.
+func (a *Annotator) Unlifted(v interfaces.Relatable) bool {
+	for _, c := range a.chains {
+		if _, ok := c.Lift(v.Chrom(), v.Start(), v.End()); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Unmapped gives the number of times that an annotation from a lifted Source was
+// skipped because it is not within a single block of the chain or could not be
+// mapped back to the query. An annotation is counted for each query that finds it.
+func (a *Annotator) Unmapped() int {
+	return int(atomic.LoadInt64(&a.unmapped))
+}
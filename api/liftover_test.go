@@ -0,0 +1,101 @@
+package api
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/fasta"
+	"github.com/brentp/vcfanno/liftover"
+	"github.com/brentp/vcfgo"
+)
+
+type variantBackend struct {
+	memBackend
+	vs []*parsers.Variant
+}
+
+func (b *variantBackend) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	it := &memIterator{}
+	for _, v := range b.vs {
+		if v.Chrom() == region.Chrom() && v.Start() < region.End() && region.Start() < v.End() {
+			it.ivs = append(it.ivs, v)
+		}
+	}
+	return it, nil
+}
+
+func TestUnliftMinus(t *testing.T) {
+	dir := t.TempDir()
+	// the annotations are on the reverse complement of the query and the two blocks of
+	// the chain meet at 50.
+	q := strings.Repeat("ACGTTGCAAG", 10)
+	for name, s := range map[string]string{"q.fa": ">1\n" + q + "\n", "rev.chain": "chain 1 1 100 + 0 100 1 100 - 0 100 2\n50 0 0\n50\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chains, err := liftover.Open(filepath.Join(dir, "rev.chain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := fasta.Open(filepath.Join(dir, "q.fa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Close()
+
+	h := vcfgo.NewHeader()
+	backend := &variantBackend{vs: []*parsers.Variant{
+		makeVariant("1", 49, "AAA", []string{"A"}, "span", "", h),
+		makeVariant("1", 61, "C", []string{"<DEL>"}, "sv_end", "END=71", h),
+		makeVariant("1", 61, "C", []string{"<DEL>"}, "sv_len", "SVLEN=-10", h),
+		makeVariant("1", 81, "C", []string{"T"}, "snp", "", h),
+		makeVariant("1", 85, "CA", []string{"C"}, "del_repeat", "", h),
+		makeVariant("1", 91, "C", []string{"CT"}, "ins_repeat", "", h),
+		makeVariant("1", 97, "AC", []string{"A"}, "del", "", h),
+	}}
+	// the same variants as in the query, left-aligned.
+	query := map[string]*parsers.Variant{
+		"sv_end":     makeVariant("1", 30, "G", []string{"<DEL>"}, "", "END=40", h),
+		"sv_len":     makeVariant("1", 30, "G", []string{"<DEL>"}, "", "SVLEN=-10", h),
+		"snp":        makeVariant("1", 20, "G", []string{"A"}, "", "", h),
+		"del_repeat": makeVariant("1", 13, "GT", []string{"G"}, "", "", h),
+		"ins_repeat": makeVariant("1", 7, "C", []string{"CA"}, "", "", h),
+		"del":        makeVariant("1", 2, "CG", []string{"C"}, "", "", h),
+	}
+
+	for _, tt := range []struct {
+		ref      *fasta.Reader
+		expected []string
+	}{
+		{ref, []string{"sv_end", "sv_len", "snp", "del_repeat", "ins_repeat", "del"}},
+		// without a reference, the base added to the left is N so indels in repeats differ.
+		{nil, []string{"snp", "del"}},
+	} {
+		var unmapped int64
+		l := liftBackend{SourceBackend: backend, chains: chains, ref: tt.ref, unmapped: &unmapped}
+		it, err := l.Query(parsers.NewInterval("1", 0, 100, nil, 0, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lifted := make(map[string]*vcfgo.Variant)
+		for r, err := it.Next(); err != io.EOF; r, err = it.Next() {
+			v := r.(interfaces.VarWrap).IVariant.(*vcfgo.Variant)
+			lifted[v.Id()] = v
+		}
+		if unmapped != 1 || lifted["span"] != nil {
+			t.Errorf("expected the variant across the blocks to be unmapped, got %d", unmapped)
+		}
+		for _, id := range tt.expected {
+			v, e := lifted[id], query[id]
+			if v == nil || v.Start() != e.Start() || v.End() != e.End() || !sameAllele(e, v) {
+				t.Errorf("%s: expected %s:%d %s/%s, got %v", id, e.Chrom(), e.Start()+1, e.Ref(), e.Alt(), v)
+			}
+		}
+	}
+}
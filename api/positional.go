@@ -0,0 +1,112 @@
+package api
+
+import (
+	"sort"
+
+	"github.com/brentp/irelate/interfaces"
+)
+
+// PositionReducer is like a Reducer but it also receives the query interval and the
+// position of the interval that each value came from so that it can account for
+// how much of the query each value covers.
+type PositionReducer func(query interfaces.IPosition, positions []interfaces.IPosition, vals []interface{}) interface{}
+
+// overlapLen gives the number of bases shared by a and b.
+func overlapLen(a, b interfaces.IPosition) int {
+	s, e := a.Start(), a.End()
+	if b.Start() > s {
+		s = b.Start()
+	}
+	if b.End() < e {
+		e = b.End()
+	}
+	if e <= s {
+		return 0
+	}
+	return int(e - s)
+}
+
+// weightedMean is the mean of the values weighted by the number of bases that each
+// interval overlaps the query.
+func weightedMean(query interfaces.IPosition, positions []interfaces.IPosition, vals []interface{}) interface{} {
+	s, w := 0.0, 0
+	for i, v := range vals {
+		n := overlapLen(query, positions[i])
+		f, _ := asfloat64(v)
+		s += f * float64(n)
+		w += n
+	}
+	if w == 0 {
+		return nil
+	}
+	return s / float64(w)
+}
+
+// bpCovered is the number of bases in the query that are covered by any interval.
+func bpCovered(query interfaces.IPosition, positions []interfaces.IPosition, vals []interface{}) interface{} {
+	type iv struct{ s, e uint32 }
+	ivs := make([]iv, 0, len(positions))
+	for _, p := range positions {
+		if overlapLen(query, p) == 0 {
+			continue
+		}
+		s, e := p.Start(), p.End()
+		if s < query.Start() {
+			s = query.Start()
+		}
+		if e > query.End() {
+			e = query.End()
+		}
+		ivs = append(ivs, iv{s, e})
+	}
+	sort.Slice(ivs, func(i, j int) bool { return ivs[i].s < ivs[j].s })
+	covered := 0
+	var last uint32
+	for i, v := range ivs {
+		if i == 0 || v.s > last {
+			covered += int(v.e - v.s)
+			last = v.e
+		} else if v.e > last {
+			covered += int(v.e - last)
+			last = v.e
+		}
+	}
+	return covered
+}
+
+// fracCovered is the proportion of the bases in the query that are covered by any interval.
+func fracCovered(query interfaces.IPosition, positions []interfaces.IPosition, vals []interface{}) interface{} {
+	l := query.End() - query.Start()
+	if l == 0 {
+		return nil
+	}
+	return float64(bpCovered(query, positions, vals).(int)) / float64(l)
+}
+
+// maxOverlapValue gives the value from the interval that overlaps the query by the
+// most bases. Ties go to the first interval.
+func maxOverlapValue(query interfaces.IPosition, positions []interfaces.IPosition, vals []interface{}) interface{} {
+	best, bestn := -1, 0
+	for i := range vals {
+		if n := overlapLen(query, positions[i]); n > bestn {
+			best, bestn = i, n
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	return vals[best]
+}
+
+func init() {
+	for name, r := range map[string]registered{
+		"weighted_mean":     {pfn: weightedMean, spec: Spec{OutType: "Float", Number: "1", Accepts: AcceptsNumber}},
+		"bp_covered":        {pfn: bpCovered, spec: Spec{OutType: "Integer", Number: "1"}},
+		"frac_covered":      {pfn: fracCovered, spec: Spec{OutType: "Float", Number: "1"}},
+		"max_overlap_value": {pfn: maxOverlapValue, spec: Spec{Number: "1"}},
+	} {
+		if err := register(name, r); err != nil {
+			panic(err)
+		}
+	}
+}
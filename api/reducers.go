@@ -2,7 +2,6 @@ package api
 
 import (
 	"fmt"
-	"log"
 	"math"
 	"reflect"
 	"strconv"
@@ -14,12 +13,28 @@ import (
 
 type Reducer func([]interface{}) interface{}
 
+// formatNumber applies format (see Annotator.FloatFormat) to floating-point values.
+// Other values are unchanged.
+func formatNumber(val interface{}, format string) interface{} {
+	if format == "" {
+		return val
+	}
+	switch v := val.(type) {
+	case float64:
+		return fmt.Sprintf(format, v)
+	case float32:
+		return fmt.Sprintf(format, v)
+	}
+	return val
+}
+
 func mean(vals []interface{}) interface{} {
-	s := float32(0.0)
+	s := 0.0
 	for _, v := range vals {
-		s += asfloat32(v)
+		f, _ := asfloat64(v)
+		s += f
 	}
-	return s / float32(len(vals))
+	return s / float64(len(vals))
 }
 
 func dp2(vals []interface{}) interface{} {
@@ -34,10 +49,21 @@ func dp2(vals []interface{}) interface{} {
 	return ret
 }
 
+// sum returns an int if all the values are integers and a float64 otherwise.
 func sum(vals []interface{}) interface{} {
-	s := float32(0.0)
+	s, is := 0.0, 0
+	allInt := true
 	for _, v := range vals {
-		s += asfloat32(v, sum)
+		f, isInt := asfloat64(v, sum)
+		s += f
+		if isInt {
+			is += int(f)
+		} else {
+			allInt = false
+		}
+	}
+	if allInt && len(vals) > 0 {
+		return is
 	}
 	return s
 }
@@ -59,73 +85,75 @@ func div2(vals []interface{}) interface{} {
 	if vals[0] == 0 || vals[1] == 0 {
 		return 0
 	}
-	return asfloat32(vals[0]) / asfloat32(vals[1])
+	a, _ := asfloat64(vals[0])
+	b, _ := asfloat64(vals[1])
+	return a / b
 }
 
+// max returns an int if all the values are integers and a float64 otherwise.
 func max(vals []interface{}) interface{} {
-	imax := float32(-math.MaxFloat32)
+	imax := -math.MaxFloat64
+	allInt := true
 	for _, v := range vals {
-		vv := asfloat32(v, max)
+		vv, isInt := asfloat64(v, max)
+		allInt = allInt && isInt
 		if vv > imax {
 			imax = vv
 		}
 	}
+	if allInt && len(vals) > 0 {
+		return int(imax)
+	}
 	return imax
 }
 
-// asfloat32 returns a float32 from a single value. If there is
-// more than 1 value then it calls reducer_func(vals).
-func asfloat32(i interface{}, reducer_func ...Reducer) float32 {
-	l_arr := -1
-	switch i.(type) {
+// asfloat64 returns a float64 from a single value and indicates if that value
+// was an integer. If there is more than 1 value then it calls reducer_func(vals).
+func asfloat64(i interface{}, reducer_func ...Reducer) (float64, bool) {
+	switch v := i.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
 	case uint32:
-		return float32(i.(uint32))
+		return float64(v), true
 	case uint64:
-		return float32(i.(uint64))
-	case int:
-		return float32(i.(int))
+		return float64(v), true
 	case float32:
-		return i.(float32)
+		return float64(v), false
 	case float64:
-		return float32(i.(float64))
+		return v, false
 	case string:
-		f, err := strconv.ParseFloat(i.(string), 32)
-		if err != nil {
-			return float32(0)
-		}
-		return float32(f)
-	case []int:
-		v := i.([]int)
-		if len(v) == 1 {
-			return asfloat32(v[0])
+		if n, err := strconv.Atoi(v); err == nil {
+			return float64(n), true
 		}
-		l_arr = len(v)
-	case []string:
-		v := i.([]string)
-		if len(v) == 1 {
-			return asfloat32(v[0])
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
 		}
-		l_arr = len(v)
-	case []float32:
-		v := i.([]float32)
-		if len(v) == 1 {
-			return v[0]
+		return f, false
+	case []int, []float32, []float64, []string, []interface{}:
+		s := to_interface_slice(v)
+		if len(s) == 1 {
+			return asfloat64(s[0])
 		}
-		l_arr = len(v)
-		if l_arr == 2 && len(reducer_func) == 1 {
-			fn := reducer_func[0]
-			return fn([]interface{}{v[0], v[1]}).(float32)
+		if len(s) > 1 && len(reducer_func) == 1 {
+			return asfloat64(reducer_func[0](s))
 		}
-
 	}
 
-	if l_arr > 0 && len(reducer_func) == 1 {
-		fn := reducer_func[0]
-		return fn(to_interface_slice(i)).(float32)
-	}
+	// this is recovered and returned as an error by reduce.
+	panic(fmt.Errorf("%w: asfloat64('%+v'). This usually means you have multiple alts and need to decompose or call max() or min()", ErrMultiValue, i))
+}
 
-	log.Fatalf("FATAL: tried to call asfloat32('%+v'). This usually means you have multiple alts and need to decompose or call max() or min() ", i)
-	return i.(float32)
+// parseNumber parses s as an int if possible and as a float64 otherwise.
+func parseNumber(s string) (interface{}, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	return strconv.ParseFloat(s, 64)
 }
 
 func to_interface_slice(a interface{}) []interface{} {
@@ -141,14 +169,20 @@ func to_interface_slice(a interface{}) []interface{} {
 	return b
 }
 
+// min returns an int if all the values are integers and a float64 otherwise.
 func min(vals []interface{}) interface{} {
-	imin := float32(math.MaxFloat32)
+	imin := math.MaxFloat64
+	allInt := true
 	for _, v := range vals {
-		vv := asfloat32(v, min)
+		vv, isInt := asfloat64(v, min)
+		allInt = allInt && isInt
 		if vv < imin {
 			imin = vv
 		}
 	}
+	if allInt && len(vals) > 0 {
+		return int(imin)
+	}
 	return imin
 }
 
@@ -208,10 +242,10 @@ func _strings(vals []interface{}, uniq bool) []string {
 	return s
 }
 
-// delete is not used but we need it for a place-holder.
-func delete(vals []interface{}) interface{} {
+// vdelete is not used but we need it for a place-holder. named vdelete because of
+// conflict with builtin.
+func vdelete(vals []interface{}) interface{} {
 	panic("do not use")
-	return nil
 }
 
 func uniq(vals []interface{}) interface{} {
@@ -257,20 +291,26 @@ func overlap(a, b interfaces.IPosition) bool {
 	return b.Start() < a.End() && a.Start() < b.End()
 }
 
-var Reducers = map[string]Reducer{
-	"self":   Reducer(self),
-	"concat": Reducer(concat),
-	"count":  Reducer(count),
-	"delete": Reducer(delete),
-	"mean":   Reducer(mean),
-	"sum":    Reducer(sum),
-	"max":    Reducer(max),
-	"min":    Reducer(min),
-	"uniq":   Reducer(uniq),
-	"first":  Reducer(first),
-	"flag":   Reducer(vflag),
-	"div2":   Reducer(div2),
-	"DP2":    Reducer(dp2),
-	"setid":  Reducer(setid),
-	"by_alt": Reducer(concat),
+func init() {
+	number := Spec{OutType: "Float", Number: "1", Accepts: AcceptsNumber}
+	keepInt := Spec{OutType: "Float", Number: "1", Accepts: AcceptsNumber, KeepInteger: true}
+	str := Spec{OutType: "String", Number: "."}
+
+	// for self and first, the Type and Number come from the annotation.
+	mustRegister("self", self, Spec{})
+	mustRegister("first", first, Spec{})
+	mustRegister("concat", concat, str)
+	mustRegister("uniq", uniq, str)
+	mustRegister("count", count, Spec{OutType: "Integer", Number: "1"})
+	mustRegister("mean", mean, number)
+	mustRegister("sum", sum, keepInt)
+	mustRegister("max", max, keepInt)
+	mustRegister("min", min, keepInt)
+	mustRegister("flag", vflag, Spec{OutType: "Flag", Number: "0"})
+	mustRegister("div2", div2, Spec{OutType: "Float", Number: ".", Accepts: AcceptsNumber})
+	mustRegister("DP2", dp2, Spec{OutType: "Integer", Number: "2"})
+	mustRegister("by_alt", concat, Spec{OutType: "String", Number: "A"})
+	// postannotation only.
+	mustRegister("delete", vdelete, str)
+	mustRegister("setid", setid, str)
 }
@@ -45,10 +45,10 @@ func (s *ReducerSuite) TestFloats(c *C) {
 	c.Assert(f, Equals, s.floats[0])
 
 	m := min(s.floats)
-	c.Assert(m.(float32), Equals, float32(1.3))
+	c.Assert(m, Equals, 1.3)
 
 	m = max(s.floats)
-	c.Assert(m, Equals, float32(7.7))
+	c.Assert(m, Equals, 7.7)
 
 	cc := concat(s.floats)
 	c.Assert(cc, Equals, "1.3,2.3,3.3,4.4,5.5,6.6,7.7")
@@ -67,7 +67,7 @@ func (s *ReducerSuite) TestFloat(c *C) {
 	c.Assert(f, Equals, s.one_float[0])
 
 	m := min(s.one_float)
-	c.Assert(float64(m.(float32))-s.one_float[0].(float64) < float64(0.0001), Equals, true)
+	c.Assert(m, Equals, s.one_float[0])
 
 	m = max(s.one_float)
 	//c.Assert(float64(m.(float32)), Equals, s.one_float[0].(float64))
@@ -80,6 +80,31 @@ func (s *ReducerSuite) TestInts(c *C) {
 	cnt := count(s.ints)
 	c.Assert(cnt, Equals, 7)
 
+	// integers stay integers.
+	c.Assert(sum(s.ints), Equals, 28)
+	c.Assert(max(s.ints), Equals, 7)
+	c.Assert(min(s.ints), Equals, 1)
+	c.Assert(mean(s.ints), Equals, 4.0)
+
+	// multi-valued integers are reduced with the same op.
+	c.Assert(sum([]interface{}{[]int{1, 2}, 3}), Equals, 6)
+	c.Assert(max([]interface{}{[]int{1, 9}, 3}), Equals, 9)
+
+	// ints mixed with floats give a float.
+	c.Assert(sum([]interface{}{1, 2.5}), Equals, 3.5)
+}
+
+func (s *ReducerSuite) TestPrecision(c *C) {
+	// float32 can not represent this.
+	c.Assert(sum([]interface{}{16777216, 1}), Equals, 16777217)
+	c.Assert(sum([]interface{}{16777216.0, 1.0}), Equals, 16777217.0)
+	c.Assert(min([]interface{}{1e-9, 2e-9}), Equals, 1e-9)
+}
+
+func (s *ReducerSuite) TestFormatNumber(c *C) {
+	c.Assert(formatNumber(0.123456789, ""), Equals, 0.123456789)
+	c.Assert(formatNumber(0.123456789, "%.3g"), Equals, "0.123")
+	c.Assert(formatNumber(12, "%.3g"), Equals, 12)
 }
 
 func (s *ReducerSuite) TestStrings(c *C) {
@@ -92,3 +117,98 @@ func (s *ReducerSuite) TestStrings(c *C) {
 	n := vflag([]interface{}{})
 	c.Assert(n, Equals, false)
 }
+
+func (s *ReducerSuite) TestStats(c *C) {
+	c.Assert(median(s.ints), Equals, 4.0)
+	c.Assert(median([]interface{}{1, 2, 3, 4}), Equals, 2.5)
+	p10, _, _ := LookupReducer("p10")
+	p50, _, _ := LookupReducer("p50")
+	p90, _, _ := LookupReducer("p90")
+	c.Assert(p10(s.ints), Equals, 1.6)
+	c.Assert(p90(s.ints), Equals, 6.4)
+	c.Assert(p50(s.ints), Equals, median(s.ints))
+	c.Assert(median(s.one_float), Equals, 33.33)
+	c.Assert(median([]interface{}{}), IsNil)
+	// multi-valued inputs are flattened.
+	c.Assert(median([]interface{}{[]int{1, 2}, 9}), Equals, 2.0)
+
+	c.Assert(variance(s.ints), Equals, 4.0)
+	c.Assert(stdev(s.ints), Equals, 2.0)
+	c.Assert(stdev(s.one_int), Equals, 0.0)
+
+	_, ok := ReducerSpec("p100")
+	c.Assert(ok, Equals, false)
+	_, ok = ReducerSpec("p05")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *ReducerSuite) TestStringStats(c *C) {
+	vals := []interface{}{"exon", "intron", "exon", []string{"utr", "exon"}}
+	c.Assert(mode(vals), Equals, "exon")
+	c.Assert(mode([]interface{}{"b", "a"}), Equals, "b")
+	c.Assert(countUniq(vals), Equals, 3)
+	c.Assert(hist(vals), Equals, "exon:3,intron:1,utr:1")
+	c.Assert(hist([]interface{}{1, 1, 2}), Equals, "1:2,2:1")
+	c.Assert(mode(s.empty), IsNil)
+	c.Assert(countUniq(s.empty), Equals, 0)
+}
+
+func (s *ReducerSuite) TestRegistry(c *C) {
+	spec := Spec{OutType: "Integer", Number: "1", Accepts: AcceptsNumber}
+	c.Assert(RegisterReducer("test_double_first", func(vals []interface{}) interface{} {
+		f, _ := asfloat64(vals[0])
+		return int(2 * f)
+	}, spec), IsNil)
+	fn, got, ok := LookupReducer("test_double_first")
+	c.Assert(ok, Equals, true)
+	c.Assert(got, Equals, spec)
+	c.Assert(fn(s.ints), Equals, 2)
+
+	// can't register an op twice or with a bad type.
+	c.Assert(RegisterReducer("test_double_first", first, spec), NotNil)
+	c.Assert(RegisterReducer("mean", first, spec), NotNil)
+	c.Assert(RegisterReducer("test_bad_type", first, Spec{OutType: "Number"}), NotNil)
+	c.Assert(RegisterReducer("lua:x", first, spec), NotNil)
+
+	// position reducers are separate.
+	_, _, ok = LookupReducer("weighted_mean")
+	c.Assert(ok, Equals, false)
+	_, _, ok = LookupPositionReducer("weighted_mean")
+	c.Assert(ok, Equals, true)
+
+	src := Source{Op: "test_double_first"}
+	c.Assert(src.IsNumber(), Equals, true)
+
+	// ops added to the deprecated map are used with an empty Spec.
+	c.Assert(Reducers["mean"], NotNil)
+	Reducers["test_legacy"] = first
+	defer delete(Reducers, "test_legacy")
+	_, got, ok = LookupReducer("test_legacy")
+	c.Assert(ok, Equals, true)
+	c.Assert(got, Equals, Spec{})
+
+	// replacing a built-in op in the map overrides it but keeps its Spec.
+	builtin := Reducers["mean"]
+	Reducers["mean"] = first
+	defer func() { Reducers["mean"] = builtin }()
+	fn, got, ok = LookupReducer("mean")
+	c.Assert(ok, Equals, true)
+	c.Assert(fn([]interface{}{1, 3}), Equals, 1)
+	c.Assert(got.OutType, Equals, "Float")
+}
+
+func (s *ReducerSuite) TestSpecHeaderType(c *C) {
+	keepInt, _ := ReducerSpec("sum")
+	t, n := keepInt.headerType("Integer", "A")
+	c.Assert(t+n, Equals, "Integer1")
+	t, n = keepInt.headerType("Float", "1")
+	c.Assert(t+n, Equals, "Float1")
+
+	self, _ := ReducerSpec("self")
+	t, n = self.headerType("", "1")
+	c.Assert(t+n, Equals, "String1")
+
+	mode, _ := ReducerSpec("mode")
+	t, n = mode.headerType("Flag", "0")
+	c.Assert(t+n, Equals, "String1")
+}
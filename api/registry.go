@@ -0,0 +1,159 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Accepts indicates which input values a Reducer can handle.
+type Accepts uint8
+
+const (
+	// AcceptsAny is for ops that work on strings or numbers (e.g. concat, first).
+	AcceptsAny Accepts = iota
+	// AcceptsNumber is for ops that need numbers (e.g. mean, sum). Values from
+	// BED columns are parsed as numbers for these ops.
+	AcceptsNumber
+)
+
+// Spec describes the output of a Reducer so that the header of the annotated file can
+// be set and the inputs can be checked without special-casing each op by name.
+type Spec struct {
+	// OutType is the VCF Type of the output: Integer, Float, String or Flag.
+	// If empty, the Type of the annotation field is used (or String if that is unknown).
+	OutType string
+	// Number is the VCF Number of the output. If empty, the Number of the annotation field is used.
+	Number string
+	// Accepts indicates which input values the op can handle.
+	Accepts Accepts
+	// KeepInteger indicates that the output is an Integer when the annotation field is an Integer.
+	KeepInteger bool
+}
+
+// headerType gives the VCF Type and Number of the output of an op with this Spec given
+// the Type and Number of the annotation field (either of which may be empty).
+func (spec Spec) headerType(htype string, number string) (string, string) {
+	ntype := spec.OutType
+	if spec.KeepInteger && htype == "Integer" {
+		ntype = "Integer"
+	}
+	if ntype == "" {
+		ntype = "String"
+		if htype != "" && htype != "Flag" {
+			ntype = htype
+		}
+	}
+	if spec.Number != "" {
+		number = spec.Number
+	}
+	return ntype, number
+}
+
+type registered struct {
+	fn   Reducer
+	pfn  PositionReducer
+	spec Spec
+}
+
+// Reducers holds the built-in Reducers by the name of their op.
+//
+// Deprecated: use RegisterReducer and LookupReducer, which also give the Spec of an op.
+// A Reducer added to this map under a new name is used as an op with an empty Spec (so
+// its output Type and Number are from the annotation). A Reducer that replaces a
+// built-in op in the map is used instead of it with the Spec of the built-in op. The map
+// must not be changed while annotating.
+var Reducers = map[string]Reducer{}
+
+var registry = struct {
+	sync.RWMutex
+	ops map[string]registered
+}{ops: make(map[string]registered, 128)}
+
+func register(name string, r registered) error {
+	if name == "" || strings.HasPrefix(name, "lua:") {
+		return fmt.Errorf("invalid name for op: '%s'", name)
+	}
+	switch r.spec.OutType {
+	case "", "Integer", "Float", "String", "Flag":
+	default:
+		return fmt.Errorf("invalid OutType for op %s: %s", name, r.spec.OutType)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.ops[name]; ok {
+		return fmt.Errorf("op already registered: %s", name)
+	}
+	registry.ops[name] = r
+	return nil
+}
+
+// RegisterReducer makes a Reducer available as an op with the given name.
+// It is safe to call concurrently and returns an error if the name is already used.
+func RegisterReducer(name string, fn Reducer, spec Spec) error {
+	if fn == nil {
+		return fmt.Errorf("nil Reducer for op: %s", name)
+	}
+	return register(name, registered{fn: fn, spec: spec})
+}
+
+// RegisterPositionReducer makes a PositionReducer available as an op with the given name.
+// It is safe to call concurrently and returns an error if the name is already used.
+func RegisterPositionReducer(name string, fn PositionReducer, spec Spec) error {
+	if fn == nil {
+		return fmt.Errorf("nil PositionReducer for op: %s", name)
+	}
+	return register(name, registered{pfn: fn, spec: spec})
+}
+
+// mustRegister registers a built-in op and adds it to Reducers.
+func mustRegister(name string, fn Reducer, spec Spec) {
+	if err := RegisterReducer(name, fn, spec); err != nil {
+		panic(err)
+	}
+	Reducers[name] = fn
+}
+
+// lookup gives the registered op with name unless it was added to or replaced in
+// Reducers.
+func lookup(name string) (registered, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	r, ok := registry.ops[name]
+	if fn := Reducers[name]; fn != nil && (!ok || r.fn == nil || funcPointer(fn) != funcPointer(r.fn)) {
+		return registered{fn: fn, spec: r.spec}, true
+	}
+	return r, ok
+}
+
+// funcPointer gives the code pointer of fn so that a Reducer replaced in Reducers can be
+// detected.
+func funcPointer(fn Reducer) uintptr {
+	return reflect.ValueOf(fn).Pointer()
+}
+
+// LookupReducer returns the Reducer and Spec registered with name.
+// It returns false if there is no such op or if it is a PositionReducer.
+func LookupReducer(name string) (Reducer, Spec, bool) {
+	r, ok := lookup(name)
+	if !ok || r.fn == nil {
+		return nil, Spec{}, false
+	}
+	return r.fn, r.spec, true
+}
+
+// LookupPositionReducer returns the PositionReducer and Spec registered with name.
+func LookupPositionReducer(name string) (PositionReducer, Spec, bool) {
+	r, ok := lookup(name)
+	if !ok || r.pfn == nil {
+		return nil, Spec{}, false
+	}
+	return r.pfn, r.spec, true
+}
+
+// ReducerSpec returns the Spec for any registered op.
+func ReducerSpec(name string) (Spec, bool) {
+	r, ok := lookup(name)
+	return r.spec, ok
+}
@@ -51,7 +51,9 @@ func (s *RegrSuite) SetUpTest(c *C) {
 	s.v1.AddRelated(s.v2)
 
 	empty := make([]PostAnnotation, 0)
-	s.annotator = NewAnnotator([]*Source{&s.src_disease, &s.src_pmids}, "", true, false, empty)
+	var err error
+	s.annotator, err = NewAnnotator([]*Source{&s.src_disease, &s.src_pmids}, "", true, false, empty)
+	c.Assert(err, IsNil)
 
 }
 
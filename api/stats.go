@@ -0,0 +1,144 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/brentp/vcfgo"
+)
+
+// flatten expands any multi-valued (slice) values so that each value is counted
+// separately by the statistical ops.
+func flatten(vals []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(vals))
+	for _, v := range vals {
+		switch v.(type) {
+		case nil:
+			continue
+		case []int, []float32, []float64, []string, []interface{}:
+			out = append(out, flatten(to_interface_slice(v))...)
+		default:
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// sortedFloats returns the (flattened) vals as sorted float64s.
+func sortedFloats(vals []interface{}) []float64 {
+	flat := flatten(vals)
+	fs := make([]float64, len(flat))
+	for i, v := range flat {
+		fs[i], _ = asfloat64(v)
+	}
+	sort.Float64s(fs)
+	return fs
+}
+
+// quantile returns a Reducer that gives the q'th (0 <= q <= 1) quantile of the
+// values using linear interpolation between the closest ranks.
+func quantile(q float64) Reducer {
+	return func(vals []interface{}) interface{} {
+		fs := sortedFloats(vals)
+		if len(fs) == 0 {
+			return nil
+		}
+		h := q * float64(len(fs)-1)
+		lo := int(math.Floor(h))
+		if lo+1 >= len(fs) {
+			return fs[lo]
+		}
+		return fs[lo] + (h-float64(lo))*(fs[lo+1]-fs[lo])
+	}
+}
+
+var median = quantile(0.5)
+
+// variance is the population variance of the values.
+func variance(vals []interface{}) interface{} {
+	fs := sortedFloats(vals)
+	if len(fs) == 0 {
+		return nil
+	}
+	m := 0.0
+	for _, f := range fs {
+		m += f
+	}
+	m /= float64(len(fs))
+	v := 0.0
+	for _, f := range fs {
+		v += (f - m) * (f - m)
+	}
+	return v / float64(len(fs))
+}
+
+// stdev is the population standard deviation of the values.
+func stdev(vals []interface{}) interface{} {
+	v := variance(vals)
+	if v == nil {
+		return nil
+	}
+	return math.Sqrt(v.(float64))
+}
+
+// counts returns the string value of each of the (flattened) values in the
+// order they were first seen along with the number of times each was seen.
+func counts(vals []interface{}) ([]string, map[string]int) {
+	keys := make([]string, 0, len(vals))
+	m := make(map[string]int, len(vals))
+	for _, v := range flatten(vals) {
+		k := vcfgo.ItoS("", v)
+		if _, ok := m[k]; !ok {
+			keys = append(keys, k)
+		}
+		m[k]++
+	}
+	return keys, m
+}
+
+// mode gives the most common value. Ties go to the value seen first.
+func mode(vals []interface{}) interface{} {
+	keys, m := counts(vals)
+	if len(keys) == 0 {
+		return nil
+	}
+	best := keys[0]
+	for _, k := range keys[1:] {
+		if m[k] > m[best] {
+			best = k
+		}
+	}
+	return best
+}
+
+func countUniq(vals []interface{}) interface{} {
+	keys, _ := counts(vals)
+	return len(keys)
+}
+
+// hist gives value:count pairs in the order the values were first seen, e.g.:
+// "exon:3,intron:1"
+func hist(vals []interface{}) interface{} {
+	keys, m := counts(vals)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s:%d", k, m[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func init() {
+	number := Spec{OutType: "Float", Number: "1", Accepts: AcceptsNumber}
+	mustRegister("median", median, number)
+	mustRegister("stdev", stdev, number)
+	mustRegister("variance", variance, number)
+	for p := 1; p < 100; p++ {
+		mustRegister(fmt.Sprintf("p%d", p), quantile(float64(p)/100), number)
+	}
+	// mode keeps the Type of the annotation.
+	mustRegister("mode", mode, Spec{Number: "1"})
+	mustRegister("count_uniq", countUniq, Spec{OutType: "Integer", Number: "1"})
+	mustRegister("hist", hist, Spec{OutType: "String", Number: "."})
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"io"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+)
+
+// summaryBackend streams a Summarizer as one summaryRegion for each region of the query
+// so that the state of the Setup that opened it is related to each variant.
+type summaryBackend struct {
+	SourceBackend
+	s Summarizer
+}
+
+func (b summaryBackend) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	r := &summaryRegion{Interval: parsers.NewInterval(region.Chrom(), region.Start(), region.End(), nil, 0, nil), s: b.s}
+	return &sliceIterator{r}, nil
+}
+
+// summaryRegion is related to each variant in a region of the query. The variant is
+// annotated with the records from Summary for its own region.
+type summaryRegion struct {
+	*parsers.Interval
+	s Summarizer
+}
+
+// summarized gives the records for v from the Summarizer of the summaryRegions in rels
+// (which all have the same one) or rels if there are none.
+func summarized(v interfaces.Relatable, rels []interfaces.Relatable) ([]interfaces.Relatable, error) {
+	if len(rels) == 0 {
+		return rels, nil
+	}
+	sr, ok := rels[0].(*summaryRegion)
+	if !ok {
+		return rels, nil
+	}
+	it, err := sr.s.Summary(v)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var out []interfaces.Relatable
+	for {
+		r, err := it.Next()
+		if r != nil {
+			r.SetSource(sr.Source())
+			out = append(out, r)
+		}
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/vcfanno/fasta"
+)
+
+// VariantSource computes the annotations of each query variant (e.g. from gene models or
+// the reference) rather than reading those that overlap it so it is not queried by
+// position. It may implement ContigLister so that its contigs are checked against the
+// query and FieldSelector to check the fields of its Sources.
+type VariantSource interface {
+	// Value gives the value of field for v or nil if there is none.
+	Value(field string, v interfaces.IVariant) (interface{}, error)
+	// Header gives the VCF Type, Number and Description of field. Type is empty if
+	// field is not known.
+	Header(field string) (htype string, number string, desc string)
+}
+
+// VariantSourceOpener opens the VariantSource at path (the File after the prefix, which
+// may be empty, e.g. for "fasta:"). ref is the reference given by the Fasta of the
+// Source or nil if there is none.
+type VariantSourceOpener func(path string, ref *fasta.Reader) (VariantSource, error)
+
+var variantSources = struct {
+	sync.RWMutex
+	prefixes map[string]VariantSourceOpener
+}{prefixes: make(map[string]VariantSourceOpener)}
+
+// RegisterVariantSource makes a VariantSource available for files starting with prefix,
+// which must end in ":" (e.g. "consequence:").
+func RegisterVariantSource(prefix string, open VariantSourceOpener) error {
+	if !strings.HasSuffix(prefix, ":") || strings.Contains(prefix, "/") || open == nil {
+		return fmt.Errorf("invalid variant source: '%s'", prefix)
+	}
+	variantSources.Lock()
+	defer variantSources.Unlock()
+	if _, ok := variantSources.prefixes[prefix]; ok {
+		return fmt.Errorf("variant source already registered: %s", prefix)
+	}
+	variantSources.prefixes[prefix] = open
+	return nil
+}
+
+// variantSourcePrefix gives the registered prefix of file or "".
+func variantSourcePrefix(file string) string {
+	i := strings.IndexByte(file, ':')
+	if i == -1 {
+		return ""
+	}
+	variantSources.RLock()
+	defer variantSources.RUnlock()
+	if _, ok := variantSources.prefixes[file[:i+1]]; ok {
+		return file[:i+1]
+	}
+	return ""
+}
+
+// IsVariantSource indicates that file starts with the prefix of a registered
+// VariantSource (e.g. "fasta:") so it is not a file that is queried.
+func IsVariantSource(file string) bool {
+	return variantSourcePrefix(file) != ""
+}
+
+// variantSourceKey identifies the VariantSource of a Source.
+func (s *Source) variantSourceKey() string {
+	return s.File + "\x00" + s.Fasta
+}
+
+// setupVariantSources opens the VariantSource of each Source with one. It is called once
+// for an Annotator after the FASTAs are opened.
+func (a *Annotator) setupVariantSources() error {
+	for _, src := range a.Sources {
+		prefix := variantSourcePrefix(src.File)
+		if prefix == "" || a.variantSources[src.variantSourceKey()] != nil {
+			continue
+		}
+		variantSources.RLock()
+		open := variantSources.prefixes[prefix]
+		variantSources.RUnlock()
+		var ref *fasta.Reader
+		if src.Fasta != "" {
+			ref = a.fastas[src.Fasta]
+		}
+		vs, err := open(src.File[len(prefix):], ref)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %s", ErrSourceOpen, src.File, err)
+		}
+		if fs, ok := vs.(FieldSelector); ok {
+			var fields []string
+			for _, other := range a.Sources {
+				if other.variantSourceKey() == src.variantSourceKey() {
+					fields = append(fields, other.Field)
+				}
+			}
+			if err := fs.SelectFields(fields); err != nil {
+				return fmt.Errorf("%w: %s for %s", ErrConfig, err, src.File)
+			}
+		}
+		if a.variantSources == nil {
+			a.variantSources = make(map[string]VariantSource)
+		}
+		a.variantSources[src.variantSourceKey()] = vs
+	}
+	return nil
+}
+
+// annotateVariantSources annotates v with each Source from a VariantSource.
+func (a *Annotator) annotateVariantSources(v interfaces.IVariant) error {
+	var e error
+	for _, src := range a.Sources {
+		if !IsVariantSource(src.File) {
+			continue
+		}
+		val, err := a.variantSources[src.variantSourceKey()].Value(src.Field, v)
+		if err == nil && val != nil {
+			err = src.annotate(v, []interface{}{val}, "", a.FloatFormat)
+		}
+		if err != nil {
+			e = &VariantError{Chrom: v.Chrom(), Pos: int(v.Start()) + 1, Name: src.Name, Err: err}
+			if IsFatal(err) {
+				return e
+			}
+		}
+	}
+	return e
+}
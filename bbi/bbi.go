@@ -0,0 +1,330 @@
+// Package bbi provides annotations from bigWig and bigBed files. Importing the package
+// registers it as a source for files ending in ".bw", ".bigWig", ".bigwig", ".bb",
+// ".bigBed" and ".bigbed".
+//
+// Each record is used like a BED interval with columns chrom, start, end and then the
+// value of a bigWig or the other columns of a bigBed. With fields, the columns after the
+// end are those fields in order. The fields of a bigWig are value, min and max, which
+// are the same for a base-level record. The fields of a bigBed are the names from its
+// autoSql (e.g. name, score and strand).
+//
+// A bigWig is queried for the region of each variant (see api.Summarizer). For a variant
+// longer than SummaryBins times the resolution of a zoom level, the records are the
+// summaries from the coarsest such zoom level, where value is the mean over the bases
+// with data. So a large SV is annotated from at least SummaryBins records rather than
+// from every base. A bigBed is read like a tabix-indexed BED as its zoom levels only give
+// its coverage.
+package bbi
+
+import (
+	"bytes"
+	"compress/zlib"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/brentp/vcfanno/api"
+)
+
+// Suffixes are the endings of the files that are opened as bigWig or bigBed.
+var Suffixes = []string{".bw", ".bigWig", ".bigwig", ".bb", ".bigBed", ".bigbed"}
+
+// IsBBI indicates that path is a bigWig or bigBed file.
+func IsBBI(path string) bool {
+	for _, s := range Suffixes {
+		if strings.HasSuffix(path, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SummaryBins is the least number of zoom records that summarize a variant.
+const SummaryBins = 100
+
+const (
+	bigWigMagic    = 0x888FFC26
+	bigBedMagic    = 0x8789F2EB
+	chromTreeMagic = 0x78CA8C91
+	rTreeMagic     = 0x2468ACE0
+)
+
+// cacheSize is the number of uncompressed blocks kept in memory.
+const cacheSize = 64
+
+type header struct {
+	Magic             uint32
+	Version           uint16
+	ZoomLevels        uint16
+	ChromTreeOffset   uint64
+	FullDataOffset    uint64
+	FullIndexOffset   uint64
+	FieldCount        uint16
+	DefinedFieldCount uint16
+	AutoSQLOffset     uint64
+	TotalSummary      uint64
+	UncompressBufSize uint32
+	ExtensionOffset   uint64
+}
+
+type zoomHeader struct {
+	ReductionLevel uint32
+	Reserved       uint32
+	DataOffset     uint64
+	IndexOffset    uint64
+}
+
+// block is the location of a block of data from an R tree.
+type block struct {
+	offset, size uint64
+}
+
+// file is the part of a bigWig and bigBed that is common to both.
+type file struct {
+	f     *os.File
+	path  string
+	order binary.ByteOrder
+	hdr   header
+	zooms []zoomHeader
+	// chroms gives the id of each contig and names and sizes are by id.
+	chroms map[string]uint32
+	names  []string
+	sizes  []uint32
+
+	mu     sync.Mutex
+	lru    *list.List
+	blocks map[uint64]*list.Element
+}
+
+type cached struct {
+	offset uint64
+	data   []byte
+}
+
+func openFile(path string) (*file, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &file{f: f, path: path, lru: list.New(), blocks: make(map[uint64]*list.Element)}
+	if err := b.readHeader(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+func (b *file) Close() error {
+	return b.f.Close()
+}
+
+func (b *file) read(off uint64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := b.f.ReadAt(buf, int64(off)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (b *file) readHeader() error {
+	buf, err := b.read(0, 64)
+	if err != nil {
+		return fmt.Errorf("not a bigWig or bigBed: %w", err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(buf) == bigWigMagic || binary.LittleEndian.Uint32(buf) == bigBedMagic:
+		b.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(buf) == bigWigMagic || binary.BigEndian.Uint32(buf) == bigBedMagic:
+		b.order = binary.BigEndian
+	default:
+		return fmt.Errorf("not a bigWig or bigBed")
+	}
+	if err := binary.Read(bytes.NewReader(buf), b.order, &b.hdr); err != nil {
+		return err
+	}
+	if b.hdr.ZoomLevels > 0 {
+		buf, err := b.read(64, 24*int(b.hdr.ZoomLevels))
+		if err != nil {
+			return err
+		}
+		b.zooms = make([]zoomHeader, b.hdr.ZoomLevels)
+		if err := binary.Read(bytes.NewReader(buf), b.order, b.zooms); err != nil {
+			return err
+		}
+	}
+	return b.readChroms()
+}
+
+// readChroms reads the B+ tree of contig names.
+func (b *file) readChroms() error {
+	buf, err := b.read(b.hdr.ChromTreeOffset, 32)
+	if err != nil {
+		return err
+	}
+	if b.order.Uint32(buf) != chromTreeMagic {
+		return fmt.Errorf("bad contig tree")
+	}
+	keySize := int(b.order.Uint32(buf[8:]))
+	n := b.order.Uint64(buf[16:])
+	b.chroms = make(map[string]uint32, n)
+	b.names, b.sizes = make([]string, n), make([]uint32, n)
+	var walk func(off uint64) error
+	walk = func(off uint64) error {
+		head, err := b.read(off, 4)
+		if err != nil {
+			return err
+		}
+		leaf, count := head[0] == 1, int(b.order.Uint16(head[2:]))
+		items, err := b.read(off+4, count*(keySize+8))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			item := items[i*(keySize+8):]
+			if !leaf {
+				if err := walk(b.order.Uint64(item[keySize:])); err != nil {
+					return err
+				}
+				continue
+			}
+			name := string(bytes.TrimRight(item[:keySize], "\x00"))
+			id := b.order.Uint32(item[keySize:])
+			if uint64(id) >= n {
+				return fmt.Errorf("bad contig id %d for %s", id, name)
+			}
+			b.chroms[name], b.names[id], b.sizes[id] = id, name, b.order.Uint32(item[keySize+4:])
+		}
+		return nil
+	}
+	return walk(b.hdr.ChromTreeOffset + 32)
+}
+
+// Contigs gives the contigs in the order of their ids.
+func (b *file) Contigs() []api.Contig {
+	contigs := make([]api.Contig, len(b.names))
+	for i, n := range b.names {
+		contigs[i] = api.Contig{Name: n, Length: int(b.sizes[i])}
+	}
+	return contigs
+}
+
+// chromID gives the id of chrom, with or without a "chr" prefix.
+func (b *file) chromID(chrom string) (uint32, bool) {
+	if id, ok := b.chroms[chrom]; ok {
+		return id, true
+	}
+	if strings.HasPrefix(chrom, "chr") {
+		id, ok := b.chroms[chrom[3:]]
+		return id, ok
+	}
+	id, ok := b.chroms["chr"+chrom]
+	return id, ok
+}
+
+// search gives the blocks in the R tree at off that overlap [start, end) on chrom id.
+func (b *file) search(off uint64, id, start, end uint32) ([]block, error) {
+	buf, err := b.read(off, 48)
+	if err != nil {
+		return nil, err
+	}
+	if b.order.Uint32(buf) != rTreeMagic {
+		return nil, fmt.Errorf("bad R tree at %d", off)
+	}
+	var blocks []block
+	var walk func(off uint64) error
+	walk = func(off uint64) error {
+		head, err := b.read(off, 4)
+		if err != nil {
+			return err
+		}
+		leaf, count := head[0] == 1, int(b.order.Uint16(head[2:]))
+		size := 24
+		if leaf {
+			size = 32
+		}
+		items, err := b.read(off+4, count*size)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			item := items[i*size:]
+			sc, sb := b.order.Uint32(item), b.order.Uint32(item[4:])
+			ec, eb := b.order.Uint32(item[8:]), b.order.Uint32(item[12:])
+			// the item is [sc:sb, ec:eb) which overlaps [id:start, id:end).
+			if !(before(id, start, ec, eb) && before(sc, sb, id, end)) {
+				continue
+			}
+			if leaf {
+				blocks = append(blocks, block{b.order.Uint64(item[16:]), b.order.Uint64(item[24:])})
+			} else if err := walk(b.order.Uint64(item[16:])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return blocks, walk(off + 48)
+}
+
+// before indicates that chrom a, position p is before chrom c, position q.
+func before(a, p, c, q uint32) bool {
+	return a < c || (a == c && p < q)
+}
+
+// data gives the uncompressed data of bl.
+func (b *file) data(bl block) ([]byte, error) {
+	b.mu.Lock()
+	if e, ok := b.blocks[bl.offset]; ok {
+		b.lru.MoveToFront(e)
+		b.mu.Unlock()
+		return e.Value.(*cached).data, nil
+	}
+	b.mu.Unlock()
+
+	buf, err := b.read(bl.offset, int(bl.size))
+	if err != nil {
+		return nil, err
+	}
+	if b.hdr.UncompressBufSize > 0 {
+		z, err := zlib.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		if buf, err = io.ReadAll(z); err != nil {
+			return nil, err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.blocks[bl.offset]; !ok {
+		b.blocks[bl.offset] = b.lru.PushFront(&cached{offset: bl.offset, data: buf})
+		if b.lru.Len() > cacheSize {
+			delete(b.blocks, b.lru.Remove(b.lru.Back()).(*cached).offset)
+		}
+	}
+	return buf, nil
+}
+
+// Open opens the bigWig (as a *BigWig) or bigBed (as a *BigBed) at path.
+func Open(path string) (api.SourceBackend, error) {
+	b, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if b.hdr.Magic == bigWigMagic {
+		return &BigWig{file: b}, nil
+	}
+	return newBigBed(b)
+}
+
+func init() {
+	for _, suffix := range Suffixes {
+		if err := api.RegisterBackend(suffix, func(path string, _ api.BackendOptions) (api.SourceBackend, error) { return Open(path) }); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package bbi
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/api"
+)
+
+// testBlock is a block of data for writeBBI. It covers [start, end) on chrom.
+type testBlock struct {
+	chrom, start, end uint32
+	data              []byte
+}
+
+type testZoom struct {
+	reduction uint32
+	blocks    []testBlock
+}
+
+func le(vals ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range vals {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// bedGraph gives a bigWig section of the [start, end, value) records.
+func bedGraph(chrom uint32, recs ...[3]float32) testBlock {
+	data := le(chrom, uint32(recs[0][0]), uint32(recs[len(recs)-1][1]), uint32(0), uint32(0), uint8(1), uint8(0), uint16(len(recs)))
+	for _, r := range recs {
+		data = append(data, le(uint32(r[0]), uint32(r[1]), r[2])...)
+	}
+	return testBlock{chrom, uint32(recs[0][0]), uint32(recs[len(recs)-1][1]), data}
+}
+
+func fixedStep(chrom, start, step, span uint32, vals ...float32) testBlock {
+	end := start + uint32(len(vals)-1)*step + span
+	data := le(chrom, start, end, step, span, uint8(3), uint8(0), uint16(len(vals)))
+	for _, v := range vals {
+		data = append(data, le(v)...)
+	}
+	return testBlock{chrom, start, end, data}
+}
+
+// varStep gives a bigWig section of the (start, value) records.
+func varStep(chrom, span uint32, recs ...[2]float32) testBlock {
+	start, end := uint32(recs[0][0]), uint32(recs[len(recs)-1][0])+span
+	data := le(chrom, start, end, uint32(0), span, uint8(2), uint8(0), uint16(len(recs)))
+	for _, r := range recs {
+		data = append(data, le(uint32(r[0]), r[1])...)
+	}
+	return testBlock{chrom, start, end, data}
+}
+
+// zoomBlock gives a block of zoom records, on one chrom, of chrom, start, end, count, min,
+// max and sum.
+func zoomBlock(recs ...[7]float32) testBlock {
+	var data []byte
+	for _, r := range recs {
+		data = append(data, le(uint32(r[0]), uint32(r[1]), uint32(r[2]), uint32(r[3]), r[4], r[5], r[6], r[6]*r[6])...)
+	}
+	return testBlock{uint32(recs[0][0]), uint32(recs[0][1]), uint32(recs[len(recs)-1][2]), data}
+}
+
+// bedBlock gives a bigBed block of the records on chrom with their other columns.
+func bedBlock(chrom uint32, recs ...struct {
+	start, end uint32
+	rest       string
+}) testBlock {
+	var data []byte
+	for _, r := range recs {
+		data = append(append(data, le(chrom, r.start, r.end)...), append([]byte(r.rest), 0)...)
+	}
+	return testBlock{chrom, recs[0].start, recs[len(recs)-1].end, data}
+}
+
+// writeBBI writes a little-endian bigWig or bigBed (by magic) to path with a block for
+// each of data and of the blocks of each zoom level, which must be sorted.
+func writeBBI(t *testing.T, path string, magic uint32, chroms []string, sizes []uint32, autoSQL string, fieldCount uint16,
+	data []testBlock, zooms []testZoom, compress bool) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 64+24*len(zooms)))
+	var autoOffset uint64
+	if autoSQL != "" {
+		autoOffset = uint64(buf.Len())
+		buf.WriteString(autoSQL + "\x00")
+	}
+
+	chromOffset := uint64(buf.Len())
+	keySize := 0
+	for _, c := range chroms {
+		keySize = max(keySize, len(c))
+	}
+	buf.Write(le(uint32(chromTreeMagic), uint32(len(chroms)), uint32(keySize), uint32(8), uint64(len(chroms)), uint64(0)))
+	buf.Write(le(uint8(1), uint8(0), uint16(len(chroms))))
+	for i, c := range chroms {
+		key := make([]byte, keySize)
+		copy(key, c)
+		buf.Write(key)
+		buf.Write(le(uint32(i), sizes[i]))
+	}
+
+	maxBlock := 0
+	writeBlocks := func(blocks []testBlock) []uint64 {
+		buf.Write(le(uint32(len(blocks))))
+		offsets := make([]uint64, 0, len(blocks))
+		for _, b := range blocks {
+			offsets = append(offsets, uint64(buf.Len()))
+			maxBlock = max(maxBlock, len(b.data))
+			if !compress {
+				buf.Write(b.data)
+				continue
+			}
+			z := zlib.NewWriter(&buf)
+			z.Write(b.data)
+			z.Close()
+		}
+		return offsets
+	}
+	// rtree writes the index of blocks at offsets, with the size of each from the next.
+	rtree := func(blocks []testBlock, offsets []uint64) uint64 {
+		sizes := make([]uint64, len(offsets))
+		end := append(offsets[1:len(offsets):len(offsets)], uint64(buf.Len()))
+		for i := range offsets {
+			sizes[i] = end[i] - offsets[i]
+		}
+		return writeRTree(&buf, blocks, offsets, sizes)
+	}
+
+	dataOffset := uint64(buf.Len())
+	indexOffset := rtree(data, writeBlocks(data))
+	zoomHeaders := make([]byte, 0, 24*len(zooms))
+	for _, z := range zooms {
+		off := uint64(buf.Len())
+		zoomHeaders = append(zoomHeaders, le(z.reduction, uint32(0), off, rtree(z.blocks, writeBlocks(z.blocks)))...)
+	}
+	if !compress {
+		maxBlock = 0
+	}
+
+	out := buf.Bytes()
+	copy(out, le(magic, uint16(4), uint16(len(zooms)), chromOffset, dataOffset, indexOffset, fieldCount, fieldCount,
+		autoOffset, uint64(0), uint32(maxBlock), uint64(0)))
+	copy(out[64:], zoomHeaders)
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeRTree writes an R tree of blocks at offsets with sizes and gives its offset. Leaves
+// hold up to 2 blocks so that a tree of more than 2 has 2 levels.
+func writeRTree(buf *bytes.Buffer, blocks []testBlock, offsets, sizes []uint64) uint64 {
+	start := uint64(buf.Len())
+	last := blocks[len(blocks)-1]
+	buf.Write(le(uint32(rTreeMagic), uint32(2), uint64(len(blocks)), blocks[0].chrom, blocks[0].start, last.chrom, last.end,
+		uint64(0), uint32(1), uint32(0)))
+	leaf := func(i, j int) {
+		buf.Write(le(uint8(1), uint8(0), uint16(j-i)))
+		for k := i; k < j; k++ {
+			b := blocks[k]
+			buf.Write(le(b.chrom, b.start, b.chrom, b.end, offsets[k], sizes[k]))
+		}
+	}
+	if len(blocks) <= 2 {
+		leaf(0, len(blocks))
+		return start
+	}
+	n := (len(blocks) + 1) / 2
+	child := uint64(buf.Len()) + 4 + uint64(n)*24
+	buf.Write(le(uint8(0), uint8(0), uint16(n)))
+	for i := 0; i < len(blocks); i += 2 {
+		j := min(i+2, len(blocks))
+		buf.Write(le(blocks[i].chrom, blocks[i].start, blocks[j-1].chrom, blocks[j-1].end, child))
+		child += 4 + uint64(j-i)*32
+	}
+	for i := 0; i < len(blocks); i += 2 {
+		leaf(i, min(i+2, len(blocks)))
+	}
+	return start
+}
+
+// intervals gives the start, end and fields (after chrom, start and end) of the records
+// from it.
+func intervals(t *testing.T, it interfaces.RelatableIterator, err error) []string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var out []string
+	for {
+		r, err := it.Next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		iv := r.(*parsers.Interval)
+		s := string(iv.Fields[1]) + "-" + string(iv.Fields[2])
+		for _, v := range iv.Fields[3:] {
+			s += ":" + string(v)
+		}
+		out = append(out, s)
+	}
+}
+
+func region(chrom string, start, end uint32) interfaces.IPosition {
+	return parsers.NewInterval(chrom, start, end, nil, 0, nil)
+}
+
+func TestBigWig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.bw")
+	data := []testBlock{
+		bedGraph(0, [3]float32{100, 200, 1.5}, [3]float32{200, 300, 2.5}),
+		fixedStep(0, 1000, 10, 5, 1, 2, 3, 4),
+		varStep(0, 1, [2]float32{2000, 7}, [2]float32{2005, 8}),
+		bedGraph(1, [3]float32{0, 1000, 0.25}),
+	}
+	zooms := []testZoom{
+		{10, []testBlock{zoomBlock([7]float32{0, 0, 1000, 200, 1.5, 2.5, 400}, [7]float32{0, 1000, 3000, 22, 1, 8, 44}),
+			zoomBlock([7]float32{1, 0, 1000, 1000, 0.25, 0.25, 250})}},
+		{100, []testBlock{zoomBlock([7]float32{0, 0, 10000, 10, 0, 9, 50}), zoomBlock([7]float32{1, 0, 1000, 1000, 0.25, 0.25, 250})}},
+	}
+	writeBBI(t, path, bigWigMagic, []string{"chr1", "chr2"}, []uint32{10000, 1000}, "", 0, data, zooms, true)
+
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	w := b.(*BigWig)
+	for _, c := range []struct {
+		chrom      string
+		start, end uint32
+		summary    bool
+		exp        []string
+	}{
+		{"chr1", 150, 250, false, []string{"100-200:1.5", "200-300:2.5"}},
+		{"1", 1003, 1012, false, []string{"1000-1005:1", "1010-1015:2"}},
+		{"1", 2000, 2006, false, []string{"2000-2001:7", "2005-2006:8"}},
+		{"2", 500, 501, false, []string{"0-1000:0.25"}},
+		{"3", 0, 100, false, nil},
+		// too short for a zoom level.
+		{"1", 150, 160, true, []string{"100-200:1.5"}},
+		{"1", 0, 2000, true, []string{"0-1000:2", "1000-3000:2"}},
+		{"1", 0, 10000, true, []string{"0-10000:5"}},
+	} {
+		it, err := w.Query(region(c.chrom, c.start, c.end))
+		if c.summary {
+			it, err = w.Summary(region(c.chrom, c.start, c.end))
+		}
+		if got := intervals(t, it, err); !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("%s:%d-%d (summary: %v): expected %v, got %v", c.chrom, c.start, c.end, c.summary, c.exp, got)
+		}
+	}
+
+	if err := w.SelectFields([]string{"value", "min", "max"}); err != nil {
+		t.Fatal(err)
+	}
+	it, err := w.Summary(region("1", 0, 2000))
+	if got, exp := intervals(t, it, err), []string{"0-1000:2:1.5:2.5", "1000-3000:2:1:8"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+	if err := w.SelectFields([]string{"mean"}); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+	if got, exp := w.Contigs(), []api.Contig{{Name: "chr1", Length: 10000}, {Name: "chr2", Length: 1000}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+	if htype, number, _ := w.Header("max"); htype != "Float" || number != "1" {
+		t.Errorf("unexpected header %s %s", htype, number)
+	}
+}
+
+type bedRec = struct {
+	start, end uint32
+	rest       string
+}
+
+const autoSQL = `table bed6plus
+"BED6 with a signal"
+(
+string chrom;      "Reference sequence chromosome or scaffold"
+uint   chromStart; "Start position in chromosome"
+uint   chromEnd;   "End position in chromosome"
+string name;       "Name of item"
+uint   score;      "Score from 0-1000"
+char[1] strand;    "+ or -"
+float  signal;     "Signal value"
+)
+`
+
+func TestBigBed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.bb")
+	data := []testBlock{
+		bedBlock(0, bedRec{100, 200, "a\t5\t+\t0.5"}),
+		bedBlock(0, bedRec{150, 300, "b\t7\t-\t1.25"}, bedRec{400, 500, "c\t1\t+\t2"}),
+		bedBlock(1, bedRec{10, 20, "d\t0\t.\t0"}),
+	}
+	writeBBI(t, path, bigBedMagic, []string{"chr1", "chr2"}, []uint32{1000, 100}, autoSQL, 7, data, nil, false)
+
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	bb := b.(*BigBed)
+	if _, ok := b.(api.Summarizer); ok {
+		t.Error("a bigBed should be streamed")
+	}
+	it, err := bb.Query(region("chr1", 180, 190))
+	if got, exp := intervals(t, it, err), []string{"100-200:a:5:+:0.5", "150-300:b:7:-:1.25"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+	if err := bb.SelectFields([]string{"signal", "name"}); err != nil {
+		t.Fatal(err)
+	}
+	it, err = bb.Query(region("2", 0, 100))
+	if got, exp := intervals(t, it, err), []string{"10-20:0:d"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+	if err := bb.SelectFields([]string{"thickStart"}); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+	for field, exp := range map[string]string{"signal": "Float", "score": "Integer", "strand": "String", "chromStart": ""} {
+		if htype, _, _ := bb.Header(field); htype != exp {
+			t.Errorf("%s: expected %q, got %q", field, exp, htype)
+		}
+	}
+	if _, _, desc := bb.Header("signal"); desc != "Signal value" {
+		t.Errorf("unexpected description %s", desc)
+	}
+
+	// without an autoSql, the columns have the names of BED.
+	writeBBI(t, path, bigBedMagic, []string{"chr1"}, []uint32{1000}, "", 7, data[:1], nil, true)
+	if b, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.(*BigBed).SelectFields([]string{"strand", "score"}); err != nil {
+		t.Fatal(err)
+	}
+	it, err = b.Query(region("chr1", 100, 101))
+	if got, exp := intervals(t, it, err), []string{"100-200:+:5"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	if _, err := Open("../example/fitcons.bed.gz"); err == nil {
+		t.Error("expected an error for a file that is not a bigWig or bigBed")
+	}
+	if _, err := Open("missing.bw"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	if !IsBBI("x.bigWig") || IsBBI("x.bed.gz") {
+		t.Error("unexpected IsBBI")
+	}
+}
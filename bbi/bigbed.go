@@ -0,0 +1,207 @@
+package bbi
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+)
+
+// bedNames are the names of the columns of a bigBed without an autoSql.
+var bedNames = []string{"chrom", "chromStart", "chromEnd", "name", "score", "strand", "thickStart", "thickEnd",
+	"itemRgb", "blockCount", "blockSizes", "chromStarts"}
+
+// column is a column of a bigBed from its autoSql.
+type column struct {
+	name, typ, comment string
+}
+
+// BigBed is an opened bigBed. It meets api.SourceBackend, api.FieldSelector and
+// api.ContigLister.
+type BigBed struct {
+	*file
+	// columns are those after the end.
+	columns []column
+	// fields are the indexes in columns of the selected fields or nil for all.
+	fields []int
+}
+
+func newBigBed(b *file) (*BigBed, error) {
+	bb := &BigBed{file: b}
+	if b.hdr.AutoSQLOffset != 0 {
+		as, err := b.cString(b.hdr.AutoSQLOffset)
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("%s: %w", b.path, err)
+		}
+		bb.columns = parseAutoSQL(as)
+	}
+	if len(bb.columns) == 0 {
+		for i := 0; i < int(b.hdr.FieldCount); i++ {
+			name := fmt.Sprintf("field%d", i+1)
+			if i < len(bedNames) {
+				name = bedNames[i]
+			}
+			bb.columns = append(bb.columns, column{name: name})
+		}
+	}
+	if len(bb.columns) >= 3 {
+		bb.columns = bb.columns[3:]
+	}
+	return bb, nil
+}
+
+// cString reads the null-terminated string at off.
+func (b *file) cString(off uint64) (string, error) {
+	var s []byte
+	for {
+		buf := make([]byte, 1024)
+		n, err := b.f.ReadAt(buf, int64(off)+int64(len(s)))
+		if i := bytes.IndexByte(buf[:n], 0); i != -1 {
+			return string(append(s, buf[:i]...)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		s = append(s, buf[:n]...)
+	}
+}
+
+// parseAutoSQL gives the columns declared in the table of as, e.g.
+// `uint chromStart; "Start position"`.
+func parseAutoSQL(as string) []column {
+	i, j := strings.IndexByte(as, '('), strings.LastIndexByte(as, ')')
+	if i == -1 || j < i {
+		return nil
+	}
+	var cols []column
+	for _, line := range strings.Split(as[i+1:j], "\n") {
+		decl, comment, ok := strings.Cut(line, ";")
+		words := strings.Fields(decl)
+		if !ok || len(words) < 2 {
+			continue
+		}
+		cols = append(cols, column{name: words[len(words)-1], typ: strings.Join(words[:len(words)-1], " "),
+			comment: strings.Trim(strings.TrimSpace(comment), `"`)})
+	}
+	return cols
+}
+
+func (bb *BigBed) names() []string {
+	names := make([]string, len(bb.columns))
+	for i, c := range bb.columns {
+		names[i] = c.name
+	}
+	return names
+}
+
+// SelectFields sets the columns that are given after the end of each record. Without
+// fields, all of the columns are given.
+func (bb *BigBed) SelectFields(fields []string) error {
+	bb.fields = nil
+	names := bb.names()
+	for _, f := range fields {
+		i := index(names, f)
+		if i == -1 {
+			return fmt.Errorf("unknown field %s (use one of %s)", f, strings.Join(names, ", "))
+		}
+		bb.fields = append(bb.fields, i)
+	}
+	return nil
+}
+
+// FieldColumn gives the column of field after the chrom, start and end.
+func (bb *BigBed) FieldColumn(field string) int {
+	if bb.fields == nil {
+		if i := index(bb.names(), field); i != -1 {
+			return 4 + i
+		}
+		return -1
+	}
+	for k, i := range bb.fields {
+		if bb.columns[i].name == field {
+			return 4 + k
+		}
+	}
+	return -1
+}
+
+// Header gives the type of field from the autoSql (Integer for integers, Float for
+// floating point and String for others, including arrays) and its comment.
+func (bb *BigBed) Header(field string) (string, string, string) {
+	i := index(bb.names(), field)
+	if i == -1 {
+		return "", "", ""
+	}
+	c := bb.columns[i]
+	desc := c.comment
+	if desc == "" {
+		desc = c.name
+	}
+	htype := "String"
+	switch c.typ {
+	case "int", "uint", "short", "ushort", "byte", "ubyte", "bigint":
+		htype = "Integer"
+	case "float", "double":
+		htype = "Float"
+	}
+	return htype, "1", desc
+}
+
+// Query returns the records overlapping region sorted by start.
+func (bb *BigBed) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	var rels records
+	id, ok := bb.chromID(region.Chrom())
+	if !ok {
+		return &rels, nil
+	}
+	start, end := region.Start(), region.End()
+	blocks, err := bb.search(bb.hdr.FullIndexOffset, id, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", bb.path, err)
+	}
+	o := bb.order
+	for _, bl := range blocks {
+		data, err := bb.data(bl)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", bb.path, err)
+		}
+		for len(data) > 0 {
+			i := bytes.IndexByte(data[min(12, len(data)):], 0)
+			if len(data) < 12 || i == -1 {
+				return nil, fmt.Errorf("%s: truncated record", bb.path)
+			}
+			chrom, s, e, rest := o.Uint32(data), o.Uint32(data[4:]), o.Uint32(data[8:]), data[12:12+i]
+			data = data[12+i+1:]
+			if chrom == id && s < end && e > start {
+				rels = append(rels, bb.interval(region.Chrom(), s, e, rest))
+			}
+		}
+	}
+	sort.SliceStable(rels, func(i, j int) bool { return rels[i].Start() < rels[j].Start() })
+	return &rels, nil
+}
+
+func (bb *BigBed) interval(chrom string, start, end uint32, rest []byte) *parsers.Interval {
+	var cols [][]byte
+	if len(rest) > 0 {
+		cols = bytes.Split(rest, []byte{'\t'})
+	}
+	fields := make([][]byte, 3, 3+len(cols))
+	fields[0], fields[1], fields[2] = []byte(chrom), []byte(strconv.Itoa(int(start))), []byte(strconv.Itoa(int(end)))
+	if bb.fields == nil {
+		fields = append(fields, cols...)
+	}
+	for _, i := range bb.fields {
+		if i < len(cols) {
+			fields = append(fields, cols[i])
+		} else {
+			fields = append(fields, []byte("."))
+		}
+	}
+	return parsers.NewInterval(chrom, start, end, fields, 0, nil)
+}
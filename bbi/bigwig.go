@@ -0,0 +1,222 @@
+package bbi
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+)
+
+// wigFields are the fields of a bigWig.
+var wigFields = []string{"value", "min", "max"}
+
+// BigWig is an opened bigWig. It meets api.SourceBackend, api.FieldSelector,
+// api.ContigLister and api.Summarizer.
+type BigWig struct {
+	*file
+	// fields are the indexes in wigFields of the selected fields.
+	fields []int
+}
+
+// SelectFields sets the fields that are given after the end of each record. Without
+// fields, only the value is given.
+func (w *BigWig) SelectFields(fields []string) error {
+	w.fields = w.fields[:0]
+	for _, f := range fields {
+		i := index(wigFields, f)
+		if i == -1 {
+			return fmt.Errorf("unknown field %s for a bigWig (use value, min or max)", f)
+		}
+		w.fields = append(w.fields, i)
+	}
+	return nil
+}
+
+// FieldColumn gives the column of field after the chrom, start and end.
+func (w *BigWig) FieldColumn(field string) int {
+	for k, i := range w.fields {
+		if wigFields[i] == field {
+			return 4 + k
+		}
+	}
+	return -1
+}
+
+func index(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Header gives Float for each field.
+func (w *BigWig) Header(field string) (string, string, string) {
+	switch field {
+	case "min", "max":
+		return "Float", "1", field + " value"
+	}
+	return "Float", "1", "value (the mean of a zoom level for a large variant)"
+}
+
+// wigRecord is a record of the data or of a zoom level.
+type wigRecord struct {
+	start, end      uint32
+	value, min, max float32
+}
+
+// Query returns the base-level records overlapping region sorted by start.
+func (w *BigWig) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	return w.query(region, nil)
+}
+
+// Summary returns the records overlapping region from the coarsest zoom level with at
+// least SummaryBins records in region or, if there is none, the base-level records.
+func (w *BigWig) Summary(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	var zoom *zoomHeader
+	for i, z := range w.zooms {
+		if uint64(z.ReductionLevel)*SummaryBins <= uint64(region.End()-region.Start()) &&
+			(zoom == nil || z.ReductionLevel > zoom.ReductionLevel) {
+			zoom = &w.zooms[i]
+		}
+	}
+	return w.query(region, zoom)
+}
+
+// query returns the records of zoom, or the data if zoom is nil, that overlap region.
+func (w *BigWig) query(region interfaces.IPosition, zoom *zoomHeader) (interfaces.RelatableIterator, error) {
+	var rels records
+	id, ok := w.chromID(region.Chrom())
+	if !ok {
+		return &rels, nil
+	}
+	start, end := region.Start(), region.End()
+	indexOffset := w.hdr.FullIndexOffset
+	if zoom != nil {
+		indexOffset = zoom.IndexOffset
+	}
+	blocks, err := w.search(indexOffset, id, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", w.path, err)
+	}
+	for _, bl := range blocks {
+		data, err := w.data(bl)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", w.path, err)
+		}
+		parse := w.sections
+		if zoom != nil {
+			parse = w.zoomRecords
+		}
+		err = parse(data, id, func(r wigRecord) {
+			if r.start < end && r.end > start {
+				rels = append(rels, w.interval(region.Chrom(), r))
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", w.path, err)
+		}
+	}
+	sort.SliceStable(rels, func(i, j int) bool { return rels[i].Start() < rels[j].Start() })
+	return &rels, nil
+}
+
+// sections calls fn with each record on chrom id in the sections of data.
+func (w *BigWig) sections(data []byte, id uint32, fn func(wigRecord)) error {
+	o := w.order
+	for len(data) > 0 {
+		if len(data) < 24 {
+			return io.ErrUnexpectedEOF
+		}
+		chrom, start := o.Uint32(data), o.Uint32(data[4:])
+		step, span := o.Uint32(data[12:]), o.Uint32(data[16:])
+		kind, n := data[20], int(o.Uint16(data[22:]))
+		data = data[24:]
+		var size int
+		switch kind {
+		case 1:
+			size = 12
+		case 2:
+			size = 8
+		case 3:
+			size = 4
+		default:
+			return fmt.Errorf("unknown section type %d", kind)
+		}
+		if len(data) < n*size {
+			return io.ErrUnexpectedEOF
+		}
+		for i := 0; i < n && chrom == id; i++ {
+			item := data[i*size:]
+			var r wigRecord
+			switch kind {
+			case 1:
+				r.start, r.end, r.value = o.Uint32(item), o.Uint32(item[4:]), math.Float32frombits(o.Uint32(item[8:]))
+			case 2:
+				r.start, r.value = o.Uint32(item), math.Float32frombits(o.Uint32(item[4:]))
+				r.end = r.start + span
+			case 3:
+				r.start, r.value = start+uint32(i)*step, math.Float32frombits(o.Uint32(item))
+				r.end = r.start + span
+			}
+			r.min, r.max = r.value, r.value
+			fn(r)
+		}
+		data = data[n*size:]
+	}
+	return nil
+}
+
+// zoomRecords calls fn with each zoom record on chrom id in data. The value is the mean.
+func (w *BigWig) zoomRecords(data []byte, id uint32, fn func(wigRecord)) error {
+	o := w.order
+	if len(data)%32 != 0 {
+		return io.ErrUnexpectedEOF
+	}
+	for ; len(data) > 0; data = data[32:] {
+		n := o.Uint32(data[12:])
+		if o.Uint32(data) != id || n == 0 {
+			continue
+		}
+		sum := math.Float32frombits(o.Uint32(data[24:]))
+		fn(wigRecord{start: o.Uint32(data[4:]), end: o.Uint32(data[8:]), value: sum / float32(n),
+			min: math.Float32frombits(o.Uint32(data[16:])), max: math.Float32frombits(o.Uint32(data[20:]))})
+	}
+	return nil
+}
+
+func (w *BigWig) interval(chrom string, r wigRecord) *parsers.Interval {
+	vals := [3]float32{r.value, r.min, r.max}
+	fields := make([][]byte, 3, 3+len(w.fields))
+	fields[0], fields[1], fields[2] = []byte(chrom), []byte(strconv.Itoa(int(r.start))), []byte(strconv.Itoa(int(r.end)))
+	if len(w.fields) == 0 {
+		fields = append(fields, formatFloat(r.value))
+	}
+	for _, i := range w.fields {
+		fields = append(fields, formatFloat(vals[i]))
+	}
+	return parsers.NewInterval(chrom, r.start, r.end, fields, 0, nil)
+}
+
+func formatFloat(v float32) []byte {
+	return strconv.AppendFloat(nil, float64(v), 'g', -1, 32)
+}
+
+// records iterates over the records from a query.
+type records []interfaces.Relatable
+
+func (s *records) Next() (interfaces.Relatable, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	r := (*s)[0]
+	*s = (*s)[1:]
+	return r, nil
+}
+
+func (s *records) Close() error { return nil }
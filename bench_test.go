@@ -36,7 +36,10 @@ func benchmarkAnno(b *testing.B) {
 		if err != nil {
 			log.Fatal(err)
 		}
-		a := api.NewAnnotator(srcs, l_string, false, true, empty)
+		a, err := api.NewAnnotator(srcs, l_string, false, true, empty)
+		if err != nil {
+			log.Fatal(err)
+		}
 		qrdr, err := xopen.Ropen("example/query.vcf.gz")
 		if err != nil {
 			log.Fatal(err)
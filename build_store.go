@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	. "github.com/brentp/vcfanno/shared"
+	"github.com/brentp/vcfanno/store"
+	"github.com/brentp/xopen"
+)
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func splitInts(s string) ([]int, error) {
+	var cols []int
+	for _, c := range splitList(s) {
+		i, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("bad column: %s", c)
+		}
+		cols = append(cols, i)
+	}
+	return cols, nil
+}
+
+// configFields returns the fields (or columns and names) used for path in the config.
+func configFields(conf string, path string) (fields []string, columns []int, names []string, err error) {
+	var config Config
+	if _, err = toml.DecodeFile(conf, &config); err != nil {
+		return nil, nil, nil, err
+	}
+	seen := make(map[string]bool)
+	for _, a := range config.Annotation {
+		if filepath.Base(a.File) != filepath.Base(path) {
+			continue
+		}
+		for _, f := range a.Fields {
+			if !seen[f] {
+				fields = append(fields, f)
+				seen[f] = true
+			}
+		}
+		for i, c := range a.Columns {
+			name := strconv.Itoa(c)
+			if !seen[name] && i < len(a.Names) {
+				columns = append(columns, c)
+				names = append(names, a.Names[i])
+				seen[name] = true
+			}
+		}
+	}
+	if len(fields) == 0 && len(columns) == 0 {
+		err = fmt.Errorf("no annotation for %s in %s", path, conf)
+	}
+	return fields, columns, names, err
+}
+
+// buildStore implements the build-store command.
+func buildStore(args []string) {
+	fs := flag.NewFlagSet("build-store", flag.ExitOnError)
+	conf := fs.String("config", "", "optional config from which to take the fields (or columns) used for the input file")
+	fields := fs.String("fields", "", "comma-separated INFO fields to keep from a VCF. ID and FILTER may be included")
+	columns := fs.String("columns", "", "comma-separated (1-based) columns to keep from a tab-delimited file")
+	nameList := fs.String("names", "", "comma-separated names for -columns")
+	types := fs.String("types", "", "comma-separated types (Integer, Float or String) for -columns. default is String")
+	key := fs.String("key", "1,2,3,4", "columns of chrom, pos (1-based), ref and alt in a tab-delimited file")
+	out := fs.String("o", "", "path of the store to write. default is the input with "+store.Suffix)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+%s build-store [options] annotation.vcf.gz|annotation.tsv.gz
+
+Writes the requested fields to an indexed store that can be used as the file of an
+[[annotation]] in place of the original.
+
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+
+	flds, names := splitList(*fields), splitList(*nameList)
+	cols, err := splitInts(*columns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *conf != "" {
+		if flds, cols, names, err = configFields(*conf, path); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(flds) == 0 && len(cols) == 0 {
+		log.Fatal("ERROR: must specify -config, -fields or -columns")
+	}
+	if len(flds) != 0 && len(cols) != 0 {
+		log.Fatal("ERROR: can't specify both fields and columns")
+	}
+
+	if *out == "" {
+		*out = strings.TrimSuffix(strings.TrimSuffix(path, ".gz"), ".bgz")
+		*out = strings.TrimSuffix(*out, filepath.Ext(*out)) + store.Suffix
+	}
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rdr.Close()
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now()
+	var n int
+	if len(flds) != 0 {
+		n, err = store.BuildVCF(rdr, flds, f)
+	} else {
+		opts := store.TSVOptions{Columns: cols, Names: names, Types: splitList(*types)}
+		var k []int
+		if k, err = splitInts(*key); err == nil && len(k) != 4 {
+			err = fmt.Errorf("-key must have 4 columns")
+		}
+		if err == nil {
+			copy(opts.Key[:], k)
+			n, err = store.BuildTSV(rdr, opts, f)
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d records to %s in %.1f seconds", n, *out, time.Since(start).Seconds())
+}
@@ -0,0 +1,653 @@
+// Package columnar provides annotations from Parquet and Arrow IPC files. Importing the
+// package registers it as a source for files ending in ".parquet", ".arrow" and ".feather".
+//
+// A table must have a chromosome column (chrom, chromosome, chr, contig or seqname) and a
+// 1-based position column (pos or position). It may have a 1-based, inclusive end column (end)
+// and ref and alt columns (ref and alt) where alt is a comma-separated string or a list.
+// Names are matched without case. With ref and alt, each row is used like a VCF record so
+// that alleles are matched as for a VCF. Otherwise each row is used like a BED interval with
+// columns chrom, start, end and then the fields in order.
+//
+// Only the chunks (Parquet row groups or Arrow record batches) that can overlap a query are
+// read, and only the columns of the requested fields. The table should be sorted by chrom
+// and position. Values are typed from the schema so integers are passed to the ops as int,
+// floats as float64 and lists as []int, []float64 or []string.
+package columnar
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/api"
+	"github.com/brentp/vcfgo"
+)
+
+// maxSpan is the longest row (from its ref) that is expected when a table has no end
+// column. It is only used to skip chunks that have not been read.
+const maxSpan = 10000
+
+// cacheSize is the number of chunks kept in memory.
+const cacheSize = 4
+
+var (
+	chromNames = []string{"chrom", "chromosome", "chr", "contig", "seqname", "#chrom"}
+	posNames   = []string{"pos", "position"}
+	endNames   = []string{"end"}
+	refNames   = []string{"ref", "reference"}
+	altNames   = []string{"alt", "alternate"}
+)
+
+// role is the index of each coordinate column in a loaded chunk.
+const (
+	colChrom = iota
+	colPos
+	colEnd
+	colRef
+	colAlt
+	nCoords
+)
+
+// source is a file (or a file in a partitioned directory) that can read chunks.
+type source interface {
+	schema() *arrow.Schema
+	// read reads the named columns of chunk i in order. A nil array is returned for a
+	// column that is not in the file.
+	read(i int, columns []string) ([]arrow.Array, error)
+	io.Closer
+}
+
+type chunk struct {
+	src source
+	idx int
+	// partition is the chrom given by the path (e.g. chrom=1/part-0.parquet) when it is
+	// not a column.
+	partition string
+	// range of chroms and 1-based positions from statistics. Empty chroms are unknown.
+	chromMin, chromMax string
+	posMin, posMax     int64
+	hasPos             bool
+	// maxEnd is the largest (inclusive) end. It is 0 if unknown.
+	maxEnd atomic.Int64
+}
+
+// Table is an opened Parquet or Arrow file or directory. It meets api.SourceBackend and
+// api.FieldSelector.
+type Table struct {
+	path    string
+	sources []source
+	chunks  []*chunk
+	names   [nCoords]string
+	fields  []string
+	index   map[string]int
+	types   map[string]arrow.DataType
+	header  *vcfgo.Header
+
+	mu    sync.Mutex
+	cache []*loaded
+}
+
+// loaded is a chunk that has been read.
+type loaded struct {
+	c      *chunk
+	coords [nCoords]arrow.Array
+	fields []arrow.Array
+	// rows of each chrom. These are contiguous in a sorted table.
+	chroms map[string][][2]int
+	// sorted indicates that pos is increasing within each range.
+	sorted bool
+	maxLen int64
+	maxEnd int64
+}
+
+// Open opens a Parquet or Arrow IPC file or a directory of Parquet files.
+func Open(path string) (*Table, error) {
+	t := &Table{path: path}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if st.IsDir() {
+		err = t.openDir(path)
+	} else if strings.HasSuffix(path, ".parquet") {
+		err = t.addParquet(path, "")
+	} else {
+		err = t.addIPC(path)
+	}
+	if err == nil {
+		err = t.init()
+	}
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("columnar: %s: %s", path, err)
+	}
+	return t, nil
+}
+
+func find(s *arrow.Schema, names []string) string {
+	for _, f := range s.Fields() {
+		for _, n := range names {
+			if strings.EqualFold(f.Name, n) {
+				return f.Name
+			}
+		}
+	}
+	return ""
+}
+
+func (t *Table) init() error {
+	if len(t.sources) == 0 {
+		return fmt.Errorf("no files found")
+	}
+	s := t.sources[0].schema()
+	for i, names := range [][]string{chromNames, posNames, endNames, refNames, altNames} {
+		t.names[i] = find(s, names)
+	}
+	if t.names[colChrom] == "" && t.chunks[0].partition == "" {
+		return fmt.Errorf("no chromosome column (one of %s) found", strings.Join(chromNames, ", "))
+	}
+	if t.names[colPos] == "" {
+		return fmt.Errorf("no position column (one of %s) found", strings.Join(posNames, ", "))
+	}
+	if (t.names[colRef] == "") != (t.names[colAlt] == "") {
+		return fmt.Errorf("must have both or neither of ref and alt columns")
+	}
+	t.types = make(map[string]arrow.DataType)
+	for _, f := range s.Fields() {
+		t.types[f.Name] = f.Type
+	}
+	return t.SelectFields(nil)
+}
+
+// SelectFields sets the fields that are read. Setup calls this with the fields in the config.
+func (t *Table) SelectFields(fields []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fields = nil
+	t.index = make(map[string]int)
+	t.header = vcfgo.NewHeader()
+	for _, f := range fields {
+		if _, ok := t.index[f]; ok {
+			continue
+		}
+		dt, ok := t.types[f]
+		if !ok {
+			if f == "ID" || f == "FILTER" {
+				continue
+			}
+			return fmt.Errorf("field %s not found in %s", f, t.path)
+		}
+		htype, number := vcfType(dt)
+		t.index[f] = len(t.fields)
+		t.fields = append(t.fields, f)
+		t.header.Infos[f] = &vcfgo.Info{Id: f, Type: htype, Number: number, Description: t.description(f)}
+	}
+	t.cache = nil
+	return nil
+}
+
+// FieldColumn gives the column of field after the chrom, start and end for a table without
+// ref and alt columns.
+func (t *Table) FieldColumn(field string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i, ok := t.index[field]
+	if !ok || t.names[colRef] != "" {
+		return -1
+	}
+	return 4 + i
+}
+
+func (t *Table) description(field string) string {
+	return fmt.Sprintf("column %s", field)
+}
+
+// vcfType gives the VCF Type and Number for an arrow type.
+func vcfType(dt arrow.DataType) (string, string) {
+	if d, ok := dt.(*arrow.DictionaryType); ok {
+		dt = d.ValueType
+	}
+	if l, ok := dt.(arrow.ListLikeType); ok {
+		htype, _ := vcfType(l.Elem())
+		return htype, "."
+	}
+	switch {
+	case arrow.IsInteger(dt.ID()):
+		return "Integer", "1"
+	case arrow.IsFloating(dt.ID()):
+		return "Float", "1"
+	case dt.ID() == arrow.BOOL:
+		return "Flag", "0"
+	}
+	return "String", "1"
+}
+
+// Header gives the Type and Number from the schema.
+func (t *Table) Header(field string) (string, string, string) {
+	if dt, ok := t.types[field]; ok {
+		htype, number := vcfType(dt)
+		return htype, number, t.description(field)
+	}
+	return "", "1", ""
+}
+
+// Close closes the files.
+func (t *Table) Close() error {
+	var err error
+	for _, s := range t.sources {
+		if e := s.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (c *chunk) overlaps(chroms []string, start, end int64) bool {
+	ok := false
+	for _, chrom := range chroms {
+		if c.partition != "" {
+			ok = ok || c.partition == chrom
+		} else {
+			ok = ok || c.chromMin == "" || (c.chromMin <= chrom && chrom <= c.chromMax)
+		}
+	}
+	// positions are only comparable if the chunk has a single chrom.
+	single := c.partition != "" || (c.chromMin != "" && c.chromMin == c.chromMax)
+	if !ok || !c.hasPos || !single {
+		return ok
+	}
+	maxEnd := c.maxEnd.Load()
+	if maxEnd == 0 {
+		maxEnd = c.posMax + maxSpan
+	}
+	// 1-based, inclusive positions against a 0-based, half-open query.
+	return c.posMin <= end && maxEnd > start
+}
+
+// load reads the chunk (or gets it from the cache).
+func (t *Table) load(c *chunk) (*loaded, error) {
+	t.mu.Lock()
+	for i, l := range t.cache {
+		if l.c == c {
+			copy(t.cache[1:i+1], t.cache[:i])
+			t.cache[0] = l
+			t.mu.Unlock()
+			return l, nil
+		}
+	}
+	fields := t.fields
+	t.mu.Unlock()
+
+	cols := append(append([]string{}, t.names[:]...), fields...)
+	arrs, err := c.src.read(c.idx, cols)
+	if err != nil {
+		return nil, err
+	}
+	l := &loaded{c: c, fields: arrs[nCoords:]}
+	copy(l.coords[:], arrs[:nCoords])
+	if err := l.index(); err != nil {
+		return nil, err
+	}
+
+	c.maxEnd.Store(l.maxEnd)
+	t.mu.Lock()
+	t.cache = append([]*loaded{l}, t.cache...)
+	if len(t.cache) > cacheSize {
+		t.cache = t.cache[:cacheSize]
+	}
+	t.mu.Unlock()
+	return l, nil
+}
+
+func (l *loaded) len() int {
+	return l.coords[colPos].Len()
+}
+
+func (l *loaded) chrom(i int) string {
+	if l.coords[colChrom] == nil {
+		return l.c.partition
+	}
+	switch v := value(l.coords[colChrom], i).(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return text(v)
+	}
+}
+
+func (l *loaded) pos(i int) int64 {
+	return asInt(value(l.coords[colPos], i))
+}
+
+// end gives the 1-based inclusive end of row i.
+func (l *loaded) end(i int, pos int64) int64 {
+	if l.coords[colEnd] != nil {
+		if e := asInt(value(l.coords[colEnd], i)); e >= pos {
+			return e
+		}
+	}
+	if l.coords[colRef] != nil {
+		if r, _ := value(l.coords[colRef], i).(string); len(r) > 0 {
+			return pos + int64(len(r)) - 1
+		}
+	}
+	return pos
+}
+
+// index finds the rows of each chrom and the longest row.
+func (l *loaded) index() error {
+	l.chroms = make(map[string][][2]int)
+	l.sorted = true
+	n := l.len()
+	last, lastPos := "", int64(0)
+	for i := 0; i < n; i++ {
+		c, p := l.chrom(i), l.pos(i)
+		if p < 1 {
+			return fmt.Errorf("bad position at row %d", i)
+		}
+		if i == 0 || c != last {
+			l.chroms[c] = append(l.chroms[c], [2]int{i, i})
+		} else if p < lastPos {
+			l.sorted = false
+		}
+		r := l.chroms[c]
+		r[len(r)-1][1] = i + 1
+		last, lastPos = c, p
+		e := l.end(i, p)
+		if e-p+1 > l.maxLen {
+			l.maxLen = e - p + 1
+		}
+		if e > l.maxEnd {
+			l.maxEnd = e
+		}
+	}
+	return nil
+}
+
+func asInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// Query returns the rows overlapping region.
+func (t *Table) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	chroms := []string{region.Chrom(), "chr" + region.Chrom()}
+	if strings.HasPrefix(region.Chrom(), "chr") {
+		chroms[1] = region.Chrom()[3:]
+	}
+	start, end := int64(region.Start()), int64(region.End())
+	var rows []interfaces.Relatable
+	for _, c := range t.chunks {
+		if !c.overlaps(chroms, start, end) {
+			continue
+		}
+		l, err := t.load(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, chrom := range chroms {
+			for _, r := range l.chroms[chrom] {
+				lo := r[0]
+				if l.sorted {
+					// first row that can overlap: pos > start - maxLen.
+					lo += sort.Search(r[1]-r[0], func(i int) bool { return l.pos(r[0]+i) > start-l.maxLen })
+				}
+				for i := lo; i < r[1]; i++ {
+					p := l.pos(i)
+					if p > end {
+						if l.sorted {
+							break
+						}
+						continue
+					}
+					if e := l.end(i, p); e > start {
+						rows = append(rows, t.row(l, i, chrom, p, e))
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Start() < rows[j].Start() })
+	return &iterator{rows: rows}, nil
+}
+
+func (t *Table) row(l *loaded, i int, chrom string, pos, end int64) interfaces.Relatable {
+	vals := make([]interface{}, len(l.fields))
+	for k, a := range l.fields {
+		if a != nil {
+			vals[k] = value(a, i)
+		}
+	}
+	if l.coords[colRef] == nil {
+		fields := make([][]byte, 3, 3+len(vals))
+		fields[0], fields[1], fields[2] = []byte(chrom), []byte(strconv.FormatInt(pos-1, 10)), []byte(strconv.FormatInt(end, 10))
+		for _, v := range vals {
+			fields = append(fields, []byte(column(v)))
+		}
+		return parsers.NewInterval(chrom, uint32(pos-1), uint32(end), fields, 0, nil)
+	}
+
+	ref, _ := value(l.coords[colRef], i).(string)
+	var alts []string
+	switch a := value(l.coords[colAlt], i).(type) {
+	case string:
+		alts = strings.Split(a, ",")
+	case []string:
+		alts = a
+	}
+	if len(alts) == 0 {
+		alts = []string{"."}
+	}
+	v := &vcfgo.Variant{Chromosome: chrom, Pos: uint64(pos), Reference: ref, Alternate: alts, Id_: ".", Filter: ".",
+		Header: t.header, Info_: &info{t: t, vals: vals}}
+	if k, ok := t.index["ID"]; ok && vals[k] != nil {
+		v.Id_ = text(vals[k])
+	}
+	if k, ok := t.index["FILTER"]; ok && vals[k] != nil {
+		v.Filter = text(vals[k])
+	}
+	return interfaces.AsRelatable(v)
+}
+
+type iterator struct {
+	rows []interfaces.Relatable
+}
+
+func (it *iterator) Next() (interfaces.Relatable, error) {
+	if len(it.rows) == 0 {
+		return nil, io.EOF
+	}
+	r := it.rows[0]
+	it.rows = it.rows[1:]
+	return r, nil
+}
+
+func (it *iterator) Close() error { return nil }
+
+// value gives the Go value of row i: int, float64, bool or string or a slice of those for
+// a list. It is nil for a null.
+func value(a arrow.Array, i int) interface{} {
+	if a.IsNull(i) {
+		return nil
+	}
+	switch a := a.(type) {
+	case *array.Int8:
+		return int(a.Value(i))
+	case *array.Int16:
+		return int(a.Value(i))
+	case *array.Int32:
+		return int(a.Value(i))
+	case *array.Int64:
+		return int(a.Value(i))
+	case *array.Uint8:
+		return int(a.Value(i))
+	case *array.Uint16:
+		return int(a.Value(i))
+	case *array.Uint32:
+		return int(a.Value(i))
+	case *array.Uint64:
+		return int(a.Value(i))
+	case *array.Float16:
+		return float64(a.Value(i).Float32())
+	case *array.Float32:
+		return float64(a.Value(i))
+	case *array.Float64:
+		return a.Value(i)
+	case *array.Boolean:
+		return a.Value(i)
+	case *array.String:
+		return a.Value(i)
+	case *array.LargeString:
+		return a.Value(i)
+	case *array.Binary:
+		return string(a.Value(i))
+	case *array.Dictionary:
+		return value(a.Dictionary(), a.GetValueIndex(i))
+	case array.ListLike:
+		return list(a, i)
+	}
+	return a.ValueStr(i)
+}
+
+// list gives the values of a list as []int, []float64 or []string. Nulls in a list of
+// numbers are skipped.
+func list(a array.ListLike, i int) interface{} {
+	start, end := a.ValueOffsets(i)
+	elems := a.ListValues()
+	switch htype, _ := vcfType(elems.DataType()); htype {
+	case "Integer":
+		out := make([]int, 0, end-start)
+		for j := start; j < end; j++ {
+			if v, ok := value(elems, int(j)).(int); ok {
+				out = append(out, v)
+			}
+		}
+		return out
+	case "Float":
+		out := make([]float64, 0, end-start)
+		for j := start; j < end; j++ {
+			if v, ok := value(elems, int(j)).(float64); ok {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+	out := make([]string, 0, end-start)
+	for j := start; j < end; j++ {
+		out = append(out, text(value(elems, int(j))))
+	}
+	return out
+}
+
+// column formats v for a column of an interval. Floats are kept in full as the column is
+// parsed again.
+func column(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []float64:
+		s := make([]string, len(v))
+		for i, f := range v {
+			s[i] = strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return strings.Join(s, ",")
+	}
+	return text(v)
+}
+
+// text formats v as it would appear in a VCF.
+func text(v interface{}) string {
+	if v == nil {
+		return "."
+	}
+	return vcfgo.ItoS("", v)
+}
+
+// info meets interfaces.Info for the typed values of a row.
+type info struct {
+	t    *Table
+	vals []interface{}
+}
+
+func (i *info) Get(key string) (interface{}, error) {
+	k, ok := i.t.index[key]
+	if !ok {
+		return nil, fmt.Errorf("Info Error: %s not found in header", key)
+	}
+	return i.vals[k], nil
+}
+
+func (i *info) Set(key string, val interface{}) error {
+	k, ok := i.t.index[key]
+	if !ok {
+		return fmt.Errorf("Info Error: %s not found in header", key)
+	}
+	i.vals[k] = val
+	return nil
+}
+
+func (i *info) Delete(key string) {
+	if k, ok := i.t.index[key]; ok {
+		i.vals[k] = nil
+	}
+}
+
+func (i *info) Keys() []string {
+	keys := make([]string, 0, len(i.vals))
+	for k, f := range i.t.fields {
+		if i.vals[k] != nil {
+			keys = append(keys, f)
+		}
+	}
+	return keys
+}
+
+func (i *info) String() string {
+	return string(i.Bytes())
+}
+
+func (i *info) Bytes() []byte {
+	var b []byte
+	for k, f := range i.t.fields {
+		if i.vals[k] == nil {
+			continue
+		}
+		if len(b) > 0 {
+			b = append(b, ';')
+		}
+		b = append(b, f...)
+		if v, ok := i.vals[k].(bool); !ok || !v {
+			b = append(b, '=')
+			b = append(b, text(i.vals[k])...)
+		}
+	}
+	return b
+}
+
+func init() {
+	open := func(path string, _ api.BackendOptions) (api.SourceBackend, error) { return Open(path) }
+	for _, suffix := range []string{".parquet", ".arrow", ".feather"} {
+		if err := api.RegisterBackend(suffix, open); err != nil {
+			panic(err)
+		}
+	}
+}
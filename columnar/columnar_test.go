@@ -0,0 +1,329 @@
+package columnar
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/shared"
+	"github.com/brentp/vcfgo"
+	"github.com/brentp/xopen"
+)
+
+var exacSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "CHROM", Type: arrow.BinaryTypes.String},
+	{Name: "POS", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "REF", Type: arrow.BinaryTypes.String},
+	{Name: "ALT", Type: arrow.BinaryTypes.String},
+	{Name: "an", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+	{Name: "dp", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+	{Name: "gq", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "af", Type: arrow.ListOf(arrow.PrimitiveTypes.Float64), Nullable: true},
+}, nil)
+
+// exacRecord reads the example ExAC VCF into a record.
+func exacRecord(t *testing.T) arrow.Record {
+	t.Helper()
+	rdr, err := xopen.Ropen("../example/exac.vcf.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	vcf, err := vcfgo.NewReader(rdr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := array.NewRecordBuilder(memory.DefaultAllocator, exacSchema)
+	for v := vcf.Read(); v != nil; v = vcf.Read() {
+		b.Field(0).(*array.StringBuilder).Append(v.Chromosome)
+		b.Field(1).(*array.Int64Builder).Append(int64(v.Pos))
+		b.Field(2).(*array.StringBuilder).Append(v.Reference)
+		b.Field(3).(*array.StringBuilder).Append(strings.Join(v.Alternate, ","))
+		if an, err := v.Info().Get("AN_Adj"); err == nil {
+			b.Field(4).(*array.Int32Builder).Append(int32(an.(int)))
+		} else {
+			b.Field(4).AppendNull()
+		}
+		dp, _ := v.Info().Get("DP")
+		b.Field(5).(*array.Int64Builder).Append(int64(dp.(int)))
+		if gq, err := v.Info().Get("GQ_MEAN"); err == nil {
+			b.Field(6).(*array.Float64Builder).Append(gq.(float64))
+		} else {
+			b.Field(6).AppendNull()
+		}
+		lb := b.Field(7).(*array.ListBuilder)
+		lb.Append(true)
+		af, _ := v.Info().Get("AF")
+		switch af := af.(type) {
+		case float64:
+			lb.ValueBuilder().(*array.Float64Builder).Append(af)
+		case []float32:
+			for _, f := range af {
+				lb.ValueBuilder().(*array.Float64Builder).Append(float64(f))
+			}
+		}
+	}
+	return b.NewRecord()
+}
+
+func writeParquet(t *testing.T, path string, rec arrow.Record) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// small row groups so that most are skipped by a query.
+	props := parquet.NewWriterProperties(parquet.WithMaxRowGroupLength(16))
+	tbl := array.NewTableFromRecords(rec.Schema(), []arrow.Record{rec})
+	if err := pqarrow.WriteTable(tbl, f, 16, props, pqarrow.DefaultWriterProps()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeIPC(t *testing.T, path string, rec arrow.Record) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := ipc.NewFileWriter(f, ipc.WithSchema(rec.Schema()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < rec.NumRows(); i += 20 {
+		end := i + 20
+		if end > rec.NumRows() {
+			end = rec.NumRows()
+		}
+		if err := w.Write(rec.NewSlice(i, end)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func run(t *testing.T, cfg *shared.Config) []string {
+	t.Helper()
+	rdr, err := xopen.Ropen("../example/query.vcf.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	var out bytes.Buffer
+	if _, err := shared.Run(context.Background(), *cfg, rdr, &out, shared.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if l[0] != '#' {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func TestMatchesVCF(t *testing.T) {
+	rec := exacRecord(t)
+	dir := t.TempDir()
+	writeParquet(t, filepath.Join(dir, "exac.parquet"), rec)
+	writeIPC(t, filepath.Join(dir, "exac.arrow"), rec)
+
+	ops, names := []string{"self", "max", "mean"}, []string{"an", "dp", "gq"}
+	exp := run(t, shared.NewConfig("").AddFields("../example/exac.vcf.gz", []string{"AN_Adj", "DP", "GQ_MEAN"}, ops, names))
+	for _, f := range []string{"exac.parquet", "exac.arrow"} {
+		got := run(t, shared.NewConfig(dir).AddFields(f, []string{"an", "dp", "gq"}, ops, names))
+		if len(exp) != len(got) {
+			t.Fatalf("%s: expected %d variants, got %d", f, len(exp), len(got))
+		}
+		annotated := 0
+		for i := range exp {
+			if exp[i] != got[i] {
+				t.Fatalf("%s: line %d differs:\n%s\n%s", f, i, exp[i], got[i])
+			}
+			if strings.Contains(got[i], ";an=") {
+				annotated++
+			}
+		}
+		if annotated == 0 {
+			t.Fatalf("%s: expected annotated variants", f)
+		}
+	}
+}
+
+func TestTyped(t *testing.T) {
+	rec := exacRecord(t)
+	path := filepath.Join(t.TempDir(), "exac.parquet")
+	writeParquet(t, path, rec)
+	tbl, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	if err := tbl.SelectFields([]string{"an", "gq", "af"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.SelectFields([]string{"nope"}); err == nil {
+		t.Fatal("expected error for missing field")
+	}
+	tbl.SelectFields([]string{"an", "gq", "af"})
+	if htype, num, _ := tbl.Header("af"); htype != "Float" || num != "." {
+		t.Errorf("unexpected header for af: %s %s", htype, num)
+	}
+
+	it, err := tbl.Query(parsers.NewInterval("chr1", 69400, 69600, nil, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, loaded := 0, len(tbl.cache)
+	for r, err := it.Next(); err == nil; r, err = it.Next() {
+		v := r.(interfaces.IVariant)
+		if v.Start() >= 69600 || v.End() <= 69400 {
+			t.Errorf("%d-%d does not overlap", v.Start(), v.End())
+		}
+		if an, _ := v.Info().Get("an"); an != nil {
+			if _, ok := an.(int); !ok {
+				t.Errorf("expected int, got %T", an)
+			}
+		}
+		if gq, _ := v.Info().Get("gq"); gq != nil {
+			if _, ok := gq.(float64); !ok {
+				t.Errorf("expected float64, got %T", gq)
+			}
+		}
+		if af, _ := v.Info().Get("af"); af != nil {
+			if _, ok := af.([]float64); !ok {
+				t.Errorf("expected []float64, got %T", af)
+			}
+		}
+		n++
+	}
+	if n == 0 {
+		t.Fatal("expected variants")
+	}
+	if loaded >= len(tbl.chunks) {
+		t.Errorf("expected row groups to be skipped: read %d of %d", loaded, len(tbl.chunks))
+	}
+}
+
+func TestPartitioned(t *testing.T) {
+	rec := exacRecord(t)
+	// drop the chrom column and write it as a hive-style partition.
+	cols := rec.Columns()[1:]
+	sch := arrow.NewSchema(exacSchema.Fields()[1:], nil)
+	dir := filepath.Join(t.TempDir(), "exac.parquet")
+	if err := os.MkdirAll(filepath.Join(dir, "chrom=1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeParquet(t, filepath.Join(dir, "chrom=1", "part-0.parquet"), array.NewRecord(sch, cols, rec.NumRows()))
+
+	exp := run(t, shared.NewConfig("").AddFields("../example/exac.vcf.gz", []string{"AN_Adj"}, []string{"self"}, []string{"an"}))
+	got := run(t, shared.NewConfig("").AddFields(dir, []string{"an"}, []string{"self"}, []string{"an"}))
+	if strings.Join(exp, "\n") != strings.Join(got, "\n") {
+		t.Fatal("partitioned output differs from VCF")
+	}
+}
+
+// TestIntervals checks a table without ref and alt columns against the BED it was made from.
+func TestIntervals(t *testing.T) {
+	rdr, err := xopen.Ropen("../example/fitcons.bed.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	sch := arrow.NewSchema([]arrow.Field{
+		{Name: "chrom", Type: arrow.BinaryTypes.String},
+		{Name: "pos", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "end", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "row", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "score", Type: arrow.PrimitiveTypes.Float64},
+	}, nil)
+	b := array.NewRecordBuilder(memory.DefaultAllocator, sch)
+	var first []string
+	for i := int64(0); ; i++ {
+		line, err := rdr.ReadString('\n')
+		if line == "" {
+			break
+		}
+		toks := strings.Split(strings.TrimSpace(line), "\t")
+		if first == nil {
+			first = toks
+		}
+		start, _ := strconv.ParseInt(toks[1], 10, 64)
+		end, _ := strconv.ParseInt(toks[2], 10, 64)
+		score, _ := strconv.ParseFloat(toks[3], 64)
+		b.Field(0).(*array.StringBuilder).Append(toks[0])
+		b.Field(1).(*array.Int64Builder).Append(start + 1)
+		b.Field(2).(*array.Int64Builder).Append(end)
+		b.Field(3).(*array.Int64Builder).Append(i)
+		b.Field(4).(*array.Float64Builder).Append(score)
+		if err != nil {
+			break
+		}
+	}
+	rec := b.NewRecord()
+	dir := t.TempDir()
+	writeParquet(t, filepath.Join(dir, "fitcons.parquet"), rec)
+	writeIPC(t, filepath.Join(dir, "fitcons.arrow"), rec)
+
+	// as for the BED, the first columns are the chrom, 0-based start and end.
+	tbl, err := Open(filepath.Join(dir, "fitcons.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.SelectFields([]string{"score"}); err != nil {
+		t.Fatal(err)
+	}
+	start, _ := strconv.Atoi(first[1])
+	it, err := tbl.Query(parsers.NewInterval(first[0], uint32(start), uint32(start+1), nil, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := r.(*parsers.Interval).Fields; string(f[0]) != first[0] || string(f[1]) != first[1] || string(f[2]) != first[2] {
+		t.Errorf("expected columns %v, got %s", first[:3], f[:3])
+	}
+	it.Close()
+	tbl.Close()
+
+	exp := run(t, shared.NewConfig("").AddColumns("../example/fitcons.bed.gz", []int{4}, []string{"mean"}, []string{"sc"}))
+	for _, f := range []string{"fitcons.parquet", "fitcons.arrow"} {
+		got := run(t, shared.NewConfig(dir).AddFields(f, []string{"row", "score"}, []string{"max", "mean"}, []string{"row", "sc"}))
+		if len(exp) != len(got) {
+			t.Fatalf("%s: expected %d variants, got %d", f, len(exp), len(got))
+		}
+		annotated := 0
+		for i := range exp {
+			info := strings.Split(strings.Split(exp[i], "\t")[7], ";")
+			sc := info[len(info)-1]
+			if !strings.HasPrefix(sc, "sc=") {
+				continue
+			}
+			if !strings.Contains(got[i], ";row=") || !strings.HasSuffix(strings.Split(got[i], "\t")[7], ";"+sc) {
+				t.Fatalf("%s: line %d differs:\n%s\n%s", f, i, exp[i], got[i])
+			}
+			annotated++
+		}
+		if annotated == 0 {
+			t.Fatalf("%s: expected annotated variants", f)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package columnar
+
+import (
+	"os"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+)
+
+type ipcFile struct {
+	f *os.File
+	r *ipc.FileReader
+}
+
+func (p *ipcFile) schema() *arrow.Schema { return p.r.Schema() }
+
+func (p *ipcFile) Close() error {
+	p.r.Close()
+	return p.f.Close()
+}
+
+func (p *ipcFile) read(i int, columns []string) ([]arrow.Array, error) {
+	rec, err := p.r.RecordAt(i)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]arrow.Array, len(columns))
+	for k, c := range columns {
+		if idx := rec.Schema().FieldIndices(c); c != "" && len(idx) > 0 {
+			out[k] = rec.Column(idx[0])
+		}
+	}
+	return out, nil
+}
+
+// addIPC adds a chunk for each record batch of the Arrow IPC file at path. An IPC file has no
+// statistics so the coordinates of each batch are read to find its range.
+func (t *Table) addIPC(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	r, err := ipc.NewFileReader(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	p := &ipcFile{f: f, r: r}
+	t.sources = append(t.sources, p)
+
+	sch := r.Schema()
+	var names [nCoords]string
+	for i, n := range [][]string{chromNames, posNames, endNames, refNames, altNames} {
+		names[i] = find(sch, n)
+	}
+	if names[colPos] == "" {
+		// reported by init.
+		return nil
+	}
+	for i := 0; i < r.NumRecords(); i++ {
+		arrs, err := p.read(i, names[:])
+		if err != nil {
+			return err
+		}
+		c := &chunk{src: p, idx: i}
+		l := &loaded{c: c}
+		copy(l.coords[:], arrs)
+		if err := l.index(); err != nil {
+			return err
+		}
+		if l.len() > 0 {
+			c.hasPos = true
+			c.posMin, c.posMax = l.pos(0), l.pos(0)
+			for k := 0; k < l.len(); k++ {
+				if p := l.pos(k); p < c.posMin {
+					c.posMin = p
+				} else if p > c.posMax {
+					c.posMax = p
+				}
+			}
+			for chrom := range l.chroms {
+				if c.chromMin == "" || chrom < c.chromMin {
+					c.chromMin = chrom
+				}
+				if chrom > c.chromMax {
+					c.chromMax = chrom
+				}
+			}
+			c.maxEnd.Store(l.maxEnd)
+		}
+		t.chunks = append(t.chunks, c)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package columnar
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/metadata"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+)
+
+type parquetFile struct {
+	mu  sync.Mutex
+	pf  *file.Reader
+	fr  *pqarrow.FileReader
+	sch *arrow.Schema
+	// leaves are the parquet column indexes of each top-level field.
+	leaves map[string][]int
+}
+
+func (p *parquetFile) schema() *arrow.Schema { return p.sch }
+
+func (p *parquetFile) Close() error { return p.pf.Close() }
+
+func (p *parquetFile) read(rg int, columns []string) ([]arrow.Array, error) {
+	var idxs []int
+	pos := make([]int, len(columns))
+	for i, c := range columns {
+		pos[i] = -1
+		if l, ok := p.leaves[c]; ok && c != "" {
+			pos[i] = len(idxs)
+			idxs = append(idxs, l...)
+		}
+	}
+	p.mu.Lock()
+	tbl, err := p.fr.ReadRowGroups(context.Background(), idxs, []int{rg})
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer tbl.Release()
+
+	// fields are returned in schema order so they are matched by name.
+	byName := make(map[string]arrow.Array, tbl.NumCols())
+	for i := 0; i < int(tbl.NumCols()); i++ {
+		a, err := array.Concatenate(tbl.Column(i).Data().Chunks(), memory.DefaultAllocator)
+		if err != nil {
+			return nil, err
+		}
+		byName[tbl.Column(i).Name()] = a
+	}
+	out := make([]arrow.Array, len(columns))
+	for i, c := range columns {
+		if pos[i] != -1 {
+			out[i] = byName[c]
+		}
+	}
+	return out, nil
+}
+
+// partitionChrom gives the chrom from a hive-style path such as chrom=1/part-0.parquet.
+func partitionChrom(path string) string {
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if i := strings.Index(part, "="); i != -1 {
+			for _, n := range chromNames {
+				if strings.EqualFold(part[:i], n) {
+					return part[i+1:]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// openDir adds all of the parquet files under dir.
+func (t *Table) openDir(dir string) error {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(path)
+		if !info.IsDir() && strings.HasSuffix(path, ".parquet") && !strings.HasPrefix(base, ".") && !strings.HasPrefix(base, "_") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		rel, _ := filepath.Rel(dir, path)
+		if err := t.addParquet(path, partitionChrom(rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addParquet adds a chunk for each row group of the file at path using the column
+// statistics for chrom and pos.
+func (t *Table) addParquet(path string, partition string) error {
+	pf, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		return err
+	}
+	fr, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{BatchSize: 64 * 1024}, memory.DefaultAllocator)
+	if err != nil {
+		pf.Close()
+		return err
+	}
+	sch, err := fr.Schema()
+	if err != nil {
+		pf.Close()
+		return err
+	}
+	p := &parquetFile{pf: pf, fr: fr, sch: sch, leaves: make(map[string][]int)}
+	meta := pf.MetaData()
+	for i := 0; i < meta.Schema.NumColumns(); i++ {
+		name := meta.Schema.Column(i).ColumnPath()[0]
+		p.leaves[name] = append(p.leaves[name], i)
+	}
+	t.sources = append(t.sources, p)
+
+	chrom, pos, end := find(sch, chromNames), find(sch, posNames), find(sch, endNames)
+	for rg := 0; rg < meta.NumRowGroups(); rg++ {
+		c := &chunk{src: p, idx: rg, partition: partition}
+		if partition == "" && chrom != "" && len(p.leaves[chrom]) == 1 {
+			if s := stats(meta.RowGroup(rg), p.leaves[chrom][0]); s != nil {
+				if b, ok := s.(*metadata.ByteArrayStatistics); ok && b.HasMinMax() {
+					c.chromMin, c.chromMax = string(b.Min()), string(b.Max())
+				}
+			}
+		}
+		if pos != "" && len(p.leaves[pos]) == 1 {
+			c.posMin, c.posMax, c.hasPos = intStats(meta.RowGroup(rg), p.leaves[pos][0])
+		}
+		if end != "" && len(p.leaves[end]) == 1 {
+			if _, m, ok := intStats(meta.RowGroup(rg), p.leaves[end][0]); ok {
+				c.maxEnd.Store(m)
+			}
+		}
+		t.chunks = append(t.chunks, c)
+	}
+	return nil
+}
+
+func stats(rg *metadata.RowGroupMetaData, col int) metadata.TypedStatistics {
+	cc, err := rg.ColumnChunk(col)
+	if err != nil {
+		return nil
+	}
+	if ok, err := cc.StatsSet(); !ok || err != nil {
+		return nil
+	}
+	s, err := cc.Statistics()
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+func intStats(rg *metadata.RowGroupMetaData, col int) (int64, int64, bool) {
+	switch s := stats(rg, col).(type) {
+	case *metadata.Int32Statistics:
+		if s.HasMinMax() {
+			return int64(s.Min()), int64(s.Max()), true
+		}
+	case *metadata.Int64Statistics:
+		if s.HasMinMax() {
+			return s.Min(), s.Max(), true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,296 @@
+// Package consequence gives the consequence of a variant on the transcripts of a GTF
+// (e.g. from GENCODE or Ensembl) using the reference sequence. Importing the package
+// registers it as a VariantSource for files starting with Prefix.
+//
+// The only field is Field which gives, for each ALT and each transcript that it
+// overlaps, the record of the alt in Format. The Consequence is one or more Sequence
+// Ontology terms joined by & (e.g. missense_variant&splice_region_variant). For a change
+// to the CDS that is within one exon, the Codons (with the changed bases in upper case),
+// Amino_acids and Protein_position are also given. Records are joined by commas. The
+// transcripts are read from the exon, CDS and stop_codon features and are grouped by
+// transcript_id.
+package consequence
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/vcfanno/api"
+	"github.com/brentp/vcfanno/fasta"
+	"github.com/brentp/vcfanno/gff"
+)
+
+// Prefix is the start of the File of a source of consequences. The path of the GTF
+// follows it, e.g. "consequence:gencode.gtf.gz".
+const Prefix = "consequence:"
+
+// Field is the field of the consequence records.
+const Field = "csq"
+
+// Format gives the parts of a record which are separated by |.
+const Format = "Allele|Consequence|Gene|Transcript|Biotype|Codons|Amino_acids|Protein_position"
+
+// Reference gives the sequence of the genome. fasta.Reader meets it.
+type Reference interface {
+	// Seq gives the upper-case sequence of [start, end) on chrom clipped to the contig.
+	Seq(chrom string, start, end int) (seq string, ok bool, err error)
+}
+
+// Transcript is a model of a transcript from a GTF. Exons and CDS are 0-based, half-open
+// and sorted by start. CDS includes the stop codon.
+type Transcript struct {
+	ID, Gene, Biotype string
+	Chrom             string
+	// Strand is '+' or '-'.
+	Strand     byte
+	Start, End int
+	Exons, CDS [][2]int
+
+	once   sync.Once
+	cds    string
+	cdsErr error
+}
+
+// maxPos is past the end of any contig in a tabix index.
+const maxPos = 1 << 29
+
+// cacheSize is the number of contigs whose transcripts are kept in memory.
+const cacheSize = 4
+
+// contig holds the transcripts of a contig sorted by start. They are read once, outside
+// of the lock of the Models, so that variants on other contigs are not blocked.
+type contig struct {
+	name string
+	once sync.Once
+	err  error
+	ts   []*Transcript
+	// maxLen is the length of the longest transcript.
+	maxLen int
+}
+
+// Models are the transcripts of a GTF. The transcripts of a contig are read the first
+// time that it is used. It meets api.VariantSource and is safe for concurrent use.
+type Models struct {
+	path string
+	file *gff.File
+	ref  Reference
+
+	mu sync.Mutex
+	// contigs are the most recently used first.
+	contigs []*contig
+}
+
+// Open opens the tabix-indexed GTF at path. ref is used for the coding sequence.
+func Open(path string, ref Reference) (*Models, error) {
+	if !strings.HasSuffix(path, ".gtf.gz") {
+		return nil, fmt.Errorf("%s: expected a bgzipped GTF ending in .gtf.gz", path)
+	}
+	if ref == nil {
+		return nil, fmt.Errorf("%s: a reference is required (use -fasta or fasta=)", path)
+	}
+	f, err := gff.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Models{path: path, file: f, ref: ref}, nil
+}
+
+// Close closes the GTF.
+func (m *Models) Close() error {
+	return m.file.Close()
+}
+
+// Contigs gives the contigs of the GTF.
+func (m *Models) Contigs() []api.Contig {
+	return m.file.Contigs()
+}
+
+// Header gives the header of Field with the Format of the records.
+func (m *Models) Header(field string) (string, string, string) {
+	if field != Field {
+		return "", "", ""
+	}
+	return "String", ".", fmt.Sprintf("Consequence annotations from %s. Format: %s", m.path, Format)
+}
+
+// contig gives the transcripts of chrom, reading them if needed.
+func (m *Models) contig(chrom string) (*contig, error) {
+	m.mu.Lock()
+	var c *contig
+	for i, o := range m.contigs {
+		if o.name == chrom {
+			copy(m.contigs[1:i+1], m.contigs[:i])
+			m.contigs[0], c = o, o
+			break
+		}
+	}
+	if c == nil {
+		c = &contig{name: chrom}
+		m.contigs = append([]*contig{c}, m.contigs...)
+		if len(m.contigs) > cacheSize {
+			m.contigs = m.contigs[:cacheSize]
+		}
+	}
+	m.mu.Unlock()
+
+	c.once.Do(func() {
+		feats, err := m.file.Features(chrom, 0, maxPos)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.ts = transcripts(feats)
+		for _, t := range c.ts {
+			if l := t.End - t.Start; l > c.maxLen {
+				c.maxLen = l
+			}
+		}
+	})
+	return c, c.err
+}
+
+// transcripts groups the exon, CDS and stop_codon features by transcript_id.
+func transcripts(feats []gff.Feature) []*Transcript {
+	byID := make(map[string]*Transcript)
+	var ts []*Transcript
+	for _, f := range feats {
+		id := f.Attributes["transcript_id"]
+		if id == "" || (f.Type != "exon" && f.Type != "CDS" && f.Type != "stop_codon") {
+			continue
+		}
+		t, ok := byID[id]
+		if !ok {
+			t = &Transcript{ID: id, Chrom: f.Chrom, Strand: f.Strand, Gene: first(f.Attributes, "gene_name", "gene_id"),
+				Biotype: first(f.Attributes, "transcript_type", "transcript_biotype", "gene_type", "gene_biotype")}
+			byID[id] = t
+			ts = append(ts, t)
+		}
+		if f.Type == "exon" {
+			t.Exons = append(t.Exons, [2]int{f.Start, f.End})
+		} else {
+			t.CDS = append(t.CDS, [2]int{f.Start, f.End})
+		}
+	}
+	for _, t := range ts {
+		t.Exons, t.CDS = merge(t.Exons), merge(t.CDS)
+		if len(t.Exons) == 0 {
+			t.Exons = t.CDS
+		}
+		t.Start, t.End = t.Exons[0][0], t.Exons[len(t.Exons)-1][1]
+		if t.Strand != '-' {
+			t.Strand = '+'
+		}
+	}
+	sort.SliceStable(ts, func(i, j int) bool { return ts[i].Start < ts[j].Start })
+	return ts
+}
+
+func first(attrs map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := attrs[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// merge sorts the intervals and joins those that overlap or touch (e.g. a CDS and its
+// stop codon).
+func merge(ivs [][2]int) [][2]int {
+	sort.Slice(ivs, func(i, j int) bool { return ivs[i][0] < ivs[j][0] })
+	var out [][2]int
+	for _, iv := range ivs {
+		if n := len(out); n > 0 && iv[0] <= out[n-1][1] {
+			if iv[1] > out[n-1][1] {
+				out[n-1][1] = iv[1]
+			}
+			continue
+		}
+		out = append(out, iv)
+	}
+	return out
+}
+
+// overlapping gives the transcripts that contain a base in [start, end) or, for an
+// insertion (start == end), the bases on each side of it.
+func (m *Models) overlapping(chrom string, start, end int) ([]*Transcript, error) {
+	c, err := m.contig(chrom)
+	if err != nil {
+		return nil, err
+	}
+	if end == start {
+		start, end = start-1, end+1
+	}
+	var out []*Transcript
+	i := sort.Search(len(c.ts), func(i int) bool { return c.ts[i].Start > start-c.maxLen })
+	for ; i < len(c.ts) && c.ts[i].Start < end; i++ {
+		if c.ts[i].End > start {
+			out = append(out, c.ts[i])
+		}
+	}
+	return out, nil
+}
+
+func isSequence(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case 'A', 'C', 'G', 'T', 'N':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Value gives the consequence records of v or nil if it has no ALT that is a sequence.
+func (m *Models) Value(field string, v interfaces.IVariant) (interface{}, error) {
+	if field != Field {
+		return nil, fmt.Errorf("unknown field %s for %s%s", field, Prefix, m.path)
+	}
+	var recs []string
+	for _, alt := range v.Alt() {
+		ref, a := strings.ToUpper(v.Ref()), strings.ToUpper(alt)
+		if !isSequence(ref) || !isSequence(a) || ref == a {
+			continue
+		}
+		// trimmed as for matching (suffix first) so that the allele is the same as in the
+		// identifiers (e.g. spdi) of v.
+		p, ref, a := api.TrimAllele(v.Start(), ref, a)
+		pos := int(p)
+		ts, err := m.overlapping(v.Chrom(), pos, pos+len(ref))
+		if err != nil {
+			return nil, err
+		}
+		if len(ts) == 0 {
+			recs = append(recs, alt+"|intergenic_variant||||||")
+			continue
+		}
+		for _, t := range ts {
+			c, err := t.consequence(m.ref, pos, ref, a)
+			if err != nil {
+				return nil, err
+			}
+			recs = append(recs, strings.Join([]string{alt, strings.Join(c.terms, "&"), t.Gene, t.ID, t.Biotype,
+				c.codons, c.aminoAcids, c.position}, "|"))
+		}
+	}
+	if len(recs) == 0 {
+		return nil, nil
+	}
+	return strings.Join(recs, ","), nil
+}
+
+func init() {
+	open := func(path string, ref *fasta.Reader) (api.VariantSource, error) {
+		if ref == nil {
+			return Open(path, nil)
+		}
+		return Open(path, ref)
+	}
+	if err := api.RegisterVariantSource(Prefix, open); err != nil {
+		panic(err)
+	}
+}
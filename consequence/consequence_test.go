@@ -0,0 +1,116 @@
+package consequence
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/brentp/vcfanno/fasta"
+	"github.com/brentp/vcfgo"
+)
+
+func open(t *testing.T) *Models {
+	ref, err := fasta.Open("../example/genes.fa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ref.Close() })
+	m, err := Open("../example/genes.gtf.gz", ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestValue(t *testing.T) {
+	m := open(t)
+	for _, c := range []struct {
+		chrom    string
+		pos      uint64
+		ref, alt string
+		exp      string
+	}{
+		{"1", 1104, "G", "A", "A|missense_variant|GENE1|T1|protein_coding|Gct/Act|A/T|2"},
+		{"1", 1108, "G", "A", "A|stop_gained|GENE1|T1|protein_coding|tGg/tAg|W/*|3"},
+		{"1", 1101, "A", "G", "G|start_lost|GENE1|T1|protein_coding|Atg/Gtg|M/V|1"},
+		{"1", 1112, "A", "G", "G|synonymous_variant|GENE1|T1|protein_coding|aaA/aaG|K|4"},
+		// the shared suffix is trimmed first, as for the spdi of the variant, so the
+		// deletions start at the first base of codon 4.
+		{"1", 1110, "AA", "A", "A|frameshift_variant|GENE1|T1|protein_coding|Aaa/aa|K/X|4"},
+		{"1", 1110, "AAAA", "A", "A|inframe_deletion|GENE1|T1|protein_coding|AAA/-|K/-|4"},
+		{"1", 1112, "A", "AGGG", "AGGG|inframe_insertion|GENE1|T1|protein_coding|-/GGG|-/G|4-5"},
+		{"1", 1198, "A", "G", "G|missense_variant&splice_region_variant|GENE1|T1|protein_coding|aAa/aGa|K/R|33"},
+		{"1", 1050, "C", "T", "T|5_prime_UTR_variant|GENE1|T1|protein_coding|||"},
+		{"1", 1500, "C", "T", "T|intron_variant|GENE1|T1|protein_coding|||"},
+		{"1", 1201, "C", "T", "T|splice_donor_variant|GENE1|T1|protein_coding|||"},
+		{"1", 1799, "C", "T", "T|splice_acceptor_variant|GENE1|T1|protein_coding|||"},
+		{"1", 1950, "C", "T", "T|3_prime_UTR_variant|GENE1|T1|protein_coding|||"},
+		{"1", 5799, "A", "G", "G|start_lost|GENE2|T2|protein_coding|aTg/aCg|M/T|1"},
+		{"1", 5797, "C", "A", "A|stop_gained|GENE2|T2|protein_coding|Gaa/Taa|E/*|2"},
+		{"1", 3000, "C", "T", "T|intergenic_variant||||||"},
+		{"2", 150, "G", "A", "A|non_coding_transcript_exon_variant|GENE3|T3|lncRNA|||"},
+	} {
+		v := &vcfgo.Variant{Chromosome: c.chrom, Pos: c.pos, Reference: c.ref, Alternate: []string{c.alt}}
+		val, err := m.Value(Field, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != c.exp {
+			t.Errorf("%s:%d %s>%s: expected %s, got %v", c.chrom, c.pos, c.ref, c.alt, c.exp, val)
+		}
+	}
+
+	v := &vcfgo.Variant{Chromosome: "1", Pos: 1104, Reference: "G", Alternate: []string{"A", "<DEL>", "T"}}
+	if val, err := m.Value(Field, v); err != nil || strings.Count(val.(string), ",") != 1 {
+		t.Errorf("expected 2 records, got %v (%v)", val, err)
+	}
+	v.Alternate = []string{"<DEL>"}
+	if val, err := m.Value(Field, v); err != nil || val != nil {
+		t.Errorf("expected no records for a symbolic allele, got %v (%v)", val, err)
+	}
+	if _, err := m.Value("gene", v); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	m := open(t)
+	// variants on interleaved contigs as with -unsorted.
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v := &vcfgo.Variant{Chromosome: "1", Pos: 1104, Reference: "G", Alternate: []string{"A"}}
+			exp := "A|missense_variant|GENE1|T1|protein_coding|Gct/Act|A/T|2"
+			if i%2 == 1 {
+				v = &vcfgo.Variant{Chromosome: "2", Pos: 150, Reference: "G", Alternate: []string{"A"}}
+				exp = "A|non_coding_transcript_exon_variant|GENE3|T3|lncRNA|||"
+			}
+			if val, err := m.Value(Field, v); err != nil || val != exp {
+				t.Errorf("expected %s, got %v (%v)", exp, val, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(m.contigs) != 2 {
+		t.Errorf("expected each contig to be read once, got %d", len(m.contigs))
+	}
+}
+
+func TestHeader(t *testing.T) {
+	m := open(t)
+	if htype, number, desc := m.Header(Field); htype != "String" || number != "." || !strings.HasSuffix(desc, "Format: "+Format) {
+		t.Errorf("unexpected header %s %s %s", htype, number, desc)
+	}
+	if htype, _, _ := m.Header("gene"); htype != "" {
+		t.Errorf("expected no header for an unknown field, got %s", htype)
+	}
+	if _, err := Open("../example/genes.gff3.gz", nil); err == nil {
+		t.Error("expected an error for a GFF3")
+	}
+	if _, err := Open("../example/genes.gtf.gz", nil); err == nil {
+		t.Error("expected an error without a reference")
+	}
+}
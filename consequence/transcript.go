@@ -0,0 +1,323 @@
+package consequence
+
+import (
+	"fmt"
+	"strings"
+)
+
+// result is the consequence of an allele on a transcript. The codons, amino acids and
+// position are only given for a change to the CDS.
+type result struct {
+	terms                        []string
+	codons, aminoAcids, position string
+}
+
+// splice sites are the 2 intronic bases at each end of an intron. The splice region is
+// up to 3 exonic and 8 intronic bases from the ends.
+const (
+	spliceSite       = 2
+	spliceRegionExon = 3
+	spliceRegion     = 8
+)
+
+// consequence gives the result of replacing ref (which may be empty for an insertion)
+// at the 0-based pos with alt. ref and alt share no first or last base.
+func (t *Transcript) consequence(r Reference, pos int, ref, alt string) (result, error) {
+	end := pos + len(ref)
+	// hits indicates that the allele changes a base in [s, e) or, for an insertion, that
+	// the bases on each side of it are in [s, e).
+	hits := func(s, e int) bool {
+		if len(ref) == 0 {
+			return s < pos && pos < e
+		}
+		return pos < e && end > s
+	}
+	// within indicates that the allele is in [s, e).
+	within := func(s, e int) bool {
+		if len(ref) == 0 {
+			return s < pos && pos < e
+		}
+		return pos >= s && end <= e
+	}
+
+	var res result
+	var donor, acceptor, region, intron bool
+	for i := 0; i+1 < len(t.Exons); i++ {
+		s, e := t.Exons[i][1], t.Exons[i+1][0]
+		left, right := hits(s, s+spliceSite), hits(e-spliceSite, e)
+		if t.Strand == '-' {
+			left, right = right, left
+		}
+		donor, acceptor = donor || left, acceptor || right
+		region = region || hits(s-spliceRegionExon, s+spliceRegion) || hits(e-spliceRegion, e+spliceRegionExon)
+		intron = intron || hits(s, e)
+	}
+	if acceptor {
+		res.terms = append(res.terms, "splice_acceptor_variant")
+	}
+	if donor {
+		res.terms = append(res.terms, "splice_donor_variant")
+	}
+
+	exon := false
+	for _, ex := range t.Exons {
+		exon = exon || hits(ex[0], ex[1])
+	}
+	if exon && len(t.CDS) > 0 {
+		cdsStart, cdsEnd := t.CDS[0][0], t.CDS[len(t.CDS)-1][1]
+		coding := false
+		for _, c := range t.CDS {
+			if within(c[0], c[1]) {
+				var err error
+				if res, err = t.codingChange(r, res, pos, ref, alt); err != nil {
+					return res, err
+				}
+				coding = true
+			}
+		}
+		if !coding {
+			for _, c := range t.CDS {
+				if hits(c[0], c[1]) {
+					res.terms = append(res.terms, "coding_sequence_variant")
+					break
+				}
+			}
+		}
+		five, three := t.hitsExons(hits, t.Start, cdsStart), t.hitsExons(hits, cdsEnd, t.End)
+		if t.Strand == '-' {
+			five, three = three, five
+		}
+		if five {
+			res.terms = append(res.terms, "5_prime_UTR_variant")
+		}
+		if three {
+			res.terms = append(res.terms, "3_prime_UTR_variant")
+		}
+	} else if exon {
+		res.terms = append(res.terms, "non_coding_transcript_exon_variant")
+	}
+	if region && !donor && !acceptor {
+		res.terms = append(res.terms, "splice_region_variant")
+	}
+	if intron && !donor && !acceptor {
+		res.terms = append(res.terms, "intron_variant")
+	}
+	if len(res.terms) == 0 {
+		res.terms = append(res.terms, "transcript_variant")
+	}
+	return res, nil
+}
+
+// hitsExons indicates that hits is true for the exonic bases in [s, e).
+func (t *Transcript) hitsExons(hits func(s, e int) bool, s, e int) bool {
+	for _, ex := range t.Exons {
+		if a, b := max(ex[0], s), min(ex[1], e); a < b && hits(a, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// codingSequence gives the sequence of the CDS in the orientation of the transcript.
+func (t *Transcript) codingSequence(r Reference) (string, error) {
+	t.once.Do(func() {
+		var b strings.Builder
+		for _, c := range t.CDS {
+			seq, ok, err := r.Seq(t.Chrom, c[0], c[1])
+			if err == nil && (!ok || len(seq) != c[1]-c[0]) {
+				err = fmt.Errorf("CDS of %s at %s:%d-%d is not in the reference", t.ID, t.Chrom, c[0]+1, c[1])
+			}
+			if err != nil {
+				t.cdsErr = err
+				return
+			}
+			b.WriteString(seq)
+		}
+		t.cds = b.String()
+		if t.Strand == '-' {
+			t.cds = revcomp(t.cds)
+		}
+	})
+	return t.cds, t.cdsErr
+}
+
+// offset gives the 0-based offset in the CDS (on the + strand) of the genomic pos which
+// must be in the CDS.
+func (t *Transcript) offset(pos int) int {
+	o := 0
+	for _, c := range t.CDS {
+		if pos < c[1] {
+			return o + pos - c[0]
+		}
+		o += c[1] - c[0]
+	}
+	return o
+}
+
+// codingChange adds the change of ref to alt at pos, which is within one CDS, to res.
+func (t *Transcript) codingChange(r Reference, res result, pos int, ref, alt string) (result, error) {
+	cds, err := t.codingSequence(r)
+	if err != nil {
+		return res, err
+	}
+	// c is the offset of the change in the CDS of the transcript.
+	var c int
+	switch {
+	case t.Strand == '+':
+		c = t.offset(pos)
+	case len(ref) == 0:
+		c = len(cds) - 1 - t.offset(pos-1)
+	default:
+		c = len(cds) - 1 - t.offset(pos+len(ref)-1)
+	}
+	if t.Strand == '-' {
+		ref, alt = revcomp(ref), revcomp(alt)
+	}
+	mut := cds[:c] + alt + cds[c+len(ref):]
+
+	// the codons from the first that is changed to the last that holds a changed base.
+	s, e := c/3*3, (c+len(ref)+2)/3*3
+	if e > len(cds) {
+		e = len(cds)
+	}
+	diff := len(alt) - len(ref)
+	ae := e + diff
+	if ae < s {
+		ae = s
+	}
+	if ae > len(mut) {
+		ae = len(mut)
+	}
+	refCodons, altCodons := cds[s:e], mut[s:ae]
+	res.codons = markCodons(refCodons, c-s, len(ref)) + "/" + markCodons(altCodons, c-s, len(alt))
+
+	code := standardCode
+	if isMito(t.Chrom) {
+		code = mitoCode
+	}
+	refAA, altAA := translate(refCodons, code), translate(altCodons, code)
+	switch {
+	case e == s:
+		res.position = fmt.Sprintf("%d-%d", s/3, s/3+1)
+	case e-s == 3:
+		res.position = fmt.Sprint(s/3 + 1)
+	default:
+		res.position = fmt.Sprintf("%d-%d", s/3+1, e/3)
+	}
+
+	refStop, altStop := strings.Contains(refAA, "*"), strings.Contains(altAA, "*")
+	if diff%3 != 0 {
+		res.terms = append(res.terms, "frameshift_variant")
+		res.aminoAcids = orDash(refAA) + "/X"
+		return res, nil
+	}
+	if refAA == altAA {
+		res.aminoAcids = refAA
+		if refStop {
+			res.terms = append(res.terms, "stop_retained_variant")
+		} else {
+			res.terms = append(res.terms, "synonymous_variant")
+		}
+		return res, nil
+	}
+	res.aminoAcids = orDash(refAA) + "/" + orDash(altAA)
+	n := len(res.terms)
+	switch {
+	case altStop && !refStop:
+		res.terms = append(res.terms, "stop_gained")
+	case refStop && !altStop:
+		res.terms = append(res.terms, "stop_lost")
+	}
+	if s == 0 && strings.HasPrefix(refAA, "M") && !strings.HasPrefix(altAA, "M") {
+		res.terms = append(res.terms, "start_lost")
+	}
+	switch {
+	case diff > 0:
+		res.terms = append(res.terms, "inframe_insertion")
+	case diff < 0:
+		res.terms = append(res.terms, "inframe_deletion")
+	case len(res.terms) == n:
+		res.terms = append(res.terms, "missense_variant")
+	}
+	return res, nil
+}
+
+// markCodons gives codons in lower case except for the n bases from i.
+func markCodons(codons string, i, n int) string {
+	if codons == "" {
+		return "-"
+	}
+	b := []byte(strings.ToLower(codons))
+	for k := i; k < i+n && k < len(b); k++ {
+		b[k] = codons[k]
+	}
+	return string(b)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// The genetic codes by codon in the order TTT, TTC, TTA, TTG, TCT, ... GGG.
+const (
+	standardCode = "FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"
+	mitoCode     = "FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIMMTTTTNNKKSS**VVVVAAAADDEEGGGG"
+)
+
+func isMito(chrom string) bool {
+	switch strings.TrimPrefix(chrom, "chr") {
+	case "M", "MT":
+		return true
+	}
+	return false
+}
+
+// translate gives the amino acids of seq with X for an incomplete codon or one with N.
+func translate(seq string, code string) string {
+	b := make([]byte, 0, (len(seq)+2)/3)
+	for i := 0; i < len(seq); i += 3 {
+		if i+3 > len(seq) {
+			b = append(b, 'X')
+			break
+		}
+		k := 0
+		for _, c := range []byte(seq[i : i+3]) {
+			n := strings.IndexByte("TCAG", c)
+			if n == -1 {
+				k = -1
+				break
+			}
+			k = k*4 + n
+		}
+		if k == -1 {
+			b = append(b, 'X')
+		} else {
+			b = append(b, code[k])
+		}
+	}
+	return string(b)
+}
+
+func revcomp(s string) string {
+	b := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		var c byte
+		switch s[i] {
+		case 'A':
+			c = 'T'
+		case 'C':
+			c = 'G'
+		case 'G':
+			c = 'C'
+		case 'T':
+			c = 'A'
+		default:
+			c = 'N'
+		}
+		b[len(s)-1-i] = c
+	}
+	return string(b)
+}
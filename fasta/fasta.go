@@ -0,0 +1,366 @@
+// Package fasta reads an indexed reference FASTA and computes annotations (e.g. GC
+// content) from the reference sequence around a variant.
+package fasta
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/biogo/hts/fai"
+)
+
+// Prefix is the start of the File of an annotation that is computed from a reference.
+// The path of the FASTA follows it, e.g. "fasta:ref.fa".
+const Prefix = "fasta:"
+
+// ErrCompressed occurs for a gzipped FASTA which can not be read by position.
+var ErrCompressed = errors.New("compressed FASTA is not supported (decompress it and index it with samtools faidx)")
+
+// Reader gives the sequence of an uncompressed FASTA by position. It is safe for
+// concurrent use.
+type Reader struct {
+	f    *os.File
+	file *fai.File
+
+	mu      sync.Mutex
+	digests map[string]*digest
+}
+
+// digest is the refget digest of a sequence which is computed once.
+type digest struct {
+	once sync.Once
+	val  string
+	err  error
+}
+
+// Open opens the FASTA at path using the index at path.fai or, if there is none, an
+// index that is built by reading the file.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 2)
+	if n, _ := f.ReadAt(magic, 0); n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, ErrCompressed)
+	}
+	var idx fai.Index
+	if fi, ferr := os.Open(path + ".fai"); ferr == nil {
+		idx, err = fai.ReadFrom(fi)
+		fi.Close()
+	} else {
+		idx, err = fai.NewIndex(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &Reader{f: f, file: fai.NewFile(f, idx), digests: make(map[string]*digest)}, nil
+}
+
+// Close closes the FASTA.
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
+
+// name gives the name of chrom in the FASTA, adding or removing a chr prefix if needed.
+func (r *Reader) name(chrom string) (string, bool) {
+	if _, ok := r.file.Index[chrom]; ok {
+		return chrom, true
+	}
+	other := "chr" + chrom
+	if strings.HasPrefix(chrom, "chr") {
+		other = chrom[3:]
+	}
+	_, ok := r.file.Index[other]
+	return other, ok
+}
+
+// Length gives the length of chrom or -1 if it is not in the FASTA.
+func (r *Reader) Length(chrom string) int {
+	name, ok := r.name(chrom)
+	if !ok {
+		return -1
+	}
+	return r.file.Index[name].Length
+}
+
+// Contigs gives the name and length of each sequence in the order of the FASTA.
+func (r *Reader) Contigs() ([]string, []int) {
+	recs := make([]fai.Record, 0, len(r.file.Index))
+	for _, rec := range r.file.Index {
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Start < recs[j].Start })
+	names, lengths := make([]string, len(recs)), make([]int, len(recs))
+	for i, rec := range recs {
+		names[i], lengths[i] = rec.Name, rec.Length
+	}
+	return names, lengths
+}
+
+// Seq gives the upper-case sequence of [start, end) on chrom, clipped to the ends of
+// the contig. ok is false if chrom is not in the FASTA.
+func (r *Reader) Seq(chrom string, start, end int) (seq string, ok bool, err error) {
+	name, ok := r.name(chrom)
+	if !ok {
+		return "", false, nil
+	}
+	l := r.file.Index[name].Length
+	if start < 0 {
+		start = 0
+	}
+	if end > l {
+		end = l
+	}
+	if end <= start {
+		return "", true, nil
+	}
+	s, err := r.file.SeqRange(name, start, end)
+	if err != nil {
+		return "", true, err
+	}
+	b, err := io.ReadAll(s)
+	if err != nil {
+		return "", true, err
+	}
+	return string(bytes.ToUpper(b)), true, nil
+}
+
+// Refget gives the refget (GA4GH) digest, SQ.<sha512t24u>, of the upper-case sequence
+// of chrom. It reads the whole sequence the first time it is called for chrom.
+func (r *Reader) Refget(chrom string) (string, error) {
+	name, ok := r.name(chrom)
+	if !ok {
+		return "", fmt.Errorf("%s is not in the reference", chrom)
+	}
+	r.mu.Lock()
+	d, ok := r.digests[name]
+	if !ok {
+		d = &digest{}
+		r.digests[name] = d
+	}
+	r.mu.Unlock()
+	d.once.Do(func() {
+		s, err := r.file.Seq(name)
+		if err != nil {
+			d.err = err
+			return
+		}
+		h := sha512.New()
+		buf := make([]byte, 1<<20)
+		for {
+			n, err := s.Read(buf)
+			h.Write(bytes.ToUpper(buf[:n]))
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				d.err = err
+				return
+			}
+		}
+		d.val = "SQ." + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:24])
+	})
+	return d.val, d.err
+}
+
+// Fields computed from the reference. Context and GC may be followed by a number of
+// bases, e.g. context10 or gc100.
+const (
+	// Context is the sequence from N bases before to N bases after REF (default 1).
+	Context = "context"
+	// GC is the fraction of G and C in the N bases centered on the variant (default 50).
+	GC = "gc"
+	// Homopolymer is the length of the run of the base at the variant.
+	Homopolymer = "homopolymer"
+	// RepeatUnit is the shortest unit of 1 to 6 bases repeated at the variant.
+	RepeatUnit = "repeat_unit"
+	// RefMatch is 1 if REF matches the reference and 0 if it does not.
+	RefMatch = "ref_match"
+)
+
+const (
+	defaultContext = 1
+	defaultGC      = 50
+	// maxRepeat is the longest repeat unit.
+	maxRepeat = 6
+	// scan is the number of bases read on each side of the variant for homopolymer and
+	// repeat_unit. Longer runs are truncated.
+	scan = 500
+)
+
+// parseField gives the name and the number of bases of field.
+func parseField(field string) (string, int, error) {
+	for _, f := range []struct {
+		name string
+		def  int
+	}{{Context, defaultContext}, {GC, defaultGC}} {
+		if !strings.HasPrefix(field, f.name) {
+			continue
+		}
+		if field == f.name {
+			return f.name, f.def, nil
+		}
+		n, err := strconv.Atoi(field[len(f.name):])
+		if err != nil || n < 0 || (n == 0 && f.name == GC) {
+			return "", 0, fmt.Errorf("invalid number of bases for %s: %s", f.name, field)
+		}
+		return f.name, n, nil
+	}
+	switch field {
+	case Homopolymer, RepeatUnit, RefMatch:
+		return field, 0, nil
+	}
+	return "", 0, fmt.Errorf("unknown field %s (expected %s, %s, %s, %s or %s)", field, Context, GC, Homopolymer, RepeatUnit, RefMatch)
+}
+
+// CheckField checks that field can be computed.
+func CheckField(field string) error {
+	_, _, err := parseField(field)
+	return err
+}
+
+// Header gives the VCF Type, Number and Description of field.
+func Header(field string) (string, string, string) {
+	name, n, err := parseField(field)
+	if err != nil {
+		return "", "", ""
+	}
+	switch name {
+	case Context:
+		return "String", "1", fmt.Sprintf("reference sequence from %d bases before to %d bases after REF", n, n)
+	case GC:
+		return "Float", "1", fmt.Sprintf("fraction of G and C in the %d reference bases centered on the variant", n)
+	case Homopolymer:
+		return "Integer", "1", "length of the homopolymer run in the reference at the variant"
+	case RepeatUnit:
+		return "String", "1", "shortest repeat unit (of up to 6 bases) in the reference at the variant"
+	}
+	return "Integer", "1", "1 if REF matches the reference and 0 otherwise"
+}
+
+// Value computes field for the variant with ref (and alts) at the 0-based start on
+// chrom. It is nil if chrom is not in the FASTA or the value is not defined, e.g. a
+// window of only N bases for gc.
+func (r *Reader) Value(field, chrom string, start int, ref string, alts []string) (interface{}, error) {
+	name, n, err := parseField(field)
+	if err != nil {
+		return nil, err
+	}
+	end := start + len(ref)
+	switch name {
+	case Context:
+		return r.value(chrom, start-n, end+n, func(seq string) interface{} { return seq })
+	case GC:
+		s := start + len(ref)/2 - n/2
+		return r.value(chrom, s, s+n, gc)
+	case RefMatch:
+		return r.value(chrom, start, end, func(seq string) interface{} {
+			if sameSeq(seq, ref) {
+				return 1
+			}
+			return 0
+		})
+	}
+	// for an indel with a shared first base, the site is after that base.
+	site := start
+	if len(alts) > 0 && len(alts[0]) != len(ref) && len(ref) > 0 && len(alts[0]) > 0 && alts[0][0] == ref[0] {
+		site++
+	}
+	s := site - scan
+	if s < 0 {
+		s = 0
+	}
+	return r.value(chrom, s, site+scan, func(seq string) interface{} {
+		i := site - s
+		if i >= len(seq) {
+			return nil
+		}
+		if name == Homopolymer {
+			return homopolymer(seq, i)
+		}
+		return repeatUnit(seq[i:])
+	})
+}
+
+// value calls fn with the sequence of [start, end) unless chrom is not in the FASTA.
+func (r *Reader) value(chrom string, start, end int, fn func(string) interface{}) (interface{}, error) {
+	seq, ok, err := r.Seq(chrom, start, end)
+	if !ok || err != nil {
+		return nil, err
+	}
+	return fn(seq), nil
+}
+
+func gc(seq string) interface{} {
+	var n, g int
+	for i := 0; i < len(seq); i++ {
+		switch seq[i] {
+		case 'G', 'C':
+			g++
+			n++
+		case 'A', 'T':
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return float64(g) / float64(n)
+}
+
+// sameSeq compares a REF allele to the reference. N in either matches any base.
+func sameSeq(seq, ref string) bool {
+	if len(seq) != len(ref) {
+		return false
+	}
+	for i := 0; i < len(seq); i++ {
+		a, b := seq[i], ref[i]&^0x20
+		if a != b && a != 'N' && b != 'N' {
+			return false
+		}
+	}
+	return true
+}
+
+// homopolymer gives the length of the run of the base at i.
+func homopolymer(seq string, i int) interface{} {
+	b := seq[i]
+	if b == 'N' {
+		return nil
+	}
+	s, e := i, i+1
+	for s > 0 && seq[s-1] == b {
+		s--
+	}
+	for e < len(seq) && seq[e] == b {
+		e++
+	}
+	return e - s
+}
+
+// repeatUnit gives the shortest unit that is repeated at least twice at the start
+// of seq.
+func repeatUnit(seq string) interface{} {
+	for k := 1; k <= maxRepeat && 2*k <= len(seq); k++ {
+		unit := seq[:k]
+		if strings.IndexByte(unit, 'N') != -1 {
+			return nil
+		}
+		if seq[k:2*k] == unit {
+			return unit
+		}
+	}
+	return nil
+}
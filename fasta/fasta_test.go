@@ -0,0 +1,120 @@
+package fasta
+
+import (
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/biogo/hts/fai"
+)
+
+const ref = `>1 first
+ACGTAAAAAC
+GCGCGCNNNN
+>chr2
+acacacacgt
+`
+
+func TestValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ref.fa")
+	if err := os.WriteFile(path, []byte(ref), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		field, chrom string
+		start        int
+		ref, alt     string
+		exp          interface{}
+	}{
+		{"context", "1", 4, "A", "G", "TAA"},
+		{"context2", "1", 0, "AC", "A", "ACGT"},
+		{"context0", "chr1", 9, "CG", "C", "CG"},
+		{"gc4", "1", 10, "G", "A", 0.75},
+		{"gc2", "1", 18, "N", "A", nil},
+		{"gc", "2", 0, "A", "G", 0.5},
+		{"homopolymer", "1", 6, "A", "G", 5},
+		{"homopolymer", "1", 3, "T", "TA", 5},
+		{"homopolymer", "1", 3, "T", "A", 1},
+		{"repeat_unit", "1", 4, "A", "G", "A"},
+		{"repeat_unit", "2", 0, "A", "G", "AC"},
+		{"repeat_unit", "1", 10, "G", "C", "GC"},
+		{"repeat_unit", "1", 1, "C", "G", nil},
+		{"ref_match", "1", 0, "ACG", "A", 1},
+		{"ref_match", "1", 0, "acg", "A", 1},
+		{"ref_match", "1", 0, "ACT", "A", 0},
+		{"ref_match", "1", 9, "CGN", "C", 1},
+		{"ref_match", "3", 0, "A", "C", nil},
+	} {
+		val, err := r.Value(c.field, c.chrom, c.start, c.ref, []string{c.alt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != c.exp {
+			t.Errorf("%s at %s:%d: expected %v, got %v", c.field, c.chrom, c.start, c.exp, val)
+		}
+	}
+	names, lengths := r.Contigs()
+	if len(names) != 2 || names[0] != "1" || names[1] != "chr2" || lengths[0] != 20 || lengths[1] != 10 {
+		t.Errorf("bad contigs: %v %v", names, lengths)
+	}
+	r.Close()
+
+	// with an index.
+	f, err := os.Create(path + ".fai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, _ := fai.NewIndex(openFile(t, path))
+	if err := fai.WriteTo(f, idx); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if r, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := r.Value("context", "1", 9, "C", []string{"T"}); val != "ACG" {
+		t.Errorf("expected ACG across lines, got %v", val)
+	}
+	r.Close()
+}
+
+func openFile(t *testing.T, path string) *os.File {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestOpenErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ref.fa.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(ref))
+	gz.Close()
+	f.Close()
+	if _, err := Open(path); !errors.Is(err, ErrCompressed) {
+		t.Errorf("expected ErrCompressed, got %v", err)
+	}
+	for _, field := range []string{"gc0", "contextx", "gcfoo", "homopolymers", "foo"} {
+		if CheckField(field) == nil {
+			t.Errorf("expected error for %s", field)
+		}
+	}
+	for _, field := range []string{"gc50", "context", "context0", "homopolymer", "repeat_unit", "ref_match"} {
+		if err := CheckField(field); err != nil {
+			t.Errorf("unexpected error for %s: %s", field, err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Package gff provides annotations from tabix-indexed GFF3 and GTF gene models. Importing
+// the package registers it as a source for files ending in ".gff3.gz", ".gff.gz" and
+// ".gtf.gz".
+//
+// The fields of a source are the keys of attributes (column 9), e.g. gene_name or
+// transcript_id. Each feature is used like a BED interval with columns chrom, start, end
+// and then the value of each field in order. An attribute with many values (e.g. tag in
+// GTF or Dbxref in GFF3) gives them joined by commas and a missing attribute gives ".".
+// The features can be limited by type and extended upstream and downstream on their
+// strand (see api.FeatureSelector). A feature without a strand is extended as if it were
+// on the + strand.
+package gff
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/bix"
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/api"
+)
+
+// Suffixes are the endings of the files that are opened as gene models.
+var Suffixes = []string{".gff3.gz", ".gff.gz", ".gtf.gz"}
+
+// IsGFF indicates that path is a GFF3 or GTF file.
+func IsGFF(path string) bool {
+	for _, s := range Suffixes {
+		if strings.HasSuffix(path, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// File is an opened GFF3 or GTF file. It meets api.SourceBackend, api.FieldSelector and
+// api.FeatureSelector.
+type File struct {
+	*bix.Bix
+	path string
+	// gtf indicates that attributes are given as key "value"; rather than key=value.
+	gtf    bool
+	fields []string
+	// types are the feature types that are used or nil for all.
+	types                map[string]bool
+	upstream, downstream int
+}
+
+// Open opens the bgzipped GFF3 or GTF at path with its tabix index.
+func Open(path string) (*File, error) {
+	b, err := bix.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Bix: b, path: path, gtf: strings.HasSuffix(path, ".gtf.gz")}, nil
+}
+
+// SelectFields sets the attributes that give the values of each feature in order.
+func (f *File) SelectFields(fields []string) error {
+	f.fields = append([]string(nil), fields...)
+	return nil
+}
+
+// FieldColumn gives the column of the attribute field after the chrom, start and end.
+func (f *File) FieldColumn(field string) int {
+	for i, k := range f.fields {
+		if k == field {
+			return 4 + i
+		}
+	}
+	return -1
+}
+
+// SelectFeatures limits the features to types (all if empty) and sets the number of bases
+// by which each is extended.
+func (f *File) SelectFeatures(types []string, upstream, downstream int) error {
+	if upstream < 0 || downstream < 0 {
+		return fmt.Errorf("upstream and downstream must not be negative")
+	}
+	f.types = nil
+	if len(types) > 0 {
+		f.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			f.types[t] = true
+		}
+	}
+	f.upstream, f.downstream = upstream, downstream
+	return nil
+}
+
+// Header gives String for each attribute with a Number of . as it may have many values.
+func (f *File) Header(field string) (string, string, string) {
+	types := "all"
+	if f.types != nil {
+		ts := make([]string, 0, len(f.types))
+		for t := range f.types {
+			ts = append(ts, t)
+		}
+		sort.Strings(ts)
+		types = strings.Join(ts, ",")
+	}
+	return "String", ".", fmt.Sprintf("attribute %s of the %s features in %s", field, types, f.path)
+}
+
+// Contigs gives the contigs in the order of the index.
+func (f *File) Contigs() []api.Contig {
+	named, ok := f.Index.(interface{ Names() []string })
+	if !ok {
+		return nil
+	}
+	names := named.Names()
+	contigs := make([]api.Contig, len(names))
+	for i, n := range names {
+		contigs[i].Name = n
+	}
+	return contigs
+}
+
+// Query returns the (extended) features overlapping region sorted by start.
+func (f *File) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	ext := f.upstream
+	if f.downstream > ext {
+		ext = f.downstream
+	}
+	var rels features
+	err := f.each(region.Chrom(), int(region.Start())-ext, int(region.End())+ext, func(iv *parsers.Interval) {
+		if rel := f.feature(iv); rel != nil && rel.Start() < region.End() && rel.End() > region.Start() {
+			rels = append(rels, rel)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rels, func(i, j int) bool { return rels[i].Start() < rels[j].Start() })
+	return &rels, nil
+}
+
+// each calls fn with each line (of at least 9 columns) that overlaps [start, end) on
+// chrom in the order of the file.
+func (f *File) each(chrom string, start, end int, fn func(*parsers.Interval)) error {
+	if start < 0 {
+		start = 0
+	}
+	it, err := f.Bix.Query(parsers.NewInterval(chrom, uint32(start), uint32(end), nil, 0, nil))
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for {
+		r, err := it.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if iv, ok := r.(*parsers.Interval); ok && len(iv.Fields) >= 9 {
+			fn(iv)
+		}
+	}
+}
+
+// Feature is a line of a GFF3 or GTF file.
+type Feature struct {
+	Chrom string
+	// Start and End are 0-based, half-open.
+	Start, End int
+	Type       string
+	// Strand is '+', '-' or '.'.
+	Strand     byte
+	Attributes map[string]string
+}
+
+// Features gives the features that overlap [start, end) on chrom in the order of the
+// file. They are not limited or extended by SelectFeatures.
+func (f *File) Features(chrom string, start, end int) ([]Feature, error) {
+	var feats []Feature
+	err := f.each(chrom, start, end, func(iv *parsers.Interval) {
+		strand := byte('.')
+		if len(iv.Fields[6]) == 1 {
+			strand = iv.Fields[6][0]
+		}
+		feats = append(feats, Feature{Chrom: iv.Chrom(), Start: int(iv.Start()), End: int(iv.End()), Type: string(iv.Fields[2]),
+			Strand: strand, Attributes: Attributes(string(iv.Fields[8]), f.gtf)})
+	})
+	return feats, err
+}
+
+// feature gives the interval of the chrom, start, end and attributes of iv after it is
+// extended or nil if its type is not used.
+func (f *File) feature(iv *parsers.Interval) *parsers.Interval {
+	if f.types != nil && !f.types[string(iv.Fields[2])] {
+		return nil
+	}
+	start, end := int(iv.Start()), int(iv.End())
+	if len(iv.Fields[6]) == 1 && iv.Fields[6][0] == '-' {
+		start, end = start-f.downstream, end+f.upstream
+	} else {
+		start, end = start-f.upstream, end+f.downstream
+	}
+	if start < 0 {
+		start = 0
+	}
+	attrs := Attributes(string(iv.Fields[8]), f.gtf)
+	fields := make([][]byte, 3, 3+len(f.fields))
+	fields[0], fields[1], fields[2] = iv.Fields[0], []byte(strconv.Itoa(start)), []byte(strconv.Itoa(end))
+	for _, k := range f.fields {
+		v, ok := attrs[k]
+		if !ok {
+			v = "."
+		}
+		fields = append(fields, []byte(v))
+	}
+	return parsers.NewInterval(iv.Chrom(), uint32(start), uint32(end), fields, 0, nil)
+}
+
+// Attributes parses column 9 of a GFF3 (key=value;...) or GTF (key "value"; ...) line.
+// The values of a key that is given more than once are joined by commas. GFF3 values
+// are unescaped.
+func Attributes(s string, gtf bool) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		var k, v string
+		if gtf {
+			i := strings.IndexAny(kv, " \t")
+			if i == -1 {
+				continue
+			}
+			k, v = kv[:i], strings.Trim(strings.TrimSpace(kv[i+1:]), `"`)
+		} else {
+			i := strings.IndexByte(kv, '=')
+			if i == -1 {
+				continue
+			}
+			k, v = kv[:i], kv[i+1:]
+			if u, err := url.PathUnescape(v); err == nil {
+				v = u
+			}
+		}
+		if old, ok := attrs[k]; ok {
+			v = old + "," + v
+		}
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// features iterates over the features from a Query.
+type features []interfaces.Relatable
+
+func (s *features) Next() (interfaces.Relatable, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	r := (*s)[0]
+	*s = (*s)[1:]
+	return r, nil
+}
+
+func (s *features) Close() error { return nil }
+
+func init() {
+	for _, suffix := range Suffixes {
+		if err := api.RegisterBackend(suffix, func(path string, _ api.BackendOptions) (api.SourceBackend, error) { return Open(path) }); err != nil {
+			panic(err)
+		}
+	}
+}
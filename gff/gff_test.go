@@ -0,0 +1,114 @@
+package gff
+
+import (
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/brentp/irelate/parsers"
+)
+
+func TestAttributes(t *testing.T) {
+	for _, c := range []struct {
+		s   string
+		gtf bool
+		exp map[string]string
+	}{
+		{`gene_id "G1"; tag "basic"; tag "CCDS";`, true, map[string]string{"gene_id": "G1", "tag": "basic,CCDS"}},
+		{`ID=gene:G1;Name=GENE1;Dbxref=HGNC:1,MIM:2;Note=first%3B second`, false,
+			map[string]string{"ID": "gene:G1", "Name": "GENE1", "Dbxref": "HGNC:1,MIM:2", "Note": "first; second"}},
+		{"", false, map[string]string{}},
+	} {
+		if got := Attributes(c.s, c.gtf); !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("%s: expected %v, got %v", c.s, c.exp, got)
+		}
+	}
+}
+
+// query gives the start, end and fields (after chrom, start and end) of the features of f
+// that overlap [start, end) on chrom.
+func query(t *testing.T, f *File, chrom string, start, end uint32) []string {
+	it, err := f.Query(parsers.NewInterval(chrom, start, end, nil, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var out []string
+	for {
+		r, err := it.Next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		iv := r.(*parsers.Interval)
+		if string(iv.Fields[1]) != strconv.Itoa(int(iv.Start())) {
+			t.Errorf("expected the 0-based start %d in column 2, got %s", iv.Start(), iv.Fields[1])
+		}
+		// the features are given with their 1-based start as in the file.
+		s := strconv.Itoa(int(iv.Start())+1) + "-" + string(iv.Fields[2])
+		for _, v := range iv.Fields[3:] {
+			s += ":" + string(v)
+		}
+		out = append(out, s)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	for _, path := range []string{"../example/genes.gtf.gz", "../example/genes.gff3.gz"} {
+		f, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, tag := "gene_name", "tag"
+		if !f.gtf {
+			name = "Name"
+		}
+		if err := f.SelectFields([]string{name, tag}); err != nil {
+			t.Fatal(err)
+		}
+		if got := query(t, f, "1", 1149, 1150); len(got) != 4 {
+			t.Errorf("%s: expected all 4 features, got %v", path, got)
+		}
+		if err := f.SelectFeatures([]string{"transcript"}, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, exp := query(t, f, "1", 1149, 1150), []string{"1000-2000:GENE1:basic,CCDS"}; !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: expected %v, got %v", path, exp, got)
+		}
+		if err := f.SelectFeatures([]string{"exon"}, 100, 10); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			start uint32
+			exp   []string
+		}{
+			// upstream of the + strand GENE1.
+			{950, []string{"900-1210:GENE1:."}},
+			// intron.
+			{1500, nil},
+			// downstream of exon 2 of GENE1.
+			{2005, []string{"1700-2010:GENE1:."}},
+			// upstream of the - strand GENE2 but not downstream.
+			{6050, []string{"4990-6100:GENE2:."}},
+			{4900, nil},
+		} {
+			if got := query(t, f, "1", c.start, c.start+1); !reflect.DeepEqual(got, c.exp) {
+				t.Errorf("%s at %d: expected %v, got %v", path, c.start, c.exp, got)
+			}
+		}
+		if got := f.Contigs(); len(got) != 2 || got[1].Name != "2" {
+			t.Errorf("%s: unexpected contigs %v", path, got)
+		}
+		if _, _, desc := f.Header(name); !strings.Contains(desc, "exon features") {
+			t.Errorf("%s: unexpected description %s", path, desc)
+		}
+		f.Close()
+	}
+	if err := (&File{}).SelectFeatures(nil, -1, 0); err == nil {
+		t.Error("expected an error for a negative upstream")
+	}
+}
@@ -0,0 +1,222 @@
+// Package liftover reads UCSC chain files to map coordinates between genome builds.
+package liftover
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/xopen"
+)
+
+// ErrFormat occurs for a chain file that can not be parsed.
+var ErrFormat = errors.New("invalid chain file")
+
+// block is an ungapped alignment of size bases from TStart in the source to QStart in
+// the target. QStart is on the strand of the Chain.
+type block struct {
+	tStart, qStart, size uint32
+}
+
+// Chain is a single chain (alignment) from the source to the target build.
+type Chain struct {
+	TName, QName string
+	TStart, TEnd uint32
+	// QSize is used to convert positions on the - strand.
+	QSize uint32
+	// Minus is true if the target is on the reverse strand.
+	Minus  bool
+	blocks []block
+}
+
+// Chains holds the chains of a chain file by source chrom.
+type Chains struct {
+	byChrom map[string][]*Chain
+}
+
+// Open reads the (possibly gzipped) chain file at path.
+func Open(path string) (*Chains, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	cs := &Chains{byChrom: make(map[string][]*Chain)}
+	var c *Chain
+	var t, q uint32
+	br := bufio.NewReader(rdr)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		toks := strings.Fields(line)
+		switch {
+		case len(toks) == 0 || toks[0][0] == '#':
+		case toks[0] == "chain":
+			var perr error
+			if c, q, perr = parseHeader(toks); perr != nil {
+				return nil, fmt.Errorf("%w: %s line %d: %s", ErrFormat, path, n, perr)
+			}
+			t = c.TStart
+			cs.byChrom[c.TName] = append(cs.byChrom[c.TName], c)
+		case c != nil && (len(toks) == 1 || len(toks) == 3):
+			v := make([]uint32, len(toks))
+			for i, tok := range toks {
+				x, perr := strconv.ParseUint(tok, 10, 32)
+				if perr != nil {
+					return nil, fmt.Errorf("%w: %s line %d: %s", ErrFormat, path, n, perr)
+				}
+				v[i] = uint32(x)
+			}
+			c.blocks = append(c.blocks, block{tStart: t, qStart: q, size: v[0]})
+			t, q = t+v[0], q+v[0]
+			if len(v) == 3 {
+				t, q = t+v[1], q+v[2]
+			} else {
+				c = nil
+			}
+		default:
+			return nil, fmt.Errorf("%w: %s line %d: %s", ErrFormat, path, n, strings.TrimSpace(line))
+		}
+		if err != nil {
+			break
+		}
+	}
+	for _, chains := range cs.byChrom {
+		sort.Slice(chains, func(i, j int) bool { return chains[i].TStart < chains[j].TStart })
+	}
+	return cs, nil
+}
+
+// parseHeader gives the Chain and the start of the target from a header line:
+// chain score tName tSize tStrand tStart tEnd qName qSize qStrand qStart qEnd id
+func parseHeader(toks []string) (*Chain, uint32, error) {
+	if len(toks) < 12 {
+		return nil, 0, fmt.Errorf("expected 12 fields in chain header, got %d", len(toks))
+	}
+	var v [4]uint32
+	for i, k := range []int{5, 6, 8, 10} {
+		x, err := strconv.ParseUint(toks[k], 10, 32)
+		if err != nil {
+			return nil, 0, err
+		}
+		v[i] = uint32(x)
+	}
+	if toks[4] != "+" {
+		return nil, 0, fmt.Errorf("source strand must be +")
+	}
+	return &Chain{TName: toks[2], TStart: v[0], TEnd: v[1], QName: toks[7], QSize: v[2], Minus: toks[9] == "-"}, v[3], nil
+}
+
+// Interval is a 0-based, half-open interval in the target. Minus is true if it is on
+// the reverse strand relative to the source.
+type Interval struct {
+	Chrom      string
+	Start, End uint32
+	Minus      bool
+}
+
+// plus converts [s, e) on the strand of the chain to the + strand (or back).
+func (c *Chain) plus(s, e uint32) (uint32, uint32) {
+	if c.Minus {
+		return c.QSize - e, c.QSize - s
+	}
+	return s, e
+}
+
+// lift maps [start, end) if it is within a single block.
+func (c *Chain) lift(start, end uint32) (Interval, bool) {
+	i := sort.Search(len(c.blocks), func(i int) bool { return c.blocks[i].tStart+c.blocks[i].size > start })
+	if i == len(c.blocks) || c.blocks[i].tStart > start || end > c.blocks[i].tStart+c.blocks[i].size {
+		return Interval{}, false
+	}
+	b := c.blocks[i]
+	s, e := c.plus(b.qStart+start-b.tStart, b.qStart+end-b.tStart)
+	return Interval{Chrom: c.QName, Start: s, End: e, Minus: c.Minus}, true
+}
+
+// Lift maps [start, end) on chrom from the source to the target. It returns false if
+// the interval is not within a single aligned block of a chain.
+func (cs *Chains) Lift(chrom string, start, end uint32) (Interval, bool) {
+	for _, c := range cs.byChrom[chrom] {
+		if c.TStart > start {
+			break
+		}
+		if end > c.TEnd {
+			continue
+		}
+		if iv, ok := c.lift(start, end); ok {
+			return iv, true
+		}
+	}
+	return Interval{}, false
+}
+
+// Segment is the part of the target that is aligned to a region of the source by a
+// single Chain.
+type Segment struct {
+	Chain  *Chain
+	Target Interval
+}
+
+// Segments gives a Segment for each chain with a block that overlaps [start, end) on
+// chrom.
+func (cs *Chains) Segments(chrom string, start, end uint32) []Segment {
+	var segs []Segment
+	for _, c := range cs.byChrom[chrom] {
+		if c.TStart >= end {
+			break
+		}
+		if c.TEnd <= start {
+			continue
+		}
+		qs, qe := ^uint32(0), uint32(0)
+		i := sort.Search(len(c.blocks), func(i int) bool { return c.blocks[i].tStart+c.blocks[i].size > start })
+		for ; i < len(c.blocks) && c.blocks[i].tStart < end; i++ {
+			b := c.blocks[i]
+			s, e := b.qStart, b.qStart+b.size
+			if start > b.tStart {
+				s += start - b.tStart
+			}
+			if b.tStart+b.size > end {
+				e -= b.tStart + b.size - end
+			}
+			if s < qs {
+				qs = s
+			}
+			if e > qe {
+				qe = e
+			}
+		}
+		if qe > qs {
+			s, e := c.plus(qs, qe)
+			segs = append(segs, Segment{Chain: c, Target: Interval{Chrom: c.QName, Start: s, End: e, Minus: c.Minus}})
+		}
+	}
+	return segs
+}
+
+// Unlift maps [start, end) on the target back to the source. It returns false if the
+// interval is not within a single block of c.
+func (c *Chain) Unlift(start, end uint32) (uint32, uint32, bool) {
+	s, e := c.plus(start, end)
+	i := sort.Search(len(c.blocks), func(i int) bool { return c.blocks[i].qStart+c.blocks[i].size > s })
+	if i == len(c.blocks) || c.blocks[i].qStart > s || e > c.blocks[i].qStart+c.blocks[i].size {
+		return 0, 0, false
+	}
+	b := c.blocks[i]
+	return b.tStart + s - b.qStart, b.tStart + e - b.qStart, true
+}
+
+var complement = strings.NewReplacer("A", "T", "C", "G", "G", "C", "T", "A", "a", "t", "c", "g", "g", "c", "t", "a")
+
+// ReverseComplement gives the reverse complement of a DNA sequence. Other characters
+// (e.g. N) are kept.
+func ReverseComplement(s string) string {
+	b := []byte(complement.Replace(s))
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
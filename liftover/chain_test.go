@@ -0,0 +1,77 @@
+package liftover
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chains maps chr1:100-150 and 160-200 to 1000-1050 and 1070-1110 and chr2:0-100 to
+// the - strand of chr2 (of length 100).
+const chains = `chain 100 chr1 1000 + 100 200 1 5000 + 1000 1110 1
+50	10	20
+40
+
+chain 100 chr2 100 + 0 100 2 100 - 0 100 2
+100
+`
+
+func TestChains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.chain")
+	if err := os.WriteFile(path, []byte(chains), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		chrom      string
+		start, end uint32
+		exp        Interval
+		ok         bool
+	}{
+		{"chr1", 100, 101, Interval{"1", 1000, 1001, false}, true},
+		{"chr1", 149, 150, Interval{"1", 1049, 1050, false}, true},
+		{"chr1", 149, 151, Interval{}, false},
+		{"chr1", 155, 156, Interval{}, false},
+		{"chr1", 160, 170, Interval{"1", 1070, 1080, false}, true},
+		{"chr1", 99, 100, Interval{}, false},
+		{"chr2", 0, 1, Interval{"2", 99, 100, true}, true},
+		{"chr2", 10, 15, Interval{"2", 85, 90, true}, true},
+		{"chr3", 10, 15, Interval{}, false},
+	} {
+		iv, ok := cs.Lift(c.chrom, c.start, c.end)
+		if ok != c.ok || iv != c.exp {
+			t.Errorf("%s:%d-%d: expected %v %v, got %v %v", c.chrom, c.start, c.end, c.exp, c.ok, iv, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		segs := cs.Segments(c.chrom, c.start, c.end)
+		if len(segs) != 1 || segs[0].Target != iv {
+			t.Errorf("%s:%d-%d: bad segments %v", c.chrom, c.start, c.end, segs)
+			continue
+		}
+		if s, e, ok := segs[0].Chain.Unlift(iv.Start, iv.End); !ok || s != c.start || e != c.end {
+			t.Errorf("%s:%d-%d: unlifted to %d-%d", c.chrom, c.start, c.end, s, e)
+		}
+	}
+	if segs := cs.Segments("chr1", 0, 1000); len(segs) != 1 || segs[0].Target != (Interval{"1", 1000, 1110, false}) {
+		t.Errorf("bad segments for chr1: %v", segs)
+	}
+
+	if err := os.WriteFile(path, []byte("chain 1 chr1 1000 +\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("expected error for bad chain")
+	}
+}
+
+func TestReverseComplement(t *testing.T) {
+	if rc := ReverseComplement("ACGTNa"); rc != "tNACGT" {
+		t.Errorf("got %s", rc)
+	}
+}
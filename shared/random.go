@@ -0,0 +1,194 @@
+package shared
+
+import (
+	"container/list"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+)
+
+const (
+	// blockSize is the size of the regions that are queried (and cached) in random-access mode.
+	blockSize = 1 << 14
+	// cacheBlocks is the number of blocks kept for each annotation file.
+	cacheBlocks = 512
+	// batchSize is the number of query variants annotated together.
+	batchSize = 400
+)
+
+type blockKey struct {
+	chrom string
+	block int
+}
+
+type block struct {
+	key  blockKey
+	rels []interfaces.Relatable
+}
+
+// blockCache is an LRU cache of the annotations in each block of a Queryable.
+type blockCache struct {
+	q      interfaces.Queryable
+	source uint32
+
+	mu    sync.Mutex
+	order *list.List
+	m     map[blockKey]*list.Element
+}
+
+func newBlockCache(q interfaces.Queryable, source uint32) *blockCache {
+	return &blockCache{q: q, source: source, order: list.New(), m: make(map[blockKey]*list.Element)}
+}
+
+// get returns the annotations that overlap the block. Concurrent calls for a block that
+// is not cached may both query it.
+func (c *blockCache) get(key blockKey) ([]interfaces.Relatable, error) {
+	c.mu.Lock()
+	if e, ok := c.m[key]; ok {
+		c.order.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*block).rels, nil
+	}
+	c.mu.Unlock()
+
+	start := uint32(key.block * blockSize)
+	it, err := c.q.Query(parsers.NewInterval(key.chrom, start, start+blockSize, nil, 0, nil))
+	if err != nil {
+		return nil, err
+	}
+	var rels []interfaces.Relatable
+	for {
+		r, err := it.Next()
+		if r != nil {
+			// the source is set once here as the annotations are shared by many queries.
+			r.SetSource(c.source)
+			rels = append(rels, r)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+	it.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*block).rels, nil
+	}
+	c.m[key] = c.order.PushFront(&block{key: key, rels: rels})
+	if c.order.Len() > cacheBlocks {
+		delete(c.m, c.order.Remove(c.order.Back()).(*block).key)
+	}
+	return rels, nil
+}
+
+// relate adds the annotations that overlap [s, e) to v.
+func (c *blockCache) relate(v interfaces.Relatable, s, e uint32) error {
+	first := int(s) / blockSize
+	for b := first; b <= int(e-1)/blockSize; b++ {
+		rels, err := c.get(blockKey{v.Chrom(), b})
+		if err != nil {
+			return err
+		}
+		for _, r := range rels {
+			// an annotation that starts before the block was also in the previous one.
+			if b > first && int(r.Start()) < b*blockSize {
+				continue
+			}
+			if r.Start() < e && r.End() > s {
+				v.AddRelated(r)
+			}
+		}
+	}
+	return nil
+}
+
+// bounds gives the region of v that is annotated, extended by CIPOS and CIEND if ends.
+func bounds(v interfaces.Relatable, ends bool) (uint32, uint32) {
+	s, e := v.Start(), v.End()
+	if ci, ok := v.(interfaces.CIFace); ok && ends {
+		if a, _, ok := ci.CIPos(); ok && a < s {
+			s = a
+		}
+		if _, b, ok := ci.CIEnd(); ok && b > e {
+			e = b
+		}
+	}
+	if e <= s {
+		e = s + 1
+	}
+	return s, e
+}
+
+// randomAccess annotates the variants from qstream in any order by querying the dbs for
+// the region of each variant. It calls fn on each variant after its annotations are
+// related and sends the variants, in the input order, on the returned channel. An error
+// from querying the dbs is sent to fail and that variant is not annotated. An error
+// reading qstream, other than io.EOF, is sent to fail and ends the stream.
+func randomAccess(qstream interfaces.RelatableIterator, ends bool, fn func(interfaces.Relatable), fail func(error), dbs ...interfaces.Queryable) interfaces.RelatableChannel {
+	caches := make([]*blockCache, len(dbs))
+	for i, db := range dbs {
+		// as for irelate, the query is source 0.
+		caches[i] = newBlockCache(db, uint32(i+1))
+	}
+	annotate := func(batch []interfaces.Relatable, ch chan []interfaces.Relatable) {
+	variants:
+		for _, v := range batch {
+			s, e := bounds(v, ends)
+			for _, c := range caches {
+				if err := c.relate(v, s, e); err != nil {
+					fail(err)
+					continue variants
+				}
+			}
+			fn(v)
+		}
+		ch <- batch
+	}
+
+	out := make(chan interfaces.Relatable, 2048)
+	// batches keeps the output in the order of the input.
+	batches := make(chan chan []interfaces.Relatable, runtime.GOMAXPROCS(0))
+	go func() {
+		for ch := range batches {
+			for _, v := range <-ch {
+				out <- v
+			}
+		}
+		close(out)
+	}()
+	go func() {
+		defer close(batches)
+		batch := make([]interfaces.Relatable, 0, batchSize)
+		for {
+			v, err := qstream.Next()
+			if err != nil && err != io.EOF {
+				// the variants read so far are still written but Run returns the error.
+				fail(err)
+			}
+			done := v == nil || err != nil
+			if v != nil {
+				batch = append(batch, v)
+			}
+			if len(batch) == batchSize || (done && len(batch) > 0) {
+				ch := make(chan []interfaces.Relatable, 1)
+				batches <- ch
+				go annotate(batch, ch)
+				batch = make([]interfaces.Relatable, 0, batchSize)
+			}
+			if done {
+				qstream.Close()
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,254 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentp/irelate"
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	. "github.com/brentp/vcfanno/api"
+	"github.com/brentp/vcfgo"
+)
+
+// Options are the settings for Run that are not part of the Config. The zero value
+// matches the defaults of the vcfanno command-line.
+type Options struct {
+	// Lua is the custom lua code (not the path to it) used by lua: ops.
+	Lua string
+	// Ends annotates the start and end of structural variants as well as the interval.
+	Ends bool
+	// Permissive annotates with overlapping variants even if they don't share an allele.
+	Permissive bool
+	// MaxGap and MaxChunk control how the query is split for annotation in parallel.
+	// They default to 20000 and 8000.
+	MaxGap   int
+	MaxChunk int
+	// Version, if set, is added to the header of the output as ##vcfanno=Version.
+	Version string
+	// Warn, if set, is called (possibly concurrently) with each error that does not stop
+	// annotation, e.g. a field missing from an annotation.
+	Warn func(error)
+	// Unsorted annotates a query that is not sorted by querying the annotations for each
+	// variant rather than sweeping them with the query. Without it, a query that is not
+	// sorted (by position within each chrom) stops with ErrUnsorted.
+	Unsorted bool
+	// AllowBuildMismatch annotates even if the query and annotation files are from
+	// different genome builds (see api.ErrBuildMismatch).
+	AllowBuildMismatch bool
+	// FloatFormat, if set, is the fmt verb (e.g. "%.6g") for the Float values from
+	// numeric ops (see api.Annotator.FloatFormat).
+	FloatFormat string
+	// Liftover is a UCSC chain file from the build of the query to the build of the
+	// annotations. It is used for each annotation without its own Chain.
+	Liftover string
+	// Fasta is the reference FASTA, when they do not give their own, for annotations from
+	// a variant source (see api.IsVariantSource, e.g. "fasta:"), a CRAM or a chain and
+	// postannotations with an identifier op (see api.IsIdentifierOp).
+	Fasta string
+}
+
+// ErrUnsorted occurs when the query is not sorted and Options.Unsorted is not set.
+var ErrUnsorted = errors.New("query is not sorted")
+
+// Result holds statistics from Run.
+type Result struct {
+	// Variants is the number of variants written.
+	Variants int
+	// Warnings is the number of variants with an error that did not stop annotation.
+	Warnings int
+	// Unlifted is the number of variants that could not be lifted (see Options.Liftover)
+	// and so were not annotated from the annotations that needed it.
+	Unlifted int
+	// Unmapped is the number of times a lifted annotation was skipped as it could not be
+	// mapped back to the query (see api.Annotator.Unmapped).
+	Unmapped int
+	// Chrom and Pos (1-based) are the location of the last variant written.
+	Chrom string
+	Pos   int
+	// Duration is the time taken by Run.
+	Duration time.Duration
+}
+
+// ctxIterator ends the query stream when the context is done so that irelate
+// stops after the variants that it has already read.
+type ctxIterator struct {
+	ctx context.Context
+	interfaces.RelatableIterator
+	stopped atomic.Bool
+
+	// if unsorted is set, it is called and the stream ends when a variant starts before
+	// the previous one on the same chrom.
+	unsorted func(error)
+	chrom    string
+	start    uint32
+}
+
+func (c *ctxIterator) Next() (interfaces.Relatable, error) {
+	if c.ctx.Err() != nil {
+		c.stopped.Store(true)
+		return nil, io.EOF
+	}
+	v, err := c.RelatableIterator.Next()
+	if c.unsorted != nil && v != nil {
+		if v.Chrom() == c.chrom && v.Start() < c.start {
+			c.unsorted(fmt.Errorf("%w: %s:%d is after %s:%d. sort the query (e.g. with bcftools sort) or use random-access mode (-unsorted)",
+				ErrUnsorted, v.Chrom(), v.Start()+1, c.chrom, c.start+1))
+			return nil, io.EOF
+		}
+		c.chrom, c.start = v.Chrom(), v.Start()
+	}
+	return v, err
+}
+
+// Run annotates the VCF from r with the annotations in cfg and writes it to w.
+// If ctx is cancelled, reading of the query stops and the variants that were already
+// read are annotated and written before Run returns the Result with ctx.Err().
+// If a variant can not be annotated due to a fatal error (see api.IsFatal), Run stops
+// in the same way and returns that error.
+func Run(ctx context.Context, cfg Config, r io.Reader, w io.Writer, opts Options) (*Result, error) {
+	start := time.Now()
+	if opts.Liftover != "" || opts.Fasta != "" {
+		annos := make([]Annotation, len(cfg.Annotation))
+		for i, a := range cfg.Annotation {
+			if opts.Liftover != "" && a.Chain == "" && a.JoinOn == "" && !IsVariantSource(a.File) && !IsAlignments(a.File) {
+				a.Chain = opts.Liftover
+			}
+			if (IsVariantSource(a.File) || IsCram(a.File) || a.Chain != "") && a.Fasta == "" {
+				a.Fasta = opts.Fasta
+			}
+			annos[i] = a
+		}
+		cfg.Annotation = annos
+	}
+	if opts.Fasta != "" {
+		posts := make([]PostAnnotation, len(cfg.PostAnnotation))
+		for i, p := range cfg.PostAnnotation {
+			if IsIdentifierOp(p.Op) && p.Fasta == "" {
+				p.Fasta = opts.Fasta
+			}
+			posts[i] = p
+		}
+		cfg.PostAnnotation = posts
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	sources, err := cfg.Sources()
+	if err != nil {
+		return nil, err
+	}
+	a, err := NewAnnotator(sources, opts.Lua, opts.Ends, !opts.Permissive, cfg.PostAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	a.AllowBuildMismatch = opts.AllowBuildMismatch
+	a.FloatFormat = opts.FloatFormat
+	qstream, query, err := parsers.VCFIterator(r)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing VCF query: %w", err)
+	}
+	queryables, err := a.Setup(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, q := range queryables {
+			if c, ok := q.(io.Closer); ok {
+				c.Close()
+			}
+		}
+	}()
+
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var fatal struct {
+		sync.Mutex
+		err error
+	}
+	setFatal := func(err error) {
+		fatal.Lock()
+		if fatal.err == nil {
+			fatal.err = err
+		}
+		fatal.Unlock()
+		cancel()
+	}
+	var warnings, unlifted int64
+
+	ends := INTERVAL
+	if opts.Ends {
+		ends = BOTH
+	}
+	fn := func(v interfaces.Relatable) {
+		if a.Unlifted(v) {
+			atomic.AddInt64(&unlifted, 1)
+		}
+		e := a.AnnotateEnds(v, ends)
+		if e == nil {
+			return
+		}
+		if IsFatal(e) {
+			setFatal(e)
+			return
+		}
+		atomic.AddInt64(&warnings, 1)
+		if opts.Warn != nil {
+			opts.Warn(e)
+		}
+	}
+
+	if opts.Version != "" {
+		query.Header.Extras = append(query.Header.Extras, fmt.Sprintf("##vcfanno=%s", opts.Version))
+	}
+	out, err := vcfgo.NewWriter(w, query.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	maxGap, maxChunk := opts.MaxGap, opts.MaxChunk
+	if maxGap == 0 {
+		maxGap = 20000
+	}
+	if maxChunk == 0 {
+		maxChunk = 8000
+	}
+	qit := &ctxIterator{ctx: rctx, RelatableIterator: qstream}
+	var stream interfaces.RelatableChannel
+	if opts.Unsorted {
+		stream = randomAccess(qit, opts.Ends, fn, setFatal, queryables...)
+	} else {
+		qit.unsorted = setFatal
+		stream = irelate.PIRelate(maxChunk, maxGap, qit, opts.Ends, fn, queryables...)
+	}
+
+	res := &Result{}
+	for v := range stream {
+		if _, err := fmt.Fprintln(out, v); err != nil {
+			setFatal(err)
+			continue
+		}
+		res.Variants++
+		res.Chrom, res.Pos = v.Chrom(), int(v.Start())+1
+	}
+	res.Warnings = int(atomic.LoadInt64(&warnings))
+	res.Unlifted = int(atomic.LoadInt64(&unlifted))
+	res.Unmapped = a.Unmapped()
+	res.Duration = time.Since(start)
+
+	fatal.Lock()
+	defer fatal.Unlock()
+	if fatal.err != nil {
+		return res, fatal.err
+	}
+	if qit.stopped.Load() {
+		return res, ctx.Err()
+	}
+	return res, nil
+}
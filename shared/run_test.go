@@ -0,0 +1,714 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/biogo/hts/bam"
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/api"
+	_ "github.com/brentp/vcfanno/consequence"
+	"github.com/brentp/vcfanno/fasta"
+	"github.com/brentp/vcfanno/liftover"
+	"github.com/brentp/xopen"
+)
+
+func testConfig() *Config {
+	return NewConfig("../example").
+		AddFields("exac.vcf.gz", []string{"AC_AFR"}, []string{"self"}, []string{"ac_afr"}).
+		AddColumns("fitcons.bed.gz", []int{4}, []string{"mean"}, []string{"fitcons_mean"})
+}
+
+func TestRun(t *testing.T) {
+	rdr, err := xopen.Ropen("../example/query.vcf.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	res, err := Run(context.Background(), *testConfig(), rdr, &out, Options{Version: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Variants == 0 || res.Chrom == "" || res.Pos == 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	s := out.String()
+	for _, exp := range []string{"##vcfanno=test", "ID=ac_afr,", "ID=fitcons_mean,", ";ac_afr=", ";fitcons_mean="} {
+		if !strings.Contains(s, exp) {
+			t.Errorf("expected %s in output", exp)
+		}
+	}
+	if n := strings.Count(s, "\n") - strings.Count(s, "\n#") - 1; n != res.Variants {
+		t.Errorf("wrote %d variants, result has %d", n, res.Variants)
+	}
+}
+
+func TestRunFloatFormat(t *testing.T) {
+	// each Run has its own format so they can be run at once.
+	formats := []string{"", "%.2f"}
+	outs := make([]bytes.Buffer, len(formats))
+	errs := make([]error, len(formats))
+	var wg sync.WaitGroup
+	for i, f := range formats {
+		wg.Add(1)
+		go func(i int, f string) {
+			defer wg.Done()
+			rdr, err := xopen.Ropen("../example/query.vcf.gz")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			_, errs[i] = Run(context.Background(), *testConfig(), rdr, &outs[i], Options{FloatFormat: f})
+		}(i, f)
+	}
+	wg.Wait()
+	for i, f := range formats {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		n, fixed := 0, 0
+		for _, l := range variantLines(outs[i].String()) {
+			for _, kv := range strings.Split(strings.Split(l, "\t")[7], ";") {
+				if v, ok := strings.CutPrefix(kv, "fitcons_mean="); ok {
+					n++
+					if j := strings.IndexByte(v, '.'); j != -1 && len(v)-j-1 == 2 {
+						fixed++
+					}
+				}
+			}
+		}
+		if n == 0 || (f != "" && fixed != n) || (f == "" && fixed == n) {
+			t.Errorf("format %q: %d of %d values have 2 decimals", f, fixed, n)
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	rdr, err := xopen.Ropen("../example/query.vcf.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err := Run(ctx, *testConfig(), rdr, &bytes.Buffer{}, Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if res.Variants != 0 {
+		t.Errorf("expected no variants after cancel, got %d", res.Variants)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	cfg := NewConfig("../example").AddFields("exac.vcf.gz", []string{"AC_AFR"}, []string{"not_an_op"}, nil)
+	_, err := Run(context.Background(), *cfg, strings.NewReader(""), &bytes.Buffer{}, Options{})
+	if !errors.Is(err, api.ErrUnknownOp) {
+		t.Errorf("expected ErrUnknownOp, got %v", err)
+	}
+
+	cfg = NewConfig("").AddColumns("fitcons.bed.gz", []int{4}, []string{"mean"}, nil)
+	if err := cfg.Validate(); !errors.Is(err, api.ErrConfig) {
+		t.Errorf("expected ErrConfig for missing names, got %v", err)
+	}
+
+	cfg = NewConfig("").AddTable("x.db", "t", []string{"chrom"}, nil, []string{"a"}, []string{"self"}, nil)
+	if err := cfg.Validate(); !errors.Is(err, api.ErrConfig) {
+		t.Errorf("expected ErrConfig for missing coordinates, got %v", err)
+	}
+}
+
+func TestRunJoin(t *testing.T) {
+	dir := t.TempDir()
+	tsv := dir + "/types.tsv"
+	// keys may be multi-valued in the table and in the query.
+	if err := os.WriteFile(tsv, []byte("#type\tscore\tdesc\nsnp\t1\tsingle\ndel,ins\t2\tindel\ncomplex\t3\tother;x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vcf := dir + "/ids.vcf"
+	if err := os.WriteFile(vcf, []byte(`##fileformat=VCFv4.1
+##INFO=<ID=GENE,Number=1,Type=String,Description="gene">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+2	5	rs1;rs2	A	G	.	.	GENE=ABC
+3	5	rs3	A	G	.	.	GENE=DEF
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	query := `##fileformat=VCFv4.1
+##INFO=<ID=TYPE,Number=A,Type=String,Description="type">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+1	10	rs2	C	T	.	.	TYPE=snp
+1	20	rs3;rs1	C	T,CA	.	.	TYPE=snp,ins
+1	30	.	C	CT	.	.	TYPE=del
+1	40	rs9	C	A	.	.	TYPE=mnp
+`
+	cfg := NewConfig("")
+	// a positional annotation after the joins must still get its own file.
+	cfg.Annotation = append(cfg.Annotation,
+		Annotation{File: tsv, JoinOn: "INFO:TYPE", Columns: []int{2, 3}, Ops: []string{"sum", "uniq"}, Names: []string{"score", "desc"}},
+		Annotation{File: vcf, JoinOn: "ID", Fields: []string{"GENE", "ID"}, Ops: []string{"uniq", "self"}, Names: []string{"gene", "rsid"}})
+	cfg.AddColumns("../example/fitcons.bed.gz", []int{4}, []string{"mean"}, []string{"fitcons_mean"})
+
+	var out bytes.Buffer
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var infos []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if l[0] != '#' {
+			infos = append(infos, strings.Split(l, "\t")[7])
+		}
+	}
+	exp := []string{
+		"TYPE=snp;score=1;desc=single;gene=ABC;rsid=rs1,rs2;fitcons_mean=",
+		"TYPE=snp,ins;score=3;desc=single,indel;gene=DEF,ABC;rsid=rs3,rs1,rs2;fitcons_mean=",
+		"TYPE=del;score=2;desc=indel;fitcons_mean=",
+		"TYPE=mnp;fitcons_mean=",
+	}
+	if len(infos) != len(exp) {
+		t.Fatalf("expected %d variants, got %d", len(exp), len(infos))
+	}
+	for i := range exp {
+		if !strings.HasPrefix(infos[i], exp[i]) {
+			t.Errorf("variant %d: expected %s, got %s", i, exp[i], infos[i])
+		}
+	}
+
+	cfg = NewConfig("")
+	cfg.Annotation = append(cfg.Annotation, Annotation{File: tsv, JoinOn: "GENE", Columns: []int{2}, Ops: []string{"sum"}, Names: []string{"s"}})
+	if err := cfg.Validate(); !errors.Is(err, api.ErrConfig) {
+		t.Errorf("expected ErrConfig for join_on, got %v", err)
+	}
+}
+
+func TestRunJoinHeader(t *testing.T) {
+	// as the gnomAD constraint table, the header does not start with '#'.
+	tsv := t.TempDir() + "/constraint.tsv"
+	if err := os.WriteFile(tsv, []byte("gene\ttranscript\tobs_lof\tpLI\toe_lof_upper\n"+
+		"ABC\tENST1\t3\t0.99\t0.35\nDEF\tENST2\t10\t.\t1.2\nDEF\tENST3\t4\t0.5\t0.8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	query := `##fileformat=VCFv4.1
+##INFO=<ID=GENE,Number=1,Type=String,Description="gene">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+1	10	.	C	T	.	.	GENE=ABC
+1	20	.	C	T	.	.	GENE=DEF
+1	30	.	C	T	.	.	GENE=gene
+`
+	exp := []string{"GENE=ABC;pli=0.99;loeuf=0.35;tx=ENST1", "GENE=DEF;pli=0.5;loeuf=0.8;tx=ENST2,ENST3", "GENE=gene"}
+	for _, a := range []Annotation{
+		{File: tsv, JoinOn: "INFO:GENE", Columns: []int{4, 5, 2}, Ops: []string{"max", "min", "uniq"}, Names: []string{"pli", "loeuf", "tx"}},
+		{File: tsv, JoinOn: "INFO:GENE", Fields: []string{"pLI", "oe_lof_upper", "transcript"}, Ops: []string{"max", "min", "uniq"},
+			Names: []string{"pli", "loeuf", "tx"}},
+	} {
+		cfg := NewConfig("")
+		cfg.Annotation = append(cfg.Annotation, a)
+		var out bytes.Buffer
+		if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &out, Options{}); err != nil {
+			t.Fatal(err)
+		}
+		var infos []string
+		for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if l[0] != '#' {
+				infos = append(infos, strings.Split(l, "\t")[7])
+			}
+		}
+		if strings.Join(infos, " ") != strings.Join(exp, " ") {
+			t.Errorf("expected %v, got %v", exp, infos)
+		}
+	}
+
+	cfg := NewConfig("")
+	cfg.Annotation = append(cfg.Annotation, Annotation{File: tsv, JoinOn: "INFO:GENE", Fields: []string{"missing"}, Ops: []string{"max"},
+		Names: []string{"m"}})
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), io.Discard, Options{}); !errors.Is(err, api.ErrConfig) {
+		t.Errorf("expected ErrConfig for a missing column, got %v", err)
+	}
+}
+
+func TestRunUnsorted(t *testing.T) {
+	rdr, err := xopen.Ropen("../example/query.vcf.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header, body []string
+	for _, l := range strings.Split(strings.TrimSpace(readAll(t, rdr)), "\n") {
+		if l[0] == '#' {
+			header = append(header, l)
+		} else {
+			body = append(body, l)
+		}
+	}
+	// reverse the variants.
+	for i, j := 0, len(body)-1; i < j; i, j = i+1, j-1 {
+		body[i], body[j] = body[j], body[i]
+	}
+	query := strings.Join(append(header, body...), "\n") + "\n"
+
+	_, err = Run(context.Background(), *testConfig(), strings.NewReader(query), &bytes.Buffer{}, Options{})
+	if !errors.Is(err, ErrUnsorted) {
+		t.Fatalf("expected ErrUnsorted, got %v", err)
+	}
+
+	var sorted, unsorted bytes.Buffer
+	rdr, _ = xopen.Ropen("../example/query.vcf.gz")
+	if _, err := Run(context.Background(), *testConfig(), rdr, &sorted, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Run(context.Background(), *testConfig(), strings.NewReader(query), &unsorted, Options{Unsorted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Variants != len(body) {
+		t.Errorf("expected %d variants, got %d", len(body), res.Variants)
+	}
+	exp, got := variantLines(sorted.String()), variantLines(unsorted.String())
+	if first := strings.Join(strings.Split(body[0], "\t")[:5], "\t"); !strings.HasPrefix(got[0], first) {
+		t.Errorf("expected output in input order starting with %s", first)
+	}
+	sort.Strings(exp)
+	sort.Strings(got)
+	if strings.Join(exp, "\n") != strings.Join(got, "\n") {
+		t.Error("random-access output differs from sorted output")
+	}
+}
+
+// failingIterator gives its intervals then err.
+type failingIterator struct {
+	rels []interfaces.Relatable
+	err  error
+}
+
+func (f *failingIterator) Next() (interfaces.Relatable, error) {
+	if len(f.rels) == 0 {
+		return nil, f.err
+	}
+	r := f.rels[0]
+	f.rels = f.rels[1:]
+	return r, nil
+}
+
+func (f *failingIterator) Close() error { return nil }
+
+func TestRandomAccessError(t *testing.T) {
+	errRead := errors.New("unexpected end of gzip stream")
+	for _, e := range []error{io.EOF, errRead} {
+		it := &failingIterator{err: e, rels: []interfaces.Relatable{
+			parsers.NewInterval("1", 10, 11, nil, 0, nil), parsers.NewInterval("1", 5, 6, nil, 0, nil)}}
+		var failed error
+		n := 0
+		for range randomAccess(it, false, func(interfaces.Relatable) {}, func(err error) { failed = err }) {
+			n++
+		}
+		if n != 2 {
+			t.Errorf("expected the 2 variants before the error, got %d", n)
+		}
+		if e == io.EOF && failed != nil {
+			t.Errorf("expected no error at the end of the stream, got %v", failed)
+		} else if e != io.EOF && failed != errRead {
+			t.Errorf("expected the read error, got %v", failed)
+		}
+	}
+}
+
+func readAll(t *testing.T, r io.Reader) string {
+	t.Helper()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func variantLines(s string) []string {
+	var lines []string
+	for _, l := range strings.Split(strings.TrimSpace(s), "\n") {
+		if l[0] != '#' {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func TestRunBuild(t *testing.T) {
+	query := "##fileformat=VCFv4.1\n##contig=<ID=1,length=248956422>\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n1\t69270\t.\tA\tG\t.\t.\t.\n"
+	_, err := Run(context.Background(), *testConfig(), strings.NewReader(query), &bytes.Buffer{}, Options{})
+	if !errors.Is(err, api.ErrBuildMismatch) {
+		t.Fatalf("expected ErrBuildMismatch, got %v", err)
+	}
+	var out bytes.Buffer
+	if _, err := Run(context.Background(), *testConfig(), strings.NewReader(query), &out, Options{AllowBuildMismatch: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\n"+api.BuildLine+"GRCh38\n") {
+		t.Error("expected the build of the query in the header")
+	}
+
+	// without contigs in the query, the build comes from the annotations.
+	out.Reset()
+	query = strings.Replace(query, "##contig=<ID=1,length=248956422>\n", "", 1)
+	if _, err := Run(context.Background(), *testConfig(), strings.NewReader(query), &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\n"+api.BuildLine+"GRCh37\n") {
+		t.Error("expected the build of the annotations in the header")
+	}
+}
+
+func TestRunLiftover(t *testing.T) {
+	rdr, err := xopen.Ropen("../example/query.vcf.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header, body []string
+	for _, l := range strings.Split(strings.TrimSpace(readAll(t, rdr)), "\n") {
+		if l[0] == '#' {
+			header = append(header, l)
+		} else {
+			body = append(body, l)
+		}
+	}
+	var out bytes.Buffer
+	if _, err := Run(context.Background(), *testConfig(), strings.NewReader(strings.Join(append(header, body...), "\n")+"\n"), &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	// exp is the INFO of each variant on chrom 1 without liftover.
+	exp := make(map[string]string)
+	for _, l := range variantLines(out.String()) {
+		if toks := strings.Split(l, "\t"); toks[0] == "1" {
+			exp[toks[1]+toks[3]+toks[4]] = toks[7]
+		}
+	}
+
+	dir := t.TempDir()
+	run := func(chain string, body []string) (*Result, []string) {
+		t.Helper()
+		path := dir + "/test.chain"
+		if err := os.WriteFile(path, []byte(chain), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		res, err := Run(context.Background(), *testConfig(), strings.NewReader(strings.Join(append(header, body...), "\n")+"\n"), &out, Options{Liftover: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, variantLines(out.String())
+	}
+
+	// chrom 1 of the query is shifted by 1000 on the + strand.
+	var shifted []string
+	for _, l := range body {
+		toks := strings.Split(l, "\t")
+		pos, _ := strconv.Atoi(toks[1])
+		toks[1] = strconv.Itoa(pos + 1000)
+		shifted = append(shifted, strings.Join(toks, "\t"))
+	}
+	res, lines := run("chain 1 1 300000000 + 1000 249251621 1 249250621 + 0 249250621 1\n249250621\n", shifted)
+	if res.Unlifted != 1 {
+		t.Errorf("expected the variant on chrom 2 to be unlifted, got %d", res.Unlifted)
+	}
+	n := 0
+	for _, l := range lines {
+		toks := strings.Split(l, "\t")
+		if toks[0] != "1" {
+			continue
+		}
+		n++
+		pos, _ := strconv.Atoi(toks[1])
+		if e := exp[strconv.Itoa(pos-1000)+toks[3]+toks[4]]; toks[7] != e {
+			t.Errorf("+ strand: expected %s, got %s", e, toks[7])
+		}
+	}
+	if n != len(exp) {
+		t.Errorf("expected %d variants on chrom 1, got %d", len(exp), n)
+	}
+
+	// chrom 1 of the query is the reverse complement; only its SNPs are used as the indels
+	// would need to be left-aligned again (see api.TestUnliftMinus).
+	var reversed []string
+	want := make(map[string]string)
+	for i := len(body) - 1; i >= 0; i-- {
+		toks := strings.Split(body[i], "\t")
+		if toks[0] != "1" || len(toks[3]) != 1 || len(toks[4]) != 1 {
+			continue
+		}
+		key := toks[1] + toks[3] + toks[4]
+		pos, _ := strconv.Atoi(toks[1])
+		toks[1] = strconv.Itoa(249250621 - pos + 1)
+		toks[3], toks[4] = liftover.ReverseComplement(toks[3]), liftover.ReverseComplement(toks[4])
+		want[toks[1]+toks[3]+toks[4]] = exp[key]
+		reversed = append(reversed, strings.Join(toks, "\t"))
+	}
+	res, lines = run("chain 1 1 249250621 + 0 249250621 1 249250621 - 0 249250621 2\n249250621\n", reversed)
+	if res.Unlifted != 0 || len(lines) != len(reversed) {
+		t.Errorf("expected %d lifted variants, got %d with %d unlifted", len(reversed), len(lines), res.Unlifted)
+	}
+	for _, l := range lines {
+		toks := strings.Split(l, "\t")
+		if e := want[toks[1]+toks[3]+toks[4]]; toks[7] != e {
+			t.Errorf("- strand: expected %s, got %s", e, toks[7])
+		}
+	}
+}
+
+func TestRunFasta(t *testing.T) {
+	// the reference is C except for an A at 69270 (1-based).
+	seq := []byte(">1\n" + strings.Repeat(strings.Repeat("C", 60)+"\n", 1200))
+	seq[3+69269+69269/60] = 'A'
+	path := t.TempDir() + "/ref.fa"
+	if err := os.WriteFile(path, seq, 0644); err != nil {
+		t.Fatal(err)
+	}
+	query := "##fileformat=VCFv4.1\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n1\t69270\t.\tA\tG\t.\t.\t.\n1\t69271\t.\tT\tG\t.\t.\t.\n"
+	cfg := NewConfig("../example").
+		AddFields(fasta.Prefix, []string{"context", "gc10", "homopolymer", "ref_match"}, []string{"self", "self", "self", "self"},
+			[]string{"ctx", "gc", "hp", "ref_match"}).
+		AddColumns("fitcons.bed.gz", []int{4}, []string{"mean"}, []string{"fitcons_mean"})
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &bytes.Buffer{}, Options{}); !errors.Is(err, api.ErrConfig) {
+		t.Fatalf("expected ErrConfig without a reference, got %v", err)
+	}
+	var out bytes.Buffer
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &out, Options{Fasta: path}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "##INFO=<ID=gc,Number=1,Type=Float") {
+		t.Error("expected the header for gc")
+	}
+	lines := variantLines(out.String())
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 variants, got %d", len(lines))
+	}
+	for i, exp := range []string{"ctx=CAC;gc=0.9;hp=1;ref_match=1;fitcons_mean=", "ctx=ACC;gc=0.9;hp=500;ref_match=0;fitcons_mean="} {
+		if info := strings.Split(lines[i], "\t")[7]; !strings.HasPrefix(info, exp) {
+			t.Errorf("expected %s, got %s", exp, info)
+		}
+	}
+
+	// the contigs of the reference are checked like those of the annotations.
+	cfg.AddFields("exac.vcf.gz", []string{"AC_AFR"}, []string{"self"}, []string{"ac_afr"})
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &bytes.Buffer{}, Options{Fasta: path}); !errors.Is(err, api.ErrBuildMismatch) {
+		t.Errorf("expected ErrBuildMismatch, got %v", err)
+	}
+}
+
+func TestRunIdentifiers(t *testing.T) {
+	// the reference is G except for CAAAAT at 101-106 (1-based).
+	seq := strings.Repeat("G", 100) + "CAAAAT" + strings.Repeat("G", 94)
+	var fa strings.Builder
+	fa.WriteString(">1\n")
+	for i := 0; i < len(seq); i += 60 {
+		fa.WriteString(seq[i:min(i+60, len(seq))] + "\n")
+	}
+	path := t.TempDir() + "/ref.fa"
+	if err := os.WriteFile(path, []byte(fa.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	query := "##fileformat=VCFv4.1\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n" +
+		"1\t101\t.\tC\tT,<DEL>\t.\t.\t.\n1\t101\trs1;1:101:AAAA:AAA\tCA\tC\t.\t.\t.\n"
+	cfg := NewConfig("").
+		AddPostAnnotation(api.PostAnnotation{Name: "spdi", Op: "spdi"}).
+		AddPostAnnotation(api.PostAnnotation{Name: "hgvs", Op: "hgvs"}).
+		AddPostAnnotation(api.PostAnnotation{Name: "vrs", Op: "vrs"}).
+		AddPostAnnotation(api.PostAnnotation{Name: "ID", Op: "spdi"})
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &bytes.Buffer{}, Options{}); !errors.Is(err, api.ErrConfig) {
+		t.Fatalf("expected ErrConfig without a reference, got %v", err)
+	}
+	var out bytes.Buffer
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &out, Options{Fasta: path}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "##INFO=<ID=vrs,Number=A,Type=String") {
+		t.Error("expected the header for vrs")
+	}
+	lines := variantLines(out.String())
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 variants, got %d", len(lines))
+	}
+	// the identifiers are appended to an existing ID once.
+	for i, exp := range [][2]string{
+		{"1:100:C:T", "spdi=1:100:C:T,.;hgvs=1:g.101C>T,.;vrs=ga4gh:VA."},
+		{"rs1;1:101:AAAA:AAA", "spdi=1:101:AAAA:AAA;hgvs=1:g.105del;vrs=ga4gh:VA."},
+	} {
+		toks := strings.Split(lines[i], "\t")
+		if toks[2] != exp[0] {
+			t.Errorf("expected ID %s, got %s", exp[0], toks[2])
+		}
+		if !strings.HasPrefix(toks[7], exp[1]) {
+			t.Errorf("expected %s, got %s", exp[1], toks[7])
+		}
+	}
+}
+
+func TestRunGFF(t *testing.T) {
+	query := "##fileformat=VCFv4.1\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n" +
+		"1\t950\t.\tA\tG\t.\t.\t.\n1\t1150\t.\tA\tG\t.\t.\t.\n1\t1500\t.\tA\tG\t.\t.\t.\n1\t6050\t.\tA\tG\t.\t.\t.\n"
+	cfg := NewConfig("../example")
+	cfg.Annotation = append(cfg.Annotation, Annotation{File: "genes.gtf.gz", Fields: []string{"gene_name", "transcript_id"},
+		Ops: []string{"uniq", "uniq"}, Names: []string{"gene", "transcript"}, FeatureTypes: []string{"exon"}, Upstream: 100})
+	var out bytes.Buffer
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "##INFO=<ID=gene,Number=.,Type=String") {
+		t.Error("expected the header for gene")
+	}
+	lines := variantLines(out.String())
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 variants, got %d", len(lines))
+	}
+	for i, exp := range []string{"gene=GENE1;transcript=T1", "gene=GENE1;transcript=T1", ".", "gene=GENE2;transcript=T2"} {
+		if info := strings.Split(lines[i], "\t")[7]; info != exp {
+			t.Errorf("expected %s, got %s", exp, info)
+		}
+	}
+
+	cfg.Annotation[0].File = "fitcons.bed.gz"
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &bytes.Buffer{}, Options{}); !errors.Is(err, api.ErrConfig) {
+		t.Errorf("expected ErrConfig for feature_types with a BED file, got %v", err)
+	}
+}
+
+func TestRunConsequence(t *testing.T) {
+	query := "##fileformat=VCFv4.1\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n" +
+		"1\t1104\t.\tG\tA\t.\t.\t.\n1\t3000\t.\tC\tT\t.\t.\t.\n"
+	cfg := NewConfig("../example")
+	cfg.Annotation = append(cfg.Annotation, Annotation{File: "consequence:genes.gtf.gz", Fields: []string{"csq"},
+		Ops: []string{"self"}, Names: []string{"CSQ"}})
+	var out bytes.Buffer
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &out, Options{Fasta: "../example/genes.fa"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "##INFO=<ID=CSQ,Number=.,Type=String,Description=\"Consequence annotations from ../example/genes.gtf.gz. Format: Allele|") {
+		t.Errorf("expected the header for CSQ, got %s", out.String())
+	}
+	lines := variantLines(out.String())
+	for i, exp := range []string{"CSQ=A|missense_variant|GENE1|T1|protein_coding|Gct/Act|A/T|2", "CSQ=T|intergenic_variant||||||"} {
+		if info := strings.Split(lines[i], "\t")[7]; info != exp {
+			t.Errorf("expected %s, got %s", exp, info)
+		}
+	}
+
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &bytes.Buffer{}, Options{}); !errors.Is(err, api.ErrSourceOpen) {
+		t.Errorf("expected ErrSourceOpen without a reference, got %v", err)
+	}
+	cfg.Annotation[0].Fields = []string{"gene"}
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &bytes.Buffer{}, Options{Fasta: "../example/genes.fa"}); !errors.Is(err, api.ErrConfig) {
+		t.Errorf("expected ErrConfig for an unknown field, got %v", err)
+	}
+	cfg.Annotation[0] = Annotation{File: "fitcons.bed.gz", Columns: []int{4}, Ops: []string{"mean"}, Names: []string{"fc"}, Fasta: "genes.fa"}
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &bytes.Buffer{}, Options{}); !errors.Is(err, api.ErrConfig) {
+		t.Errorf("expected ErrConfig for fasta with a BED file, got %v", err)
+	}
+}
+
+func TestRunBBI(t *testing.T) {
+	query := "##fileformat=VCFv4.1\n" +
+		"##INFO=<ID=SVLEN,Number=1,Type=Integer,Description=\"SV length\">\n" +
+		"##INFO=<ID=END,Number=1,Type=Integer,Description=\"End\">\n" +
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n" +
+		"1\t1050\t.\tA\tG\t.\t.\t.\n" +
+		"1\t5001\t.\tA\t<DEL>\t.\t.\tSVLEN=-20000;END=25000\n" +
+		"1\t5101\t.\tA\t<DEL>\t.\t.\tSVLEN=-99;END=5200\n"
+	cfg := NewConfig("../example")
+	cfg.Annotation = append(cfg.Annotation,
+		Annotation{File: "conservation.bw", Fields: []string{"value", "value"}, Ops: []string{"mean", "count"},
+			Names: []string{"cons", "cons_n"}},
+		Annotation{File: "regions.bb", Fields: []string{"name", "signal"}, Ops: []string{"first", "max"},
+			Names: []string{"region", "signal"}})
+	var out bytes.Buffer
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "##INFO=<ID=region,Number=1,Type=String,Description=\"Name of item (from ../example/regions.bb)\">") {
+		t.Error("expected the header for region")
+	}
+	lines := variantLines(out.String())
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 variants, got %d", len(lines))
+	}
+	// the 20kb deletion is annotated from the 200 records of the zoom level and the short
+	// one from the bases.
+	for i, exp := range []string{"cons=4.9;cons_n=1;region=enh1;signal=3.5",
+		"SVLEN=-20000;END=25000;cons=3;cons_n=200;region=prom2;signal=7.25",
+		"SVLEN=-99;END=5200;cons=2;cons_n=1;region=prom2;signal=7.25"} {
+		if info := strings.Split(lines[i], "\t")[7]; info != exp {
+			t.Errorf("expected %s, got %s", exp, info)
+		}
+	}
+
+	cfg.Annotation[0].Fields = []string{"mean", "value"}
+	if _, err := Run(context.Background(), *cfg, strings.NewReader(query), &bytes.Buffer{}, Options{}); !errors.Is(err, api.ErrSourceOpen) {
+		t.Errorf("expected ErrSourceOpen for an unknown field, got %v", err)
+	}
+}
+
+func TestRunCram(t *testing.T) {
+	// samtools is replaced by a script that gives the bam as the CRAM. The reference is
+	// only an index with the contigs of the bam.
+	dir := t.TempDir()
+	f, err := os.Open("../example/ex.bam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	br, err := bam.NewReader(f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fai strings.Builder
+	for _, r := range br.Header().Refs() {
+		fmt.Fprintf(&fai, "%s\t%d\t0\t60\t61\n", r.Name(), r.Len())
+	}
+	br.Close()
+	bamPath, _ := filepath.Abs("../example/ex.bam")
+	cram, fa := filepath.Join(dir, "ex.cram"), filepath.Join(dir, "ref.fa")
+	for name, s := range map[string]string{cram: "", cram + ".crai": "", fa: "", fa + ".fai": fai.String(),
+		filepath.Join(dir, "samtools"): "#!/bin/sh\n[ \"$3\" = -T ] && [ -f \"$4\" ] || exit 1\nexec cat " + bamPath + "\n"} {
+		if err := os.WriteFile(name, []byte(s), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	run := func(file string, opts Options) (string, error) {
+		cfg := NewConfig("../example")
+		cfg.Annotation = append(cfg.Annotation, Annotation{File: file, Fields: []string{"mapq", "coverage", "DP2"},
+			Ops: []string{"mean", "sum", "DP2"}, Names: []string{"mapq", "coverage", "xdp2"}})
+		rdr, err := xopen.Ropen("../example/query.vcf.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if _, err := Run(context.Background(), *cfg, rdr, &out, opts); err != nil {
+			return "", err
+		}
+		return strings.Join(variantLines(out.String()), "\n"), nil
+	}
+	exp, err := run("ex.bam", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(exp, ";coverage=") {
+		t.Fatal("expected coverage from the bam")
+	}
+	got, err := run(cram, Options{Fasta: fa})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != exp {
+		t.Error("expected the same annotations from the CRAM as from the bam")
+	}
+	if _, err := run(cram, Options{}); !errors.Is(err, api.ErrConfig) {
+		t.Errorf("expected ErrConfig without a reference, got %v", err)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"strings"
 
 	. "github.com/brentp/vcfanno/api"
+	"github.com/brentp/vcfanno/bbi"
+	"github.com/brentp/vcfanno/gff"
 	"github.com/brentp/xopen"
 )
 
@@ -17,6 +20,71 @@ type Config struct {
 	Base string
 }
 
+// NewConfig returns an empty Config. Use AddFields, AddColumns and AddPostAnnotation to
+// fill it without writing a toml file.
+func NewConfig(base string) *Config {
+	return &Config{Base: base}
+}
+
+// AddFields adds an annotation from the INFO fields (or ID or FILTER) of a VCF.
+// If names is nil, the field names are used.
+func (c *Config) AddFields(file string, fields []string, ops []string, names []string) *Config {
+	c.Annotation = append(c.Annotation, Annotation{File: file, Fields: fields, Ops: ops, Names: names})
+	return c
+}
+
+// AddColumns adds an annotation from the (1-based) columns of a tab-delimited file.
+func (c *Config) AddColumns(file string, columns []int, ops []string, names []string) *Config {
+	c.Annotation = append(c.Annotation, Annotation{File: file, Columns: columns, Ops: ops, Names: names})
+	return c
+}
+
+// AddTable adds an annotation from the columns (fields) of a table in a SQLite database.
+// alleles may be nil to match rows by position only. The sqlite package must be imported.
+func (c *Config) AddTable(file, table string, coordinates, alleles, fields, ops, names []string) *Config {
+	c.Annotation = append(c.Annotation, Annotation{File: file, Table: table, Coordinates: coordinates, Alleles: alleles,
+		Fields: fields, Ops: ops, Names: names})
+	return c
+}
+
+// AddPostAnnotation adds a postannotation that is calculated from other fields.
+func (c *Config) AddPostAnnotation(p PostAnnotation) *Config {
+	c.PostAnnotation = append(c.PostAnnotation, p)
+	return c
+}
+
+// Validate checks the annotations and postannotations.
+func (c Config) Validate() error {
+	for _, a := range c.Annotation {
+		if err := CheckAnno(&a); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.PostAnnotation {
+		if err := CheckPostAnno(&p); err != nil {
+			return fmt.Errorf("error in postannotation section %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// UsesLua indicates that any annotation or postannotation has a lua: op.
+func (c Config) UsesLua() bool {
+	for _, a := range c.Annotation {
+		for _, op := range a.Ops {
+			if strings.HasPrefix(op, "lua:") {
+				return true
+			}
+		}
+	}
+	for _, p := range c.PostAnnotation {
+		if strings.HasPrefix(p.Op, "lua:") {
+			return true
+		}
+	}
+	return false
+}
+
 // Annotation holds information about the annotation files parsed from the toml config.
 type Annotation struct {
 	File    string
@@ -25,6 +93,44 @@ type Annotation struct {
 	Columns []int
 	// the names in the output.
 	Names []string
+	// Table, Coordinates (chrom, start and optional end columns) and Alleles (ref and alt
+	// columns) are used when File is a SQLite database.
+	Table       string
+	Coordinates []string
+	Alleles     []string
+	// JoinOn ("ID" or "INFO:<field>") annotates by key rather than by position. See
+	// api.Source. JoinColumn is the key column of a tab-delimited File.
+	JoinOn     string `toml:"join_on"`
+	JoinColumn int    `toml:"join_column"`
+	// Chain is a UCSC chain file from the build of the query to the build of File.
+	Chain string
+	// FeatureTypes limits the features of a GFF3 or GTF File (whose Fields are attribute
+	// keys) to those types. Upstream and Downstream extend each feature on its strand.
+	FeatureTypes []string `toml:"feature_types"`
+	Upstream     int
+	Downstream   int
+	// Fasta is the reference for a File that computes its annotations from each variant
+	// (see api.IsVariantSource), e.g. "consequence:genes.gtf.gz", for a CRAM or, with a
+	// Chain, of the query (see api.Source).
+	Fasta string
+}
+
+// sqliteURI gives the File used to open the table of a SQLite annotation. See the
+// sqlite package.
+func (a *Annotation) sqliteURI() string {
+	v := url.Values{}
+	v.Set("table", a.Table)
+	for i, k := range []string{"chrom", "start", "end"} {
+		if i < len(a.Coordinates) {
+			v.Set(k, a.Coordinates[i])
+		}
+	}
+	if len(a.Alleles) == 2 {
+		v.Set("ref", a.Alleles[0])
+		v.Set("alt", a.Alleles[1])
+	}
+	v.Set("fields", strings.Join(a.Fields, ","))
+	return "sqlite://" + a.File + "?" + v.Encode()
 }
 
 // Flatten turns an annotation into a slice of Sources. Pass in the index of the file.
@@ -32,8 +138,8 @@ type Annotation struct {
 // specify multiple ops per file in the toml config.
 func (a *Annotation) Flatten(index int) ([]*Source, error) {
 	if len(a.Ops) == 0 {
-		if !strings.HasSuffix(a.File, ".bam") {
-			return nil, fmt.Errorf("no ops specified for %s\n", a.File)
+		if !IsAlignments(a.File) {
+			return nil, fmt.Errorf("%w: no ops specified for %s", ErrConfig, a.File)
 		}
 		// auto-fill bam to count.
 		a.Ops = make([]string, len(a.Names))
@@ -42,8 +148,8 @@ func (a *Annotation) Flatten(index int) ([]*Source, error) {
 		}
 	}
 	if len(a.Columns) == 0 && len(a.Fields) == 0 {
-		if !strings.HasSuffix(a.File, ".bam") {
-			return nil, fmt.Errorf("no columns or fields specified for %s\n", a.File)
+		if !IsAlignments(a.File) {
+			return nil, fmt.Errorf("%w: no columns or fields specified for %s", ErrConfig, a.File)
 		}
 
 		if len(a.Fields) == 0 {
@@ -53,8 +159,18 @@ func (a *Annotation) Flatten(index int) ([]*Source, error) {
 			}
 		}
 	}
-	if !(xopen.Exists(a.File) || a.File == "-") {
-		return nil, fmt.Errorf("[Flatten] unable to open file: %s\n", a.File)
+	if IsVariantSource(a.File) {
+		// without a path (e.g. "fasta:"), the source uses its reference.
+		if path := a.File[strings.IndexByte(a.File, ':')+1:]; path != "" && !xopen.Exists(path) {
+			return nil, fmt.Errorf("%w: [Flatten] %s", ErrSourceOpen, a.File)
+		}
+	} else if !(xopen.Exists(a.File) || a.File == "-" || IsBackendURI(a.File)) {
+		return nil, fmt.Errorf("%w: [Flatten] %s", ErrSourceOpen, a.File)
+	}
+
+	file := a.File
+	if a.Table != "" {
+		file = a.sqliteURI()
 	}
 
 	n := len(a.Ops)
@@ -63,23 +179,25 @@ func (a *Annotation) Flatten(index int) ([]*Source, error) {
 		isLua := strings.HasPrefix(a.Ops[i], "lua:")
 		if !isLua {
 			if len(a.Fields) > i && a.Fields[i] == "DP2" {
-				if !strings.HasSuffix(a.File, ".bam") {
-					log.Fatal("DP2 only valid for bams")
+				if !IsAlignments(a.File) {
+					return nil, fmt.Errorf("%w: DP2 only valid for bams and CRAMs: %s", ErrConfig, a.File)
 				}
 				// always set Op to DP2 whne Field is DP2
 				a.Ops[i] = "DP2"
 			}
-			if _, ok := Reducers[a.Ops[i]]; !ok {
-				return nil, fmt.Errorf("requested op not found: %s for %s\n", a.Ops[i], a.File)
+			if _, ok := ReducerSpec(a.Ops[i]); !ok {
+				return nil, fmt.Errorf("%w: %s for %s", ErrUnknownOp, a.Ops[i], a.File)
 			}
 		}
 		op := a.Ops[i]
 		if len(a.Names) == 0 {
 			a.Names = a.Fields
 		}
-		sources[i] = &Source{File: a.File, Op: op, Name: a.Names[i], Index: index}
+		sources[i] = &Source{File: file, Op: op, Name: a.Names[i], Index: index, JoinOn: a.JoinOn, JoinColumn: a.JoinColumn,
+			Chain: a.Chain, FeatureTypes: a.FeatureTypes, Upstream: a.Upstream, Downstream: a.Downstream, Fasta: a.Fasta}
 		if nil != a.Fields {
 			sources[i].Field = a.Fields[i]
+			// set by Setup for a backend that gives the fields as columns.
 			sources[i].Column = -1
 		} else {
 			sources[i].Column = a.Columns[i]
@@ -91,44 +209,127 @@ func (a *Annotation) Flatten(index int) ([]*Source, error) {
 func (c Config) Sources() ([]*Source, error) {
 	annos := c.Annotation
 	for i, a := range annos {
-		if !xopen.Exists(a.File) && a.File != "-" {
+		if IsVariantSource(a.File) {
+			prefix, path, _ := strings.Cut(a.File, ":")
+			if path != "" && !xopen.Exists(path) {
+				a.File = prefix + ":" + c.Base + "/" + path
+			}
+			if a.Fasta != "" && !xopen.Exists(a.Fasta) {
+				a.Fasta = c.Base + "/" + a.Fasta
+			}
+			annos[i] = a
+		} else if !xopen.Exists(a.File) && a.File != "-" && !IsBackendURI(a.File) {
 			a.File = c.Base + "/" + a.File
 			annos[i] = a
 		}
+		if (IsCram(a.File) || a.Chain != "") && a.Fasta != "" && !xopen.Exists(a.Fasta) {
+			a.Fasta = c.Base + "/" + a.Fasta
+			annos[i] = a
+		}
 	}
 	var s []*Source
-	for i, a := range annos {
-		flats, err := a.Flatten(i)
+	index := 0
+	for _, a := range annos {
+		flats, err := a.Flatten(index)
 		if err != nil {
 			return nil, err
 		}
+		// joins, references and variant sources are not queried by position so they do not
+		// have an index.
+		if a.JoinOn == "" && !IsVariantSource(a.File) {
+			index++
+		}
 		s = append(s, flats...)
 	}
 	return s, nil
 }
 
 func CheckPostAnno(p *PostAnnotation) error {
+	if IsIdentifierOp(p.Op) {
+		if p.Name == "" {
+			return fmt.Errorf("%w: must specify a 'name' (or ID) for postannotation", ErrConfig)
+		}
+		if p.Fasta == "" {
+			return fmt.Errorf("%w: no reference for op %s (use -fasta or fasta=\"ref.fa\")", ErrConfig, p.Op)
+		}
+		if !xopen.Exists(p.Fasta) {
+			return fmt.Errorf("%w: %s", ErrSourceOpen, p.Fasta)
+		}
+		if p.Type != "" && p.Type != "String" {
+			return fmt.Errorf("%w: type for op %s must be 'String'", ErrConfig, p.Op)
+		}
+		return nil
+	}
 	if len(p.Fields) == 0 {
 		log.Println("warning: no specified 'fields' for postannotation:", p.Name)
 	}
 	if p.Op == "" {
-		return fmt.Errorf("must specify an 'op' for postannotation")
+		return fmt.Errorf("%w: must specify an 'op' for postannotation", ErrConfig)
 	}
 	if p.Name == "" {
 		if p.Op != "delete" {
-			return fmt.Errorf("must specify a 'name' for postannotation")
+			return fmt.Errorf("%w: must specify a 'name' for postannotation", ErrConfig)
 		}
 	}
 	if !(p.Type == "Float" || p.Type == "String" || p.Type == "Integer" || p.Type == "Flag") {
 		if p.Op != "delete" {
-			return fmt.Errorf("must specify a type for postannotation that is 'Flag', 'Float', 'Integer' or 'String'")
+			return fmt.Errorf("%w: must specify a type for postannotation that is 'Flag', 'Float', 'Integer' or 'String'", ErrConfig)
 		}
 	}
 	return nil
 }
 
 func CheckAnno(a *Annotation) error {
-	if strings.HasSuffix(a.File, ".bam") {
+	if a.Table != "" {
+		if a.Fields == nil || a.Columns != nil {
+			return fmt.Errorf("%w: must specify 'fields' (and not 'columns') for table %s in %s", ErrConfig, a.Table, a.File)
+		}
+		if len(a.Coordinates) != 2 && len(a.Coordinates) != 3 {
+			return fmt.Errorf("%w: 'coordinates' must give the chrom, start and optional end columns for table %s in %s", ErrConfig, a.Table, a.File)
+		}
+		if len(a.Alleles) != 0 && len(a.Alleles) != 2 {
+			return fmt.Errorf("%w: 'alleles' must give the ref and alt columns for table %s in %s", ErrConfig, a.Table, a.File)
+		}
+	}
+	if a.JoinOn != "" {
+		if err := CheckJoinOn(a.JoinOn); err != nil {
+			return fmt.Errorf("%w for %s", err, a.File)
+		}
+		if a.Table != "" || IsBackendURI(a.File) || IsAlignments(a.File) || bbi.IsBBI(a.File) {
+			return fmt.Errorf("%w: join_on can only be used with a VCF or tab-delimited file: %s", ErrConfig, a.File)
+		}
+		if a.JoinColumn < 0 {
+			return fmt.Errorf("%w: join_column must be positive for %s", ErrConfig, a.File)
+		}
+	}
+	if a.Chain != "" && (a.JoinOn != "" || IsAlignments(a.File)) {
+		return fmt.Errorf("%w: chain can not be used with join_on or a bam or CRAM: %s", ErrConfig, a.File)
+	}
+	if gff.IsGFF(a.File) {
+		if a.Fields == nil || a.Columns != nil || a.Table != "" || a.JoinOn != "" {
+			return fmt.Errorf("%w: must specify only 'fields' (attributes, and not columns, table or join_on) for %s", ErrConfig, a.File)
+		}
+	} else if len(a.FeatureTypes) > 0 || a.Upstream != 0 || a.Downstream != 0 {
+		return fmt.Errorf("%w: feature_types, upstream and downstream can only be used with a GFF3 or GTF file: %s", ErrConfig, a.File)
+	}
+	if a.Upstream < 0 || a.Downstream < 0 {
+		return fmt.Errorf("%w: upstream and downstream must not be negative for %s", ErrConfig, a.File)
+	}
+	if IsVariantSource(a.File) {
+		if a.Fields == nil || a.Columns != nil || a.Table != "" || a.JoinOn != "" || a.Chain != "" {
+			return fmt.Errorf("%w: must specify only 'fields' (and not columns, table, join_on or chain) for %s", ErrConfig, a.File)
+		}
+		if strings.HasSuffix(a.File, ":") && a.Fasta == "" {
+			return fmt.Errorf("%w: no file or reference given for %s (use fasta or -fasta)", ErrConfig, a.File)
+		}
+	} else if IsCram(a.File) {
+		if a.Fasta == "" {
+			return fmt.Errorf("%w: no reference given for the CRAM %s (use fasta or -fasta)", ErrConfig, a.File)
+		}
+	} else if a.Fasta != "" && a.Chain == "" {
+		return fmt.Errorf("%w: fasta can only be used with a CRAM, a chain or a source such as consequence: or fasta: that is computed from each variant: %s", ErrConfig, a.File)
+	}
+	if IsAlignments(a.File) {
 		if nil == a.Columns && nil == a.Fields {
 			a.Columns = []int{1}
 		}
@@ -139,25 +340,25 @@ func CheckAnno(a *Annotation) error {
 	if a.Fields == nil {
 		// Columns: BED/BAM
 		if a.Columns == nil {
-			return fmt.Errorf("must specify either 'fields' or 'columns' for %s", a.File)
+			return fmt.Errorf("%w: must specify either 'fields' or 'columns' for %s", ErrConfig, a.File)
 		}
-		if len(a.Ops) != len(a.Columns) && !strings.HasSuffix(a.File, ".bam") {
-			return fmt.Errorf("must specify same # of 'columns' as 'ops' for %s", a.File)
+		if len(a.Ops) != len(a.Columns) && !IsAlignments(a.File) {
+			return fmt.Errorf("%w: must specify same # of 'columns' as 'ops' for %s", ErrConfig, a.File)
 		}
-		if len(a.Names) != len(a.Columns) && !strings.HasSuffix(a.File, ".bam") {
-			return fmt.Errorf("must specify same # of 'names' as 'ops' for %s", a.File)
+		if len(a.Names) != len(a.Columns) && !IsAlignments(a.File) {
+			return fmt.Errorf("%w: must specify same # of 'names' as 'ops' for %s", ErrConfig, a.File)
 		}
 	} else {
 		// Fields: VCF
 		if a.Columns != nil {
-			if strings.HasSuffix(a.File, ".bam") {
+			if IsAlignments(a.File) {
 				a.Columns = make([]int, len(a.Ops))
 			} else {
-				return fmt.Errorf("specify only 'fields' or 'columns' not both %s", a.File)
+				return fmt.Errorf("%w: specify only 'fields' or 'columns' not both %s", ErrConfig, a.File)
 			}
 		}
 		if len(a.Ops) != len(a.Fields) {
-			return fmt.Errorf("must specify same # of 'fields' as 'ops' for %s", a.File)
+			return fmt.Errorf("%w: must specify same # of 'fields' as 'ops' for %s", ErrConfig, a.File)
 		}
 	}
 	if len(a.Names) == 0 {
@@ -166,20 +367,18 @@ func CheckAnno(a *Annotation) error {
 	return nil
 }
 
-func ReadLua(lua string) string {
-	var luaString string
-	if lua != "" {
-		luaReader, err := xopen.Ropen(lua)
-		if err != nil {
-			log.Fatal(err)
-		}
-		luaBytes, err := ioutil.ReadAll(luaReader)
-		if err != nil {
-			log.Fatal(err)
-		}
-		luaString = string(luaBytes)
-	} else {
-		luaString = ""
+// ReadLua returns the contents of the lua file or an empty string if lua is empty.
+func ReadLua(lua string) (string, error) {
+	if lua == "" {
+		return "", nil
+	}
+	luaReader, err := xopen.Ropen(lua)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrLua, err)
+	}
+	luaBytes, err := ioutil.ReadAll(luaReader)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrLua, err)
 	}
-	return luaString
+	return string(luaBytes), nil
 }
@@ -0,0 +1,350 @@
+// Package sqlite provides annotations from a table in a SQLite database using a pure-Go
+// driver. Importing the package registers it as a source for files starting with Scheme.
+//
+// A source is given as:
+//
+//	sqlite://path/to/file.db?table=variants&chrom=chrom&start=pos&end=end&ref=ref&alt=alt&fields=a,b
+//
+// where start is the 1-based position and end (optional) is the 1-based, inclusive end.
+// If ref and alt are given, each row is used like a VCF record with the fields as INFO so that
+// alleles are matched as for a VCF. Otherwise, each row is used like a BED interval with
+// columns chrom, start, end and then the fields in order.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/api"
+	"github.com/brentp/vcfgo"
+	_ "modernc.org/sqlite"
+)
+
+// Scheme is the prefix of a File that is opened as a SQLite table.
+const Scheme = "sqlite://"
+
+// Table is an opened SQLite table. It meets api.SourceBackend.
+type Table struct {
+	db    *sql.DB
+	stmt  *sql.Stmt
+	table string
+	// column names.
+	chrom, start, end, ref, alt string
+	fields                      []string
+	types                       map[string]string
+	header                      *vcfgo.Header
+	// maxLen is the longest row so that a query can use the index on start.
+	maxLen int64
+}
+
+func quote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Open opens the table given by uri (see the package documentation).
+func Open(uri string) (*Table, error) {
+	if !strings.HasPrefix(uri, Scheme) {
+		return nil, fmt.Errorf("sqlite: expected %s prefix: %s", Scheme, uri)
+	}
+	path, query := strings.TrimPrefix(uri, Scheme), ""
+	// the options follow the last '?' so that the path may contain one.
+	if i := strings.LastIndex(path, "?"); i != -1 {
+		path, query = path[:i], path[i+1:]
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %s: %s", uri, err)
+	}
+	t := &Table{table: params.Get("table"), chrom: params.Get("chrom"), start: params.Get("start"),
+		end: params.Get("end"), ref: params.Get("ref"), alt: params.Get("alt")}
+	if f := params.Get("fields"); f != "" {
+		t.fields = strings.Split(f, ",")
+	}
+	if t.table == "" || t.chrom == "" || t.start == "" {
+		return nil, fmt.Errorf("sqlite: table, chrom and start are required: %s", uri)
+	}
+	if (t.ref == "") != (t.alt == "") {
+		return nil, fmt.Errorf("sqlite: must specify both or neither of ref and alt: %s", uri)
+	}
+
+	// mode=ro so that a missing file is not created and the database is never modified.
+	// The path is escaped so that a '?', '#' or '%' in it is not read as part of the URI.
+	dsn := url.URL{Scheme: "file", Opaque: url.PathEscape(path), RawQuery: "mode=ro"}
+	if t.db, err = sql.Open("sqlite", dsn.String()); err != nil {
+		return nil, err
+	}
+	if err := t.init(); err != nil {
+		t.db.Close()
+		return nil, fmt.Errorf("sqlite: %s: %s", path, err)
+	}
+	return t, nil
+}
+
+func (t *Table) init() error {
+	if err := t.readTypes(); err != nil {
+		return err
+	}
+	for _, c := range append([]string{t.chrom, t.start, t.end, t.ref, t.alt}, t.fields...) {
+		if _, ok := t.types[c]; c != "" && !ok {
+			return fmt.Errorf("column %s not found in table %s", c, t.table)
+		}
+	}
+	if err := t.checkIndex(); err != nil {
+		return err
+	}
+
+	length := "1"
+	if t.end != "" {
+		length = fmt.Sprintf("%s - %s + 1", quote(t.end), quote(t.start))
+	} else if t.ref != "" {
+		length = fmt.Sprintf("length(%s)", quote(t.ref))
+	}
+	var m sql.NullInt64
+	if err := t.db.QueryRow(fmt.Sprintf("SELECT MAX(%s) FROM %s", length, quote(t.table))).Scan(&m); err != nil {
+		return err
+	}
+	t.maxLen = m.Int64
+
+	t.header = vcfgo.NewHeader()
+	for _, f := range t.fields {
+		t.header.Infos[f] = &vcfgo.Info{Id: f, Type: t.types[f], Number: "1", Description: t.description(f)}
+	}
+
+	cols := []string{quote(t.chrom), quote(t.start)}
+	for _, c := range append([]string{t.end, t.ref, t.alt}, t.fields...) {
+		if c != "" {
+			cols = append(cols, quote(c))
+		}
+	}
+	var err error
+	t.stmt, err = t.db.Prepare(fmt.Sprintf("SELECT %s FROM %s WHERE %s IN (?, ?) AND %s BETWEEN ? AND ? ORDER BY %s",
+		strings.Join(cols, ", "), quote(t.table), quote(t.chrom), quote(t.start), quote(t.start)))
+	return err
+}
+
+// readTypes sets the VCF type of each column from its declared type using the
+// affinity rules of SQLite.
+func (t *Table) readTypes() error {
+	rows, err := t.db.Query("SELECT name, type FROM pragma_table_info(?)", t.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	t.types = make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return err
+		}
+		typ = strings.ToUpper(typ)
+		switch {
+		case strings.Contains(typ, "INT"):
+			t.types[name] = "Integer"
+		case strings.Contains(typ, "REAL"), strings.Contains(typ, "FLOA"), strings.Contains(typ, "DOUB"):
+			t.types[name] = "Float"
+		default:
+			t.types[name] = "String"
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(t.types) == 0 {
+		return fmt.Errorf("table %s not found", t.table)
+	}
+	return nil
+}
+
+// checkIndex warns with the statement to create an index on chrom, start if the table
+// does not have one, as queries will then scan the table.
+func (t *Table) checkIndex() error {
+	rows, err := t.db.Query(`SELECT il.name, ii.seqno, ii.name FROM pragma_index_list(?) AS il,
+		pragma_index_info(il.name) AS ii WHERE ii.seqno < 2`, t.table)
+	if err != nil {
+		return err
+	}
+	cols := make(map[string][2]string)
+	for rows.Next() {
+		var index, col sql.NullString
+		var seq int
+		if err := rows.Scan(&index, &seq, &col); err != nil {
+			rows.Close()
+			return err
+		}
+		c := cols[index.String]
+		c[seq] = col.String
+		cols[index.String] = c
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range cols {
+		if c[0] == t.chrom && c[1] == t.start {
+			return nil
+		}
+	}
+	name := quote("vcfanno_" + t.table + "_" + t.chrom + "_" + t.start)
+	log.Printf("WARNING: no index on (%s, %s) for table %s. queries will be slow. create one with: CREATE INDEX %s ON %s(%s, %s);",
+		t.chrom, t.start, t.table, name, quote(t.table), quote(t.chrom), quote(t.start))
+	return nil
+}
+
+func (t *Table) description(field string) string {
+	return fmt.Sprintf("column %s of table %s", field, t.table)
+}
+
+// FieldColumn gives the column of field after chrom, start and end for a table without ref
+// and alt.
+func (t *Table) FieldColumn(field string) int {
+	if t.ref != "" {
+		return -1
+	}
+	for i, f := range t.fields {
+		if f == field {
+			return 4 + i
+		}
+	}
+	return -1
+}
+
+// Header gives the Type from the declared type of the column. Number is always 1.
+func (t *Table) Header(field string) (string, string, string) {
+	if typ, ok := t.types[field]; ok {
+		return typ, "1", t.description(field)
+	}
+	return "", "1", ""
+}
+
+// Close closes the database.
+func (t *Table) Close() error {
+	if t.stmt != nil {
+		t.stmt.Close()
+	}
+	return t.db.Close()
+}
+
+// Query returns the rows overlapping region.
+func (t *Table) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	chrom, other := region.Chrom(), "chr"+region.Chrom()
+	if strings.HasPrefix(chrom, "chr") {
+		other = chrom[3:]
+	}
+	// start is 1-based so a row can only overlap if region.Start() - maxLen < start <= region.End().
+	rows, err := t.stmt.Query(chrom, other, int64(region.Start())-t.maxLen+1, int64(region.End()))
+	if err != nil {
+		return nil, err
+	}
+	it := &iterator{t: t, rows: rows, region: region}
+	n := 2 + len(t.fields)
+	for _, c := range []string{t.end, t.ref, t.alt} {
+		if c != "" {
+			n++
+		}
+	}
+	it.vals = make([]sql.NullString, n)
+	it.ptrs = make([]interface{}, n)
+	for i := range it.vals {
+		it.ptrs[i] = &it.vals[i]
+	}
+	return it, nil
+}
+
+type iterator struct {
+	t      *Table
+	rows   *sql.Rows
+	region interfaces.IPosition
+	vals   []sql.NullString
+	ptrs   []interface{}
+}
+
+func (it *iterator) Close() error {
+	return it.rows.Close()
+}
+
+func (it *iterator) Next() (interfaces.Relatable, error) {
+	t := it.t
+	for it.rows.Next() {
+		if err := it.rows.Scan(it.ptrs...); err != nil {
+			return nil, err
+		}
+		r, err := t.row(it.vals)
+		if err != nil {
+			return nil, err
+		}
+		if r.End() > it.region.Start() {
+			return r, nil
+		}
+	}
+	if err := it.rows.Err(); err != nil {
+		return nil, err
+	}
+	it.rows.Close()
+	return nil, io.EOF
+}
+
+func (t *Table) row(vals []sql.NullString) (interfaces.Relatable, error) {
+	chrom := vals[0].String
+	start, err := strconv.ParseInt(vals[1].String, 10, 64)
+	if err != nil || start < 1 {
+		return nil, fmt.Errorf("sqlite: bad %s in table %s: '%s'", t.start, t.table, vals[1].String)
+	}
+	end := start
+	i := 2
+	if t.end != "" {
+		if vals[i].Valid {
+			if end, err = strconv.ParseInt(vals[i].String, 10, 64); err != nil || end < start {
+				return nil, fmt.Errorf("sqlite: bad %s in table %s: '%s'", t.end, t.table, vals[i].String)
+			}
+		}
+		i++
+	}
+
+	if t.ref == "" {
+		fields := make([][]byte, 3, 3+len(t.fields))
+		fields[0], fields[1], fields[2] = []byte(chrom), []byte(strconv.FormatInt(start-1, 10)), []byte(strconv.FormatInt(end, 10))
+		for _, v := range vals[i:] {
+			fields = append(fields, []byte(v.String))
+		}
+		return parsers.NewInterval(chrom, uint32(start-1), uint32(end), fields, 0, nil), nil
+	}
+
+	v := &vcfgo.Variant{Chromosome: chrom, Pos: uint64(start), Reference: vals[i].String,
+		Alternate: strings.Split(vals[i+1].String, ","), Id_: ".", Filter: ".", Header: t.header}
+	info := make([]byte, 0, 64)
+	for k, val := range vals[i+2:] {
+		if !val.Valid || val.String == "" {
+			continue
+		}
+		s := strings.Replace(val.String, ";", ",", -1)
+		switch t.fields[k] {
+		case "ID":
+			v.Id_ = s
+			continue
+		case "FILTER":
+			v.Filter = s
+			continue
+		}
+		if len(info) > 0 {
+			info = append(info, ';')
+		}
+		info = append(info, t.fields[k]...)
+		info = append(info, '=')
+		info = append(info, s...)
+	}
+	v.Info_ = vcfgo.NewInfoByte(info, t.header)
+	return interfaces.AsRelatable(v), nil
+}
+
+func init() {
+	if err := api.RegisterBackend(Scheme, func(uri string, _ api.BackendOptions) (api.SourceBackend, error) { return Open(uri) }); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,173 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfanno/shared"
+	"github.com/brentp/vcfgo"
+	"github.com/brentp/xopen"
+)
+
+// exacDB writes the variants from the example ExAC VCF to a table.
+func exacDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "exac.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE variants (chrom TEXT, pos INTEGER, ref TEXT, alt TEXT, rsid TEXT, an INTEGER, dp INT, gq REAL);
+		CREATE TABLE genes (chrom TEXT, start INTEGER, stop INTEGER, gene TEXT);
+		INSERT INTO genes VALUES ('1', 17600, 17697, 'A'), ('1', 17697, 17730, 'B'), ('2', 1, 1000000, 'C');`); err != nil {
+		t.Fatal(err)
+	}
+	rdr, err := xopen.Ropen("../example/exac.vcf.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	vcf, err := vcfgo.NewReader(rdr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v := vcf.Read(); v != nil; v = vcf.Read() {
+		an, _ := v.Info().Get("AN_Adj")
+		dp, _ := v.Info().Get("DP")
+		gq, _ := v.Info().Get("GQ_MEAN")
+		id := sql.NullString{String: v.Id_, Valid: v.Id_ != "."}
+		if _, err := db.Exec("INSERT INTO variants VALUES (?, ?, ?, ?, ?, ?, ?, ?)", v.Chromosome, v.Pos, v.Reference,
+			strings.Join(v.Alternate, ","), id, an, dp, gq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func run(t *testing.T, cfg *shared.Config) []string {
+	t.Helper()
+	rdr, err := xopen.Ropen("../example/query.vcf.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	var out bytes.Buffer
+	if _, err := shared.Run(context.Background(), *cfg, rdr, &out, shared.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if l[0] != '#' {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func TestMatchesVCF(t *testing.T) {
+	db := exacDB(t)
+	ops, names := []string{"self", "max", "self", "mean"}, []string{"an", "dp", "id", "gq"}
+	exp := run(t, shared.NewConfig("").AddFields("../example/exac.vcf.gz", []string{"AN_Adj", "DP", "ID", "GQ_MEAN"}, ops, names))
+	got := run(t, shared.NewConfig("").AddTable(db, "variants", []string{"chrom", "pos"}, []string{"ref", "alt"},
+		[]string{"an", "dp", "rsid", "gq"}, ops, names))
+	if len(exp) != len(got) {
+		t.Fatalf("expected %d variants, got %d", len(exp), len(got))
+	}
+	annotated := 0
+	for i := range exp {
+		g := got[i]
+		if exp[i] != g {
+			t.Fatalf("line %d differs:\n%s\n%s", i, exp[i], g)
+		}
+		if strings.Contains(g, ";an=") {
+			annotated++
+		}
+	}
+	if annotated == 0 {
+		t.Fatal("expected annotated variants")
+	}
+}
+
+func TestIntervals(t *testing.T) {
+	db := exacDB(t)
+	got := run(t, shared.NewConfig("").AddTable(db, "genes", []string{"chrom", "start", "stop"}, nil,
+		[]string{"gene"}, []string{"concat"}, []string{"gene"}))
+	conn, err := sql.Open("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND tbl_name='genes'").Scan(&n); err != nil || n != 0 {
+		t.Errorf("expected the database not to be modified, got %d indexes (%v)", n, err)
+	}
+
+	// as for a BED, the first columns are the chrom, 0-based start and end.
+	tbl, err := Open(Scheme + db + "?table=genes&chrom=chrom&start=start&end=stop&fields=gene")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	it, err := tbl.Query(parsers.NewInterval("2", 0, 10, nil, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := it.Next(); err != nil || string(bytes.Join(r.(*parsers.Interval).Fields, []byte("\t"))) != "2\t0\t1000000\tC" {
+		t.Errorf("expected the columns of gene C, got %v (%v)", r, err)
+	}
+	it.Close()
+
+	genes := make(map[string]string)
+	for _, l := range got {
+		toks := strings.Split(l, "\t")
+		if i := strings.Index(toks[7], "gene="); i != -1 {
+			genes[toks[0]+":"+toks[1]] = toks[7][i+5:]
+		}
+	}
+	for pos, exp := range map[string]string{"1:17626": "A", "1:17697": "A,B", "1:17730": "B", "1:17746": "", "2:98688": "C"} {
+		if genes[pos] != exp {
+			t.Errorf("%s: expected gene=%s, got %s", pos, exp, genes[pos])
+		}
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	db := exacDB(t)
+	for _, uri := range []string{
+		Scheme + db + "?table=variants",
+		Scheme + db + "?table=nope&chrom=chrom&start=pos",
+		Scheme + db + "?table=variants&chrom=chrom&start=pos&fields=missing",
+		Scheme + db + "?table=variants&chrom=chrom&start=pos&ref=ref",
+		Scheme + filepath.Join(t.TempDir(), "missing.db") + "?table=variants&chrom=chrom&start=pos",
+	} {
+		if tbl, err := Open(uri); err == nil {
+			tbl.Close()
+			t.Errorf("expected error for %s", uri)
+		}
+	}
+}
+
+func TestEscapedPath(t *testing.T) {
+	db := exacDB(t)
+	// each of these was read as part of the URI and opened a different file.
+	path := filepath.Join(filepath.Dir(db), "ex?ac#1%41.db")
+	if err := os.Rename(db, path); err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := Open(Scheme + path + "?table=variants&chrom=chrom&start=pos&fields=rsid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Close()
+	if tbl, err := Open(Scheme + db + "?table=variants&chrom=chrom&start=pos"); err == nil {
+		tbl.Close()
+		t.Errorf("expected error for %s", db)
+	}
+}
@@ -0,0 +1,372 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/vcfgo"
+)
+
+// ErrUnsorted is returned by a Builder when records are not sorted by chrom and position.
+var ErrUnsorted = errors.New("store: records must be sorted by chromosome and position")
+
+// blockSize is the number of records that are compressed together.
+const blockSize = 1024
+
+// Record is a single entry added to a Builder.
+type Record struct {
+	Chrom string
+	// Pos is the 0-based start.
+	Pos uint32
+	// End is used only to index the record; the end of the annotation is found from
+	// the Ref, Alt and fields (e.g. SVLEN) as it is for a VCF.
+	End    uint32
+	Ref    string
+	Alt    []string
+	ID     string
+	Filter string
+	// Values holds the text of each Field as it would appear in the INFO ("" for missing).
+	// For a Flag, any non-empty value indicates that it is set.
+	Values []string
+}
+
+// Builder writes a store.
+type Builder struct {
+	w   *countWriter
+	idx index
+
+	blk     bytes.Buffer
+	fw      *flate.Writer
+	n       int
+	cur     block
+	lastPos uint32
+	closed  bool
+	seen    map[string]bool
+	scratch [binary.MaxVarintLen64]byte
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewBuilder returns a Builder that writes a store with the given fields to w.
+// hasID and hasFilter indicate that the ID and FILTER of each record are kept.
+func NewBuilder(w io.Writer, fields []Field, hasID bool, hasFilter bool) *Builder {
+	return &Builder{w: &countWriter{w: w}, idx: index{Fields: fields, HasID: hasID, HasFilter: hasFilter},
+		seen: make(map[string]bool), cur: block{Chrom: -1}}
+}
+
+func (b *Builder) uvarint(v uint64) {
+	n := binary.PutUvarint(b.scratch[:], v)
+	b.blk.Write(b.scratch[:n])
+}
+
+func (b *Builder) str(s string) {
+	b.uvarint(uint64(len(s)))
+	b.blk.WriteString(s)
+}
+
+// Add adds a record. Records must be added in sorted order.
+func (b *Builder) Add(r Record) error {
+	if len(r.Values) != len(b.idx.Fields) {
+		return fmt.Errorf("store: expected %d values, got %d", len(b.idx.Fields), len(r.Values))
+	}
+	if b.cur.Chrom == -1 || r.Chrom != b.idx.Chroms[b.cur.Chrom] {
+		if b.seen[r.Chrom] {
+			return fmt.Errorf("%w: %s:%d", ErrUnsorted, r.Chrom, r.Pos+1)
+		}
+		if err := b.flush(); err != nil {
+			return err
+		}
+		b.seen[r.Chrom] = true
+		b.idx.Chroms = append(b.idx.Chroms, r.Chrom)
+		b.cur = block{Chrom: len(b.idx.Chroms) - 1}
+		b.lastPos = 0
+	} else if r.Pos < b.lastPos {
+		return fmt.Errorf("%w: %s:%d", ErrUnsorted, r.Chrom, r.Pos+1)
+	}
+	if b.n == blockSize {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	if b.n == 0 {
+		b.cur.Start, b.cur.MaxEnd = r.Pos, r.End
+		b.lastPos = r.Pos
+	}
+	if r.End > b.cur.MaxEnd {
+		b.cur.MaxEnd = r.End
+	}
+
+	b.uvarint(uint64(r.Pos - b.lastPos))
+	b.lastPos = r.Pos
+	b.str(r.Ref)
+	b.uvarint(uint64(len(r.Alt)))
+	for _, a := range r.Alt {
+		b.str(a)
+	}
+	if b.idx.HasID {
+		b.str(r.ID)
+	}
+	if b.idx.HasFilter {
+		b.str(r.Filter)
+	}
+	for i, f := range b.idx.Fields {
+		b.value(f, r.Values[i])
+	}
+	b.n++
+	return nil
+}
+
+// value writes val in binary if it can be written back as text with the same value.
+func (b *Builder) value(f Field, val string) {
+	if val == "" {
+		b.blk.WriteByte(tagMissing)
+		return
+	}
+	if f.Type == "Flag" {
+		b.blk.WriteByte(tagFlag)
+		return
+	}
+	if f.Number == "1" {
+		switch f.Type {
+		case "Integer":
+			if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+				b.blk.WriteByte(tagInt)
+				k := binary.PutVarint(b.scratch[:], n)
+				b.blk.Write(b.scratch[:k])
+				return
+			}
+		case "Float":
+			if v, err := strconv.ParseFloat(val, 64); err == nil && !math.IsInf(v, 0) && !math.IsNaN(v) {
+				b.blk.WriteByte(tagFloat)
+				binary.LittleEndian.PutUint64(b.scratch[:8], math.Float64bits(v))
+				b.blk.Write(b.scratch[:8])
+				return
+			}
+		}
+	}
+	b.blk.WriteByte(tagString)
+	b.str(val)
+}
+
+func (b *Builder) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	b.cur.Offset = b.w.n
+	if b.fw == nil {
+		var err error
+		if b.fw, err = flate.NewWriter(b.w, flate.DefaultCompression); err != nil {
+			return err
+		}
+	} else {
+		b.fw.Reset(b.w)
+	}
+	if _, err := b.fw.Write(b.blk.Bytes()); err != nil {
+		return err
+	}
+	if err := b.fw.Close(); err != nil {
+		return err
+	}
+	b.cur.Size = int32(b.w.n - b.cur.Offset)
+	b.idx.Blocks = append(b.idx.Blocks, b.cur)
+	b.blk.Reset()
+	b.n = 0
+	return nil
+}
+
+// Close writes the remaining records and the index. It does not close the underlying writer.
+func (b *Builder) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if err := b.flush(); err != nil {
+		return err
+	}
+	off := b.w.n
+	if err := gob.NewEncoder(b.w).Encode(&b.idx); err != nil {
+		return err
+	}
+	var footer [8]byte
+	binary.LittleEndian.PutUint64(footer[:], uint64(off))
+	if _, err := b.w.Write(footer[:]); err != nil {
+		return err
+	}
+	_, err := b.w.Write(magic)
+	return err
+}
+
+// structural fields are always kept so that the end of each annotation is the same
+// as in the VCF. SVLEN and END are kept even when the header does not declare them
+// (vcfgo reads them regardless) using the Type and Number from the VCF spec.
+var structural = []Field{
+	{Name: "SVLEN", Type: "Integer", Number: ".", Description: "Difference in length between REF and ALT alleles"},
+	{Name: "END", Type: "Integer", Number: "1", Description: "End position of the variant described in this record"},
+	{Name: "CIPOS"},
+	{Name: "CIEND"},
+}
+
+// BuildVCF writes a store to w with the given fields (which may include ID and FILTER)
+// from the VCF in r. The VCF must be sorted.
+func BuildVCF(r io.Reader, fields []string, w io.Writer) (int, error) {
+	rdr, err := vcfgo.NewReader(r, true)
+	if err != nil {
+		return 0, err
+	}
+	var hasID, hasFilter bool
+	var flds []Field
+	have := make(map[string]bool)
+	for _, name := range fields {
+		switch name {
+		case "ID":
+			hasID = true
+			continue
+		case "FILTER":
+			hasFilter = true
+			continue
+		}
+		h, ok := rdr.Header.Infos[name]
+		if !ok {
+			return 0, fmt.Errorf("store: field %s not found in header", name)
+		}
+		if !have[name] {
+			flds = append(flds, Field{Name: name, Type: h.Type, Number: h.Number, Description: h.Description})
+			have[name] = true
+		}
+	}
+	for _, f := range structural {
+		if have[f.Name] {
+			continue
+		}
+		if h, ok := rdr.Header.Infos[f.Name]; ok {
+			flds = append(flds, Field{Name: f.Name, Type: h.Type, Number: h.Number, Description: h.Description})
+		} else if f.Type != "" {
+			flds = append(flds, f)
+		}
+	}
+
+	bld := NewBuilder(w, flds, hasID, hasFilter)
+	n := 0
+	for {
+		v := rdr.Read()
+		if v == nil {
+			break
+		}
+		rec := Record{Chrom: v.Chromosome, Pos: v.Start(), End: v.End(), Ref: v.Reference, Alt: v.Alternate,
+			ID: v.Id_, Filter: v.Filter, Values: make([]string, len(flds))}
+		if info, ok := v.Info_.(*vcfgo.InfoByte); ok {
+			for i, f := range flds {
+				rec.Values[i] = string(info.SGet(f.Name))
+			}
+		}
+		if err := bld.Add(rec); err != nil {
+			return n, err
+		}
+		n++
+		if n%1000 == 0 {
+			rdr.Clear()
+		}
+	}
+	return n, bld.Close()
+}
+
+// TSVOptions describe which columns of a tab-delimited file are used by BuildTSV.
+// All column numbers are 1-based.
+type TSVOptions struct {
+	// Chrom, Pos (1-based), Ref and Alt columns. Defaults to 1, 2, 3, 4.
+	Key [4]int
+	// Columns to keep with their Names and Types (Integer, Float or String).
+	Columns []int
+	Names   []string
+	Types   []string
+}
+
+// BuildTSV writes a store to w from a sorted, tab-delimited file (e.g. CADD) in r.
+// Lines starting with '#' are skipped. The columns are stored as fields with Number=1.
+func BuildTSV(r io.Reader, opts TSVOptions, w io.Writer) (int, error) {
+	if opts.Key == [4]int{} {
+		opts.Key = [4]int{1, 2, 3, 4}
+	}
+	if len(opts.Names) != len(opts.Columns) {
+		return 0, fmt.Errorf("store: must specify same # of names as columns")
+	}
+	flds := make([]Field, len(opts.Columns))
+	for i, c := range opts.Columns {
+		t := "String"
+		if i < len(opts.Types) {
+			t = opts.Types[i]
+		}
+		switch t {
+		case "Integer", "Float", "String":
+		default:
+			return 0, fmt.Errorf("store: unknown type %s for %s", t, opts.Names[i])
+		}
+		flds[i] = Field{Name: opts.Names[i], Type: t, Number: "1", Description: fmt.Sprintf("column %d", c)}
+	}
+	need := 0
+	for _, c := range append(opts.Key[:], opts.Columns...) {
+		if c < 1 {
+			return 0, fmt.Errorf("store: invalid column: %d", c)
+		}
+		if c > need {
+			need = c
+		}
+	}
+
+	bld := NewBuilder(w, flds, false, false)
+	br := bufio.NewReaderSize(r, 65536)
+	n, line := 0, 0
+	for {
+		l, err := br.ReadString('\n')
+		if len(l) == 0 && err != nil {
+			if err == io.EOF {
+				break
+			}
+			return n, err
+		}
+		line++
+		l = strings.TrimRight(l, "\r\n")
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		toks := strings.Split(l, "\t")
+		if len(toks) < need {
+			return n, fmt.Errorf("store: expected at least %d columns at line %d", need, line)
+		}
+		pos, err := strconv.Atoi(toks[opts.Key[1]-1])
+		if err != nil || pos < 1 {
+			return n, fmt.Errorf("store: bad position at line %d: %s", line, toks[opts.Key[1]-1])
+		}
+		ref := toks[opts.Key[2]-1]
+		rec := Record{Chrom: toks[opts.Key[0]-1], Pos: uint32(pos - 1), End: uint32(pos - 1 + len(ref)), Ref: ref,
+			Alt: strings.Split(toks[opts.Key[3]-1], ","), Values: make([]string, len(flds))}
+		for i, c := range opts.Columns {
+			if v := toks[c-1]; v != "." {
+				rec.Values[i] = v
+			}
+		}
+		if err := bld.Add(rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, bld.Close()
+}
@@ -0,0 +1,340 @@
+// Package store implements a compact, indexed binary file of annotations keyed by
+// chrom, position, ref and alt. It holds only the fields that were extracted when it
+// was built so annotating with it avoids parsing the full INFO of each record.
+// Importing the package registers it as a source for files ending in ".vst".
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/vcfanno/api"
+	"github.com/brentp/vcfgo"
+)
+
+// Suffix is the file suffix used to open a file as a Store.
+const Suffix = ".vst"
+
+var magic = []byte("VCFANNO-STORE\x01")
+
+// ErrFormat is returned when a file is not a valid store.
+var ErrFormat = errors.New("store: invalid file format")
+
+// Field describes a value in the store. It has the same meaning as an ##INFO header line.
+type Field struct {
+	Name        string
+	Type        string
+	Number      string
+	Description string
+}
+
+// value tags. Integer and Float values with Number=1 are stored in binary; other
+// values are stored as their text.
+const (
+	tagMissing byte = iota
+	tagInt
+	tagFloat
+	tagString
+	tagFlag
+)
+
+type block struct {
+	Chrom  int
+	Start  uint32
+	MaxEnd uint32
+	Offset int64
+	Size   int32
+}
+
+type index struct {
+	Fields    []Field
+	HasID     bool
+	HasFilter bool
+	Chroms    []string
+	Blocks    []block
+}
+
+// Store is an opened store file. It meets api.SourceBackend and can be queried
+// concurrently.
+type Store struct {
+	f      *os.File
+	idx    index
+	header *vcfgo.Header
+	chroms map[string]int
+	// blocks for each chrom and the running max of their ends to find the first
+	// block that can overlap a region.
+	byChrom [][]block
+	maxEnds [][]uint32
+}
+
+// Open opens the store at path.
+func Open(path string) (*Store, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{f: f}
+	if err := s.readIndex(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: %s", ErrFormat, path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) readIndex() error {
+	st, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	footer := make([]byte, 8+len(magic))
+	if st.Size() < int64(len(footer)) {
+		return io.ErrUnexpectedEOF
+	}
+	if _, err := s.f.ReadAt(footer, st.Size()-int64(len(footer))); err != nil {
+		return err
+	}
+	if !bytes.Equal(footer[8:], magic) {
+		return errors.New("bad magic")
+	}
+	off := int64(binary.LittleEndian.Uint64(footer[:8]))
+	r := io.NewSectionReader(s.f, off, st.Size()-int64(len(footer))-off)
+	if err := gob.NewDecoder(r).Decode(&s.idx); err != nil {
+		return err
+	}
+
+	s.header = vcfgo.NewHeader()
+	for _, f := range s.idx.Fields {
+		s.header.Infos[f.Name] = &vcfgo.Info{Id: f.Name, Type: f.Type, Number: f.Number, Description: f.Description}
+	}
+	s.chroms = make(map[string]int, len(s.idx.Chroms))
+	for i, c := range s.idx.Chroms {
+		s.chroms[c] = i
+	}
+	s.byChrom = make([][]block, len(s.idx.Chroms))
+	s.maxEnds = make([][]uint32, len(s.idx.Chroms))
+	for _, b := range s.idx.Blocks {
+		var m uint32
+		if n := len(s.maxEnds[b.Chrom]); n > 0 {
+			m = s.maxEnds[b.Chrom][n-1]
+		}
+		if b.MaxEnd > m {
+			m = b.MaxEnd
+		}
+		s.byChrom[b.Chrom] = append(s.byChrom[b.Chrom], b)
+		s.maxEnds[b.Chrom] = append(s.maxEnds[b.Chrom], m)
+	}
+	return nil
+}
+
+// Fields returns the fields in the store.
+func (s *Store) Fields() []Field {
+	return s.idx.Fields
+}
+
+// Header gives the Type, Number and Description of field.
+func (s *Store) Header(field string) (string, string, string) {
+	if h, ok := s.header.Infos[field]; ok {
+		return h.Type, h.Number, h.Description
+	}
+	return "", "1", ""
+}
+
+// Close closes the file.
+func (s *Store) Close() error {
+	return s.f.Close()
+}
+
+func (s *Store) chrom(chrom string) (int, bool) {
+	if i, ok := s.chroms[chrom]; ok {
+		return i, true
+	}
+	if strings.HasPrefix(chrom, "chr") {
+		i, ok := s.chroms[chrom[3:]]
+		return i, ok
+	}
+	i, ok := s.chroms["chr"+chrom]
+	return i, ok
+}
+
+// Query returns the records overlapping region.
+func (s *Store) Query(region interfaces.IPosition) (interfaces.RelatableIterator, error) {
+	it := &iterator{s: s, region: region}
+	ci, ok := s.chrom(region.Chrom())
+	if !ok {
+		return it, nil
+	}
+	ends := s.maxEnds[ci]
+	first := sort.Search(len(ends), func(i int) bool { return ends[i] > region.Start() })
+	for _, b := range s.byChrom[ci][first:] {
+		if b.Start >= region.End() {
+			break
+		}
+		it.blocks = append(it.blocks, b)
+	}
+	return it, nil
+}
+
+type iterator struct {
+	s      *Store
+	region interfaces.IPosition
+	blocks []block
+	buf    *bytes.Reader
+	chrom  string
+	pos    uint32
+}
+
+func (it *iterator) Close() error { return nil }
+
+func (it *iterator) Next() (interfaces.Relatable, error) {
+	for {
+		if it.buf == nil || it.buf.Len() == 0 {
+			if len(it.blocks) == 0 {
+				return nil, io.EOF
+			}
+			if err := it.load(it.blocks[0]); err != nil {
+				return nil, err
+			}
+			it.blocks = it.blocks[1:]
+			continue
+		}
+		v, err := it.s.decode(it.buf, it.chrom, &it.pos)
+		if err != nil {
+			return nil, err
+		}
+		if v.Start() >= it.region.End() {
+			it.buf, it.blocks = nil, nil
+			return nil, io.EOF
+		}
+		if v.End() > it.region.Start() {
+			return interfaces.AsRelatable(v), nil
+		}
+	}
+}
+
+var readers = sync.Pool{New: func() interface{} { return flate.NewReader(bytes.NewReader(nil)) }}
+
+func (it *iterator) load(b block) error {
+	comp := make([]byte, b.Size)
+	if _, err := it.s.f.ReadAt(comp, b.Offset); err != nil {
+		return err
+	}
+	fr := readers.Get().(io.ReadCloser)
+	fr.(flate.Resetter).Reset(bytes.NewReader(comp), nil)
+	raw, err := io.ReadAll(fr)
+	readers.Put(fr)
+	if err != nil {
+		return err
+	}
+	it.buf = bytes.NewReader(raw)
+	it.chrom = it.s.idx.Chroms[b.Chrom]
+	it.pos = b.Start
+	return nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
+
+// decode reads the next record into a variant with an INFO of only the stored fields.
+func (s *Store) decode(r *bytes.Reader, chrom string, pos *uint32) (*vcfgo.Variant, error) {
+	d, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	*pos += uint32(d)
+	v := &vcfgo.Variant{Chromosome: chrom, Pos: uint64(*pos) + 1, Id_: ".", Filter: ".", Header: s.header}
+	if v.Reference, err = readString(r); err != nil {
+		return nil, err
+	}
+	nalt, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	v.Alternate = make([]string, nalt)
+	for i := range v.Alternate {
+		if v.Alternate[i], err = readString(r); err != nil {
+			return nil, err
+		}
+	}
+	if s.idx.HasID {
+		if v.Id_, err = readString(r); err != nil {
+			return nil, err
+		}
+	}
+	if s.idx.HasFilter {
+		if v.Filter, err = readString(r); err != nil {
+			return nil, err
+		}
+	}
+
+	info := make([]byte, 0, 64)
+	for _, f := range s.idx.Fields {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if tag == tagMissing {
+			continue
+		}
+		if len(info) > 0 {
+			info = append(info, ';')
+		}
+		info = append(info, f.Name...)
+		switch tag {
+		case tagFlag:
+			continue
+		case tagInt:
+			n, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			info = append(info, '=')
+			info = strconv.AppendInt(info, n, 10)
+		case tagFloat:
+			var b [8]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return nil, err
+			}
+			info = append(info, '=')
+			info = strconv.AppendFloat(info, math.Float64frombits(binary.LittleEndian.Uint64(b[:])), 'g', -1, 64)
+		case tagString:
+			val, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			info = append(info, '=')
+			info = append(info, val...)
+		default:
+			return nil, ErrFormat
+		}
+	}
+	v.Info_ = vcfgo.NewInfoByte(info, s.header)
+	return v, nil
+}
+
+func init() {
+	if err := api.RegisterBackend(Suffix, func(path string, _ api.BackendOptions) (api.SourceBackend, error) { return Open(path) }); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,250 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brentp/bix"
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/irelate/parsers"
+	"github.com/brentp/vcfgo"
+	"github.com/brentp/xopen"
+)
+
+func build(t testing.TB, fields []string) *Store {
+	t.Helper()
+	rdr, err := xopen.Ropen("../example/exac.vcf.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	path := filepath.Join(t.TempDir(), "exac"+Suffix)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := BuildVCF(rdr, fields, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("expected records in store")
+	}
+	f.Close()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func all(t testing.TB, q interfaces.Queryable, region interfaces.IPosition) []*vcfgo.Variant {
+	t.Helper()
+	it, err := q.Query(region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vs []*vcfgo.Variant
+	for {
+		r, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs = append(vs, r.(interfaces.VarWrap).IVariant.(*vcfgo.Variant))
+	}
+	it.Close()
+	return vs
+}
+
+func TestStoreMatchesVCF(t *testing.T) {
+	fields := []string{"AC_Adj", "AF", "AC_AFR", "DB", "ID", "FILTER"}
+	s := build(t, fields)
+	defer s.Close()
+	if len(s.Fields()) != 6 { // SVLEN and END are kept as structural fields
+		t.Fatalf("expected 6 fields, got %+v", s.Fields())
+	}
+	if htype, num, _ := s.Header("AF"); htype != "Float" || num != "A" {
+		t.Errorf("unexpected header for AF: %s %s", htype, num)
+	}
+
+	b, err := bix.New("../example/exac.vcf.gz", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, region := range []interfaces.IPosition{
+		parsers.NewInterval("1", 13000, 70000, nil, 0, nil),
+		parsers.NewInterval("chr1", 69400, 69600, nil, 0, nil),
+		parsers.NewInterval("1", 0, 1<<30, nil, 0, nil),
+		parsers.NewInterval("22", 0, 1000, nil, 0, nil),
+	} {
+		exp, got := all(t, b, region), all(t, s, region)
+		if len(exp) != len(got) {
+			t.Fatalf("%s:%d-%d: expected %d records, got %d", region.Chrom(), region.Start(), region.End(), len(exp), len(got))
+		}
+		for i, e := range exp {
+			g := got[i]
+			if e.Pos != g.Pos || e.Reference != g.Reference || strings.Join(e.Alternate, ",") != strings.Join(g.Alternate, ",") ||
+				e.Id() != g.Id() || e.Filter != g.Filter || e.End() != g.End() {
+				t.Fatalf("record %d differs: %s vs %s", i, e, g)
+			}
+			for _, f := range fields[:4] {
+				ev, eerr := e.Info().Get(f)
+				gv, gerr := g.Info().Get(f)
+				if (eerr == nil) != (gerr == nil) || fmt.Sprint(ev) != fmt.Sprint(gv) {
+					t.Fatalf("%s differs at %d: %v vs %v", f, e.Pos, ev, gv)
+				}
+			}
+		}
+	}
+}
+
+func TestStructural(t *testing.T) {
+	records := "1\t100\tsv1\tA\t<DEL>\t.\tPASS\tSVLEN=-500\n" +
+		"1\t200\tsv2\tC\t<DUP>\t.\tPASS\tEND=1200;SVTYPE=DUP\n" +
+		"1\t300\tsv3\tG\t<INV>\t.\tPASS\tEND=400;SVLEN=100\n" +
+		"1\t2000\tsnp\tT\tA\t.\tPASS\tSVTYPE=SNP\n"
+	for _, header := range []string{
+		"##INFO=<ID=SVTYPE,Number=1,Type=String,Description=\"type\">\n",
+		"##INFO=<ID=SVTYPE,Number=1,Type=String,Description=\"type\">\n" +
+			"##INFO=<ID=SVLEN,Number=.,Type=Integer,Description=\"length\">\n" +
+			"##INFO=<ID=END,Number=1,Type=Integer,Description=\"end\">\n",
+	} {
+		vcf := "##fileformat=VCFv4.2\n" + header + "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n" + records
+		var buf bytes.Buffer
+		if _, err := BuildVCF(strings.NewReader(vcf), []string{"ID", "SVTYPE"}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "sv"+Suffix)
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := all(t, s, parsers.NewInterval("1", 0, 1<<30, nil, 0, nil))
+		// sv1 ends at 600 from its SVLEN, sv2 at 1200 from its END, and sv3 at 400.
+		overlap := all(t, s, parsers.NewInterval("1", 550, 560, nil, 0, nil))
+		s.Close()
+		if len(overlap) != 2 {
+			t.Errorf("expected 2 SVs overlapping 1:551-560, got %d", len(overlap))
+		}
+
+		rdr, err := vcfgo.NewReader(strings.NewReader(vcf), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exp []*vcfgo.Variant
+		for v := rdr.Read(); v != nil; v = rdr.Read() {
+			exp = append(exp, v)
+		}
+		if len(exp) != 4 || len(got) != len(exp) {
+			t.Fatalf("expected %d records, got %d", len(exp), len(got))
+		}
+		for i, e := range exp {
+			if e.End() != got[i].End() || e.Id() != got[i].Id() {
+				t.Errorf("%s: expected end %d, got %d", e.Id(), e.End(), got[i].End())
+			}
+		}
+	}
+}
+
+func TestBuildTSV(t *testing.T) {
+	tsv := "#chrom\tpos\tref\talt\tscore\tgene\n" +
+		"1\t100\tA\tG\t1.5\tABC\n" +
+		"1\t100\tA\tT\t.\tABC\n" +
+		"1\t200\tAC\tA\t-2\tDEF\n" +
+		"2\t50\tC\tG\t0.25\t.\n"
+	var buf bytes.Buffer
+	n, err := BuildTSV(strings.NewReader(tsv), TSVOptions{Columns: []int{5, 6}, Names: []string{"score", "gene"},
+		Types: []string{"Float", "String"}}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 records, got %d", n)
+	}
+	path := filepath.Join(t.TempDir(), "t"+Suffix)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	vs := all(t, s, parsers.NewInterval("1", 99, 201, nil, 0, nil))
+	if len(vs) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(vs))
+	}
+	if v, err := vs[0].Info().Get("score"); err != nil || v.(float64) != 1.5 {
+		t.Errorf("expected score 1.5, got %v (%v)", v, err)
+	}
+	if _, err := vs[1].Info().Get("score"); err == nil {
+		t.Errorf("expected missing score")
+	}
+	if v, _ := vs[2].Info().Get("gene"); v != "DEF" || vs[2].End() != 201 {
+		t.Errorf("unexpected record: %s", vs[2])
+	}
+	if vs := all(t, s, parsers.NewInterval("2", 0, 49, nil, 0, nil)); len(vs) != 0 {
+		t.Errorf("expected no records before 2:50, got %d", len(vs))
+	}
+}
+
+func TestBuildUnsorted(t *testing.T) {
+	opts := TSVOptions{Columns: []int{5}, Names: []string{"score"}}
+	for _, tsv := range []string{
+		"1\t200\tA\tG\t1\n1\t100\tA\tG\t1\n",
+		"1\t100\tA\tG\t1\n2\t100\tA\tG\t1\n1\t300\tA\tG\t1\n",
+	} {
+		if _, err := BuildTSV(strings.NewReader(tsv), opts, io.Discard); !errors.Is(err, ErrUnsorted) {
+			t.Errorf("expected ErrUnsorted, got %v", err)
+		}
+	}
+}
+
+// BenchmarkQuery compares the store to tabix for the same regions of the same records,
+// getting a field of each so that the cost of parsing the INFO is included.
+func BenchmarkQuery(b *testing.B) {
+	fields := []string{"AC_Adj", "AF", "AC_AFR"}
+	s := build(b, fields)
+	defer s.Close()
+	t, err := bix.New("../example/exac.vcf.gz", 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer t.Close()
+
+	var regions []interfaces.IPosition
+	for start := 13000; start < 100000; start += 5000 {
+		regions = append(regions, parsers.NewInterval("1", uint32(start), uint32(start+5000), nil, 0, nil))
+	}
+	for _, q := range []struct {
+		name string
+		q    interfaces.Queryable
+	}{{"vst", s}, {"tabix", t}} {
+		b.Run(q.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, region := range regions {
+					for _, v := range all(b, q.q, region) {
+						if _, err := v.Info().Get("AF"); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package varid
+
+import "strings"
+
+// accessions are the RefSeq accessions of the chromosomes of GRCh37 and GRCh38.
+var accessions = map[string][]string{
+	"GRCh37": {"NC_000001.10", "NC_000002.11", "NC_000003.11", "NC_000004.11", "NC_000005.9", "NC_000006.11",
+		"NC_000007.13", "NC_000008.10", "NC_000009.11", "NC_000010.10", "NC_000011.9", "NC_000012.11",
+		"NC_000013.10", "NC_000014.8", "NC_000015.9", "NC_000016.9", "NC_000017.10", "NC_000018.9",
+		"NC_000019.9", "NC_000020.10", "NC_000021.8", "NC_000022.10", "NC_000023.10", "NC_000024.9"},
+	"GRCh38": {"NC_000001.11", "NC_000002.12", "NC_000003.12", "NC_000004.12", "NC_000005.10", "NC_000006.12",
+		"NC_000007.14", "NC_000008.11", "NC_000009.12", "NC_000010.11", "NC_000011.10", "NC_000012.12",
+		"NC_000013.11", "NC_000014.9", "NC_000015.10", "NC_000016.10", "NC_000017.11", "NC_000018.10",
+		"NC_000019.10", "NC_000020.11", "NC_000021.9", "NC_000022.11", "NC_000023.11", "NC_000024.10"},
+}
+
+// mito is the accession of the mitochondrial genome (rCRS) in both builds.
+const mito = "NC_012920.1"
+
+// Accession gives the RefSeq accession of chrom in build (GRCh37 or GRCh38) or chrom
+// itself if it is not known.
+func Accession(build, chrom string) string {
+	accs, ok := accessions[build]
+	if !ok {
+		return chrom
+	}
+	k := strings.TrimPrefix(chrom, "chr")
+	switch k {
+	case "X":
+		return accs[22]
+	case "Y":
+		return accs[23]
+	case "MT":
+		return mito
+	case "M":
+		// chrM of hg19 is not the rCRS.
+		if build == "GRCh38" {
+			return mito
+		}
+		return chrom
+	}
+	n := 0
+	for _, r := range k {
+		if r < '0' || r > '9' {
+			return chrom
+		}
+		n = 10*n + int(r-'0')
+	}
+	if n < 1 || n > 22 {
+		return chrom
+	}
+	return accs[n-1]
+}
@@ -0,0 +1,225 @@
+// Package varid gives standard identifiers for a variant (NCBI SPDI, HGVS genomic
+// notation and GA4GH VRS allele digests) after normalizing it with the reference.
+package varid
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrRefMismatch occurs when REF does not match the reference.
+	ErrRefMismatch = errors.New("REF does not match the reference")
+	// ErrUnsupported occurs for an allele that is not a sequence (e.g. <DEL> or *) or
+	// that is the same as REF.
+	ErrUnsupported = errors.New("allele can not be normalized")
+)
+
+// Reference gives the sequence of the genome of a variant. fasta.Reader meets it.
+type Reference interface {
+	// Seq gives the upper-case sequence of [start, end) on chrom clipped to the contig.
+	// ok is false if chrom is not in the reference.
+	Seq(chrom string, start, end int) (seq string, ok bool, err error)
+	Length(chrom string) int
+	// Refget gives the refget digest (SQ.*) of the sequence of chrom.
+	Refget(chrom string) (string, error)
+}
+
+// Allele is a variant normalized as by NCBI VOCA (fully justified). For an insertion or
+// deletion, [Start, End) is the region over which its position is ambiguous and Ref and
+// Alt are the sequence of that region before and after the change; otherwise REF and
+// ALT are only trimmed of shared bases.
+type Allele struct {
+	Chrom      string
+	Start, End int
+	Ref, Alt   string
+	// Indel is the inserted or deleted sequence shifted to the 3' end of the region. It
+	// is empty for a substitution.
+	Indel string
+}
+
+// Insertion indicates that a is an insertion.
+func (a Allele) Insertion() bool { return a.Indel != "" && len(a.Alt) > len(a.Ref) }
+
+// Deletion indicates that a is a deletion.
+func (a Allele) Deletion() bool { return a.Indel != "" && len(a.Alt) < len(a.Ref) }
+
+// window is the number of bases read at a time while shifting an indel.
+const window = 256
+
+// cursor reads the reference around a variant.
+type cursor struct {
+	ref   Reference
+	chrom string
+	start int
+	seq   string
+}
+
+func (c *cursor) base(i int) (byte, error) {
+	if i < c.start || i >= c.start+len(c.seq) {
+		c.start = i - window/2
+		if c.start < 0 {
+			c.start = 0
+		}
+		s, _, err := c.ref.Seq(c.chrom, c.start, c.start+window)
+		if err != nil {
+			return 0, err
+		}
+		c.seq = s
+		if i >= c.start+len(c.seq) {
+			return 0, nil
+		}
+	}
+	return c.seq[i-c.start], nil
+}
+
+func isSequence(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case 'A', 'C', 'G', 'T', 'N':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Normalize gives the Allele for ref > alt at the 0-based pos on chrom.
+func Normalize(r Reference, chrom string, pos int, ref, alt string) (Allele, error) {
+	ref, alt = strings.ToUpper(ref), strings.ToUpper(alt)
+	if !isSequence(ref) || !isSequence(alt) || ref == alt {
+		return Allele{}, ErrUnsupported
+	}
+	seq, ok, err := r.Seq(chrom, pos, pos+len(ref))
+	if err != nil {
+		return Allele{}, err
+	}
+	if !ok || len(seq) != len(ref) {
+		return Allele{}, fmt.Errorf("%w: %s:%d is not in the reference", ErrRefMismatch, chrom, pos+1)
+	}
+	for i := 0; i < len(seq); i++ {
+		if seq[i] != ref[i] && ref[i] != 'N' && seq[i] != 'N' {
+			return Allele{}, fmt.Errorf("%w: %s at %s:%d is %s", ErrRefMismatch, ref, chrom, pos+1, seq)
+		}
+	}
+	ref = seq
+
+	// trim the shared suffix and then the shared prefix.
+	for len(ref) > 0 && len(alt) > 0 && ref[len(ref)-1] == alt[len(alt)-1] {
+		ref, alt = ref[:len(ref)-1], alt[:len(alt)-1]
+	}
+	for len(ref) > 0 && len(alt) > 0 && ref[0] == alt[0] {
+		ref, alt, pos = ref[1:], alt[1:], pos+1
+	}
+	if len(ref) > 0 && len(alt) > 0 {
+		return Allele{Chrom: chrom, Start: pos, End: pos + len(ref), Ref: ref, Alt: alt}, nil
+	}
+
+	// x is the inserted or deleted sequence which is shifted while the base before (or
+	// after) it is the same as its last (or first) base. end is the position after x in
+	// the reference.
+	x, del := alt, false
+	if len(ref) > 0 {
+		x, del = ref, true
+	}
+	end := pos
+	if del {
+		end += len(x)
+	}
+	c := &cursor{ref: r, chrom: chrom}
+	left := []byte(x)
+	for pos > 0 {
+		b, err := c.base(pos - 1)
+		if err != nil {
+			return Allele{}, err
+		}
+		if b != left[len(left)-1] {
+			break
+		}
+		copy(left[1:], left[:len(left)-1])
+		left[0] = b
+		pos, end = pos-1, end-1
+	}
+	right := append([]byte(nil), left...)
+	l := r.Length(chrom)
+	for end < l {
+		b, err := c.base(end)
+		if err != nil {
+			return Allele{}, err
+		}
+		if b != right[0] {
+			break
+		}
+		copy(right, right[1:])
+		right[len(right)-1] = b
+		end++
+	}
+	region, _, err := r.Seq(chrom, pos, end)
+	if err != nil {
+		return Allele{}, err
+	}
+	a := Allele{Chrom: chrom, Start: pos, End: end, Ref: region, Indel: string(right)}
+	if del {
+		a.Alt = region[len(x):]
+	} else {
+		a.Alt = string(left) + region
+	}
+	return a, nil
+}
+
+// SPDI gives the canonical SPDI of a on the sequence acc.
+func SPDI(a Allele, acc string) string {
+	return fmt.Sprintf("%s:%d:%s:%s", acc, a.Start, a.Ref, a.Alt)
+}
+
+// HGVS gives the HGVS genomic (g.) notation of a on the sequence acc with the 3' rule.
+func HGVS(a Allele, acc string) string {
+	k := len(a.Indel)
+	var desc string
+	switch {
+	case a.Deletion():
+		desc = span(a.End-k+1, a.End) + "del"
+	case a.Insertion() && len(a.Ref) >= k:
+		// the 3'-most inserted bases are the same as those before them.
+		desc = span(a.End-k+1, a.End) + "dup"
+	case a.Insertion():
+		desc = fmt.Sprintf("%d_%dins%s", a.End, a.End+1, a.Indel)
+	case len(a.Ref) == 1 && len(a.Alt) == 1:
+		desc = fmt.Sprintf("%d%s>%s", a.Start+1, a.Ref, a.Alt)
+	default:
+		desc = span(a.Start+1, a.End) + "delins" + a.Alt
+	}
+	return acc + ":g." + desc
+}
+
+// span gives the 1-based, inclusive range s_e or s if they are the same.
+func span(s, e int) string {
+	if s == e {
+		return strconv.Itoa(s)
+	}
+	return fmt.Sprintf("%d_%d", s, e)
+}
+
+// digest is the sha512t24u digest used by GA4GH.
+func digest(b []byte) string {
+	sum := sha512.Sum512(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:24])
+}
+
+// VRS gives the GA4GH VRS (version 2) digest of a on the sequence with the refget
+// digest seq. An insertion or deletion in a repeat (where Ref is not empty) is given as
+// a ReferenceLengthExpression.
+func VRS(a Allele, seq string) string {
+	loc := fmt.Sprintf(`{"end":%d,"sequenceReference":{"refgetAccession":"%s","type":"SequenceReference"},"start":%d,"type":"SequenceLocation"}`,
+		a.End, seq, a.Start)
+	state := fmt.Sprintf(`{"sequence":"%s","type":"LiteralSequenceExpression"}`, a.Alt)
+	if a.Indel != "" && len(a.Ref) > 0 {
+		state = fmt.Sprintf(`{"length":%d,"repeatSubunitLength":%d,"type":"ReferenceLengthExpression"}`, len(a.Alt), len(a.Indel))
+	}
+	allele := fmt.Sprintf(`{"location":"%s","state":%s,"type":"Allele"}`, digest([]byte(loc)), state)
+	return "ga4gh:VA." + digest([]byte(allele))
+}
@@ -0,0 +1,116 @@
+package varid
+
+import (
+	"errors"
+	"testing"
+)
+
+// seqRef is a Reference with a single sequence named 1.
+type seqRef string
+
+func (s seqRef) Seq(chrom string, start, end int) (string, bool, error) {
+	if chrom != "1" {
+		return "", false, nil
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > len(s) {
+		end = len(s)
+	}
+	if end <= start {
+		return "", true, nil
+	}
+	return string(s[start:end]), true, nil
+}
+
+func (s seqRef) Length(chrom string) int { return len(s) }
+
+func (s seqRef) Refget(chrom string) (string, error) { return "SQ." + digest([]byte(s)), nil }
+
+func TestNormalize(t *testing.T) {
+	// 0-based:          0123456789012345
+	ref := seqRef("TTGCACACAGTAAAAC")
+	for _, c := range []struct {
+		pos            int
+		ref, alt       string
+		spdi, hgvs     string
+		rle            bool
+		insertion, del bool
+	}{
+		{10, "T", "C", "1:10:T:C", "1:g.11T>C", false, false, false},
+		{2, "GCA", "G", "1:3:CACACA:CACA", "1:g.8_9del", true, false, true},
+		{3, "C", "CAC", "1:3:CACACA:CACACACA", "1:g.8_9dup", true, true, false},
+		{10, "T", "TG", "1:11::G", "1:g.11_12insG", false, true, false},
+		{10, "TA", "T", "1:11:AAAA:AAA", "1:g.15del", true, false, true},
+		{12, "AA", "A", "1:11:AAAA:AAA", "1:g.15del", true, false, true},
+		{2, "GC", "TT", "1:2:GC:TT", "1:g.3_4delinsTT", false, false, false},
+		{0, "tt", "ta", "1:1:T:A", "1:g.2T>A", false, false, false},
+	} {
+		a, err := Normalize(ref, "1", c.pos, c.ref, c.alt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := SPDI(a, "1"); s != c.spdi {
+			t.Errorf("%d %s>%s: expected SPDI %s, got %s", c.pos, c.ref, c.alt, c.spdi, s)
+		}
+		if h := HGVS(a, "1"); h != c.hgvs {
+			t.Errorf("%d %s>%s: expected HGVS %s, got %s", c.pos, c.ref, c.alt, c.hgvs, h)
+		}
+		if a.Insertion() != c.insertion || a.Deletion() != c.del {
+			t.Errorf("%d %s>%s: bad kind %+v", c.pos, c.ref, c.alt, a)
+		}
+		seq, _ := ref.Refget("1")
+		if v := VRS(a, seq); len(v) != len("ga4gh:VA.")+32 {
+			t.Errorf("bad VRS %s", v)
+		}
+	}
+
+	// equivalent representations have the same identifiers.
+	a, _ := Normalize(ref, "1", 4, "A", "ACA")
+	b, _ := Normalize(ref, "1", 8, "A", "ACA")
+	if a != b {
+		t.Errorf("expected the same allele, got %+v and %+v", a, b)
+	}
+
+	if _, err := Normalize(ref, "1", 0, "A", "G"); !errors.Is(err, ErrRefMismatch) {
+		t.Errorf("expected ErrRefMismatch, got %v", err)
+	}
+	if _, err := Normalize(ref, "2", 0, "A", "G"); !errors.Is(err, ErrRefMismatch) {
+		t.Errorf("expected ErrRefMismatch for missing chrom, got %v", err)
+	}
+	for _, alt := range []string{"<DEL>", "*", "T"} {
+		if _, err := Normalize(ref, "1", 0, "T", alt); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("expected ErrUnsupported for %s, got %v", alt, err)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	// from the GA4GH VRS documentation.
+	if d := digest([]byte("ACGT")); d != "aKF498dAxcJAqme6QYQ7EZ07-fiw8Kw2" {
+		t.Errorf("got %s", d)
+	}
+	// the example of computed identifiers from the VRS 2.0 documentation: rs7412
+	// (NC_000019.10:g.44908822C>T).
+	a := Allele{Chrom: "19", Start: 44908821, End: 44908822, Ref: "C", Alt: "T"}
+	if v := VRS(a, "SQ.IIB53T8CNeJJdUqzn9V_JnRtQadwWCbl"); v != "ga4gh:VA.0AePZIWZUNsUlQTamyLrjm2HWUw2opLt" {
+		t.Errorf("got %s", v)
+	}
+}
+
+func TestAccession(t *testing.T) {
+	for _, c := range [][3]string{
+		{"GRCh38", "chr1", "NC_000001.11"},
+		{"GRCh37", "X", "NC_000023.10"},
+		{"GRCh37", "22", "NC_000022.10"},
+		{"GRCh38", "chrM", "NC_012920.1"},
+		{"GRCh37", "chrM", "chrM"},
+		{"GRCh37", "GL000192.1", "GL000192.1"},
+		{"", "1", "1"},
+	} {
+		if acc := Accession(c[0], c[1]); acc != c[2] {
+			t.Errorf("%s %s: expected %s, got %s", c[0], c[1], c[2], acc)
+		}
+	}
+}
@@ -2,6 +2,9 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,25 +12,30 @@ import (
 
 	//_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/biogo/hts/bgzf"
-	"github.com/brentp/irelate"
-	"github.com/brentp/irelate/interfaces"
-	"github.com/brentp/irelate/parsers"
 	. "github.com/brentp/vcfanno/api"
+	_ "github.com/brentp/vcfanno/columnar"
+	_ "github.com/brentp/vcfanno/consequence"
 	. "github.com/brentp/vcfanno/shared"
-	"github.com/brentp/vcfgo"
+	_ "github.com/brentp/vcfanno/sqlite"
 	"github.com/brentp/xopen"
 )
 
 const VERSION = "0.3.9"
 
+// ExitInterrupted is the exit code when vcfanno is stopped by SIGINT or SIGTERM.
+// The output is then valid up to the last reported position and the run can be retried.
+const ExitInterrupted = 3
+
 func envGet(name string, vdefault int) int {
 	sval := os.Getenv(name)
 	var err error
@@ -47,6 +55,10 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "build-store" {
+		buildStore(os.Args[2:])
+		return
+	}
 	fmt.Fprintf(os.Stderr, `
 =============================================
 vcfanno version %s [built with %s]
@@ -61,13 +73,19 @@ see: https://github.com/brentp/vcfanno
 	lua := flag.String("lua", "", "optional path to a file containing custom lua functions to be used as ops")
 	base := flag.String("base-path", "", "optional base-path to prepend to annotation files in the config")
 	procs := flag.Int("p", 2, "number of processes to use.")
+	allowBuild := flag.Bool("allow-build-mismatch", false, "annotate even if the query and annotations are from different genome builds.")
+	liftover := flag.String("liftover", "", "optional UCSC chain file (e.g. hg19ToHg38.over.chain.gz) from the build of the query to that of the annotations.")
+	fasta := flag.String("fasta", "", "optional reference FASTA for annotations with file=\"fasta:\" (e.g. fields context, gc50 and ref_match), file=\"consequence:genes.gtf.gz\", CRAMs, left-aligning indels lifted from the - strand and the spdi, hgvs and vrs postannotation ops.")
+	unsorted := flag.Bool("unsorted", false, "annotate a query that is not sorted by querying the annotations for each variant (slower).")
+	floatFormat := flag.String("float-format", "", "optional format (e.g. '%.6g') for Float values from numeric ops. default is to let vcfgo decide.")
 	flag.Parse()
 	inFiles := flag.Args()
 	if len(inFiles) != 2 {
 		fmt.Printf(`Usage:
 %s config.toml input.vcf > annotated.vcf
+%s build-store [options] annotation.vcf.gz
 
-`, os.Args[0])
+`, os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
@@ -86,48 +104,15 @@ see: https://github.com/brentp/vcfanno
 		panic(err)
 	}
 	config.Base = *base
-	for _, a := range config.Annotation {
-		err := CheckAnno(&a)
-		if err != nil {
-			log.Fatal("CheckAnno err:", err)
-		}
-		for _, op := range a.Ops {
-			if len(op) > 4 && op[:4] == "lua:" && *lua == "" {
-				log.Fatal("ERROR: requested lua op without specifying -lua flag")
-			}
-		}
-	}
-	for i := range config.PostAnnotation {
-		r := config.PostAnnotation[i]
-		err := CheckPostAnno(&r)
-		if err != nil {
-			log.Fatal(fmt.Sprintf("error in postannotation section %s err: %s", r.Name, err))
-		}
-		if len(r.Op) > 4 && r.Op[:4] == "lua:" && *lua == "" {
-			log.Fatal("ERROR: requested lua op without specifying -lua flag")
-		}
+	if config.UsesLua() && *lua == "" {
+		log.Fatal("ERROR: requested lua op without specifying -lua flag")
 	}
 
-	sources, e := config.Sources()
-	if e != nil {
-		log.Fatal(e)
+	luaString, err := ReadLua(*lua)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	log.Printf("found %d sources from %d files\n", len(sources), len(config.Annotation))
-	/*
-		go func() {
-			log.Println(http.ListenAndServe("localhost:6060", nil))
-		}()
-	*/
-
-	luaString := ReadLua(*lua)
-	strict := !*notstrict
-	var a = NewAnnotator(sources, luaString, *ends, strict, config.PostAnnotation)
-
-	var out io.Writer = os.Stdout
-	defer os.Stdout.Close()
-
-	var err error
 	var qrdr io.Reader
 	// try to parallelize reading if we have plenty of CPUs and it's (possibly)
 	// a bgzf file.
@@ -159,19 +144,6 @@ see: https://github.com/brentp/vcfanno
 	if err != nil {
 		log.Fatal(fmt.Errorf("error opening query file %s: %s", queryFile, err))
 	}
-	qstream, query, err := parsers.VCFIterator(qrdr)
-	if err != nil {
-		log.Fatal(fmt.Errorf("error parsing VCF query file %s: %s", queryFile, err))
-	}
-
-	queryables, err := a.Setup(query)
-	if err != nil {
-		log.Fatal(err)
-	}
-	aends := INTERVAL
-	if *ends {
-		aends = BOTH
-	}
 
 	lastMsg := struct {
 		sync.RWMutex
@@ -179,73 +151,84 @@ see: https://github.com/brentp/vcfanno
 		i int
 	}{}
 
-	fn := func(v interfaces.Relatable) {
-		e := a.AnnotateEnds(v, aends)
-		if e != nil {
-			lastMsg.RLock()
-			em := e.Error()
-			found := false
-			for i := len(lastMsg.s) - 1; i >= 0; i-- {
-				if em == lastMsg.s[i] {
-					found = true
-					break
-				}
+	warn := func(e error) {
+		lastMsg.RLock()
+		em := e.Error()
+		found := false
+		for i := len(lastMsg.s) - 1; i >= 0; i-- {
+			if em == lastMsg.s[i] {
+				found = true
+				break
 			}
-			if !found {
-				log.Println(e, ">> this error/warning may occur many times. reporting once here...")
-				lastMsg.RUnlock()
-				lastMsg.Lock()
-				lastMsg.s[lastMsg.i] = em
-				if lastMsg.i == len(lastMsg.s)-1 {
-					lastMsg.i = -1
-				}
-				lastMsg.i++
-
-				lastMsg.Unlock()
-			} else {
-				lastMsg.RUnlock()
+		}
+		if !found {
+			log.Println(e, ">> this error/warning may occur many times. reporting once here...")
+			lastMsg.RUnlock()
+			lastMsg.Lock()
+			lastMsg.s[lastMsg.i] = em
+			if lastMsg.i == len(lastMsg.s)-1 {
+				lastMsg.i = -1
 			}
+			lastMsg.i++
+
+			lastMsg.Unlock()
+		} else {
+			lastMsg.RUnlock()
 		}
 	}
 
-	maxGap := envGet("IRELATE_MAX_GAP", 20000)
-	maxChunk := envGet("IRELATE_MAX_CHUNK", 8000)
-
-	// make a new writer from the string header.
-	query.Header.Extras = append(query.Header.Extras, fmt.Sprintf("##vcfanno=%s", VERSION))
-	out, err = vcfgo.NewWriter(out, query.Header)
-
-	stream := irelate.PIRelate(maxChunk, maxGap, qstream, *ends, fn, queryables...)
-
+	opts := Options{
+		Lua:                luaString,
+		Ends:               *ends,
+		Permissive:         *notstrict,
+		MaxGap:             envGet("IRELATE_MAX_GAP", 20000),
+		MaxChunk:           envGet("IRELATE_MAX_CHUNK", 8000),
+		Version:            VERSION,
+		Warn:               warn,
+		Unsorted:           *unsorted,
+		AllowBuildMismatch: *allowBuild,
+		FloatFormat:        *floatFormat,
+		Liftover:           *liftover,
+		Fasta:              *fasta,
+	}
+
+	// on SIGINT/SIGTERM, stop reading the query and write the variants already read
+	// so the output is valid (but partial). A second signal exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer os.Stdout.Close()
+	res, err := Run(ctx, config, qrdr, out, opts)
+	if ferr := out.Flush(); ferr != nil && err == nil {
+		err = ferr
+	}
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		printTime(res.Duration, res.Variants)
+		log.Printf("interrupted. output is complete up to %s:%d", res.Chrom, res.Pos)
+		os.Stdout.Close()
+		os.Exit(ExitInterrupted)
+	}
+	if errors.Is(err, ErrBuildMismatch) {
+		log.Fatalf("ERROR: %s. use -allow-build-mismatch to annotate anyway.", err)
+	}
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("ERROR: %s", err)
 	}
-
-	start := time.Now()
-	n := 0
-
-	/*
-		if os.Getenv("IRELATE_PROFILE") == "TRUE" {
-			log.Println("profiling to: irelate.pprof")
-			f, err := os.Create("irelate.pprof")
-			if err != nil {
-				panic(err)
-			}
-			pprof.StartCPUProfile(f)
-			defer pprof.StopCPUProfile()
-		}
-	*/
-
-	for interval := range stream {
-		//log.Printf("%v\n", interval)
-		fmt.Fprintln(out, interval)
-		n++
+	if res.Unlifted > 0 {
+		log.Printf("%d variants could not be lifted over and were not annotated from the lifted annotations", res.Unlifted)
+	}
+	if res.Unmapped > 0 {
+		log.Printf("lifted annotations were skipped %d times as they could not be mapped back to the query (e.g. not within a single block of the chain)", res.Unmapped)
 	}
-	printTime(start, n)
+	printTime(res.Duration, res.Variants)
 }
 
-func printTime(start time.Time, n int) {
-	dur := time.Since(start)
+func printTime(dur time.Duration, n int) {
 	duri, duru := dur.Seconds(), "second"
 	log.Printf("annotated %d variants in %.2f %ss (%.1f / %s)", n, duri, duru, float64(n)/duri, duru)
 }